@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// A REST API for the user data, on top of any Database.
+// ----------------------------------------------------------------------------
+
+// NewUserAPI serves the user data of a Database over HTTP, with JSON bodies:
+//
+//	GET    /users?limit=100&cursor=...  lists the users in ID order: {"users": [{"id": ..., "data": ...}], "next": "..."}
+//	GET    /users/{id}                  returns {"id": ..., "data": ...}, or 404
+//	PUT    /users/{id}                  saves {"data": ...}: 201 if the user is new, 200 if it was updated
+//	DELETE /users/{id}                  deletes the user: 204, or 404
+//
+// The ETag of a user is the version of its value (see version.go). GET and PUT return it, and the requests take the usual preconditions:
+// If-None-Match on a GET answers 304 while the user is unchanged, If-Match on a PUT or a DELETE makes it fail with 412
+// if somebody else wrote the user in the meantime, and "If-None-Match: *" on a PUT only creates a user.
+//
+// Errors come as {"error": "..."} with a status that says whose fault it is: 400 for a bad request, 413 for a body over maxBodySize,
+// 409 for a user that other writers kept changing, 507 when the database is full or a tenant is over its quota,
+// 503 for an injected fault (see faults.go), and 500 for anything else.
+// An API over the fake, with faults, is how a client's error handling gets tested.
+//
+// "go run . serve" runs the API, over the fake or the real database (see runServe).
+
+// A PUT without a precondition, or with "If-Match: *", reads the version of the user and saves with CompareAndSwap,
+// and tries again if another writer got in between: the ETag it returns is the version of its own write.
+// A DELETE with If-Match deletes with CompareAndDelete the same way. Each try checks the precondition against the version it read.
+// The tries wait and give up like the ones of Update (see version.go): NewUserAPI takes its options, and gives up after
+// defaultAPIAttempts unless WithMaxAttempts says otherwise. A user that kept changing all along is a 409.
+
+// defaultAPIAttempts is how many times a PUT or a DELETE tries to write before it gives up.
+const defaultAPIAttempts = 10
+
+// maxBodySize is the largest body a PUT takes.
+const maxBodySize = 1 << 20
+
+// maxListLimit is the largest page a list returns.
+const maxListLimit = 1000
+
+// UserData is the JSON of a user in the API.
+type UserData struct {
+	ID   string `json:"id"`
+	Data string `json:"data"`
+}
+
+// UserList is a page of users; Next is the cursor of the next page, empty on the last one.
+type UserList struct {
+	Users []UserData `json:"users"`
+	Next  string     `json:"next,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// errPreconditionFailed is returned when the version of a user doesn't satisfy the precondition of a request.
+var errPreconditionFailed = errors.New("precondition failed")
+
+type userAPI struct {
+	db Database
+	// retries says how the writes try again after a conflict
+	retries updateConfig
+}
+
+// NewUserAPI returns the handler of the API over db. The options bound the retries of the writes, as they bound Update.
+func NewUserAPI(db Database, opts ...UpdateOption) http.Handler {
+	api := &userAPI{db: db, retries: newUpdateConfig(append([]UpdateOption{WithMaxAttempts(defaultAPIAttempts)}, opts...))}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users", api.list)
+	mux.HandleFunc("GET /users/{id}", api.get)
+	mux.HandleFunc("PUT /users/{id}", api.put)
+	mux.HandleFunc("DELETE /users/{id}", api.delete)
+	return mux
+}
+
+func (api *userAPI) list(w http.ResponseWriter, r *http.Request) {
+	opts := ScanOptions{Cursor: r.URL.Query().Get("cursor")}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxListLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q: expected a number from 1 to %d", limit, maxListLimit))
+			return
+		}
+		opts.Limit = n
+	}
+	if _, _, err := decodeCursor(opts.Cursor); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	page, err := api.db.Scan(r.Context(), opts)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	list := UserList{Users: make([]UserData, len(page.Entries)), Next: page.Cursor}
+	for i, entry := range page.Entries {
+		list.Users[i] = UserData{ID: entry.Key, Data: entry.Value}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (api *userAPI) get(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	data, version, err := api.db.GetVersion(r.Context(), id)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	if version == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("user %q not found", id))
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	if matches(r.Header.Get("If-None-Match"), version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, UserData{ID: id, Data: data})
+}
+
+func (api *userAPI) put(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var body struct {
+		ID   string  `json:"id"`
+		Data *string `json:"data"`
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("the body is larger than %d bytes", maxBodySize))
+			return
+		}
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+	switch {
+	case body.Data == nil:
+		writeError(w, http.StatusBadRequest, errors.New(`invalid body: expected {"data": ...}`))
+		return
+	case body.ID != "" && body.ID != id:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("the body is for user %q, not %q", body.ID, id))
+		return
+	}
+
+	// the precondition, if any, decides which versions the write may replace
+	allowed := func(version uint64) bool { return true }
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		allowed = func(version uint64) bool { return version != 0 && matches(ifMatch, version) }
+	} else if r.Header.Get("If-None-Match") == "*" {
+		allowed = func(version uint64) bool { return version == 0 }
+	}
+	created, version, err := api.save(r.Context(), id, *body.Data, allowed)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	if created {
+		w.Header().Set("Location", "/users/"+id)
+		writeJSON(w, http.StatusCreated, UserData{ID: id, Data: *body.Data})
+		return
+	}
+	writeJSON(w, http.StatusOK, UserData{ID: id, Data: *body.Data})
+}
+
+// save saves data under id if the current version of id is allowed, and returns whether it created the user and the new version.
+func (api *userAPI) save(ctx context.Context, id, data string, allowed func(version uint64) bool) (bool, uint64, error) {
+	var created bool
+	var newVersion uint64
+	err := api.retries.retry(ctx, fmt.Sprintf("saving %q", id), func() error {
+		_, version, err := api.db.GetVersion(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !allowed(version) {
+			return fmt.Errorf("%w: user %q has version %d", errPreconditionFailed, id, version)
+		}
+		created = version == 0
+		newVersion, err = api.db.CompareAndSwap(ctx, id, version, data)
+		return err
+	})
+	return created, newVersion, err
+}
+
+func (api *userAPI) delete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	existed, err := api.remove(r.Context(), id, r.Header.Get("If-Match"))
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	if !existed {
+		writeError(w, http.StatusNotFound, fmt.Errorf("user %q not found", id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remove deletes id, if its version matches ifMatch when there is one, and reports whether it existed.
+func (api *userAPI) remove(ctx context.Context, id, ifMatch string) (bool, error) {
+	if ifMatch == "" {
+		return api.db.Delete(ctx, id)
+	}
+	err := api.retries.retry(ctx, fmt.Sprintf("deleting %q", id), func() error {
+		_, version, err := api.db.GetVersion(ctx, id)
+		if err != nil {
+			return err
+		}
+		if version == 0 || !matches(ifMatch, version) {
+			return fmt.Errorf("%w: user %q has version %d", errPreconditionFailed, id, version)
+		}
+		return api.db.CompareAndDelete(ctx, id, version)
+	})
+	return err == nil, err
+}
+
+// etag returns the ETag of a version.
+func etag(version uint64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// matches reports whether the ETags of an If-Match or If-None-Match header include version; "*" matches any version.
+// The comparison is weak: W/"1" matches version 1 too.
+func matches(header string, version uint64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// writeDatabaseError answers with the status that goes with an error of the database.
+func writeDatabaseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errPreconditionFailed), errors.Is(err, ErrTxConflict):
+		writeError(w, http.StatusPreconditionFailed, err)
+	case errors.Is(err, ErrVersionConflict):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrDatabaseFull), errors.Is(err, ErrQuotaExceeded):
+		writeError(w, http.StatusInsufficientStorage, err)
+	case errors.Is(err, ErrInjectedFault):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// runServe runs the API until it is interrupted:
+//
+//	go run . serve -addr 127.0.0.1:8080 -backend fake -data ./data
+//	go run . serve -backend real -data users.db
+//
+// The -backend and -data flags choose the database (see addBackendFlags).
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:8080", "the address to listen on")
+	backend := addBackendFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	db, name, closeDB, err := backend.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	server := &http.Server{Addr: *addr, Handler: NewUserAPI(db), ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	fmt.Printf("%s - serving the user API on http://%s\n", name, *addr)
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdown)
+}
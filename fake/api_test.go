@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------
+// The REST API, end to end.
+// ----------------------------------------------------------------------------
+
+// apiClient sends requests to an API over a database, and checks their status.
+type apiClient struct {
+	t      *testing.T
+	server *httptest.Server
+}
+
+func newAPIClient(t *testing.T, db Database, opts ...UpdateOption) *apiClient {
+	server := httptest.NewServer(NewUserAPI(db, opts...))
+	t.Cleanup(server.Close)
+	return &apiClient{t: t, server: server}
+}
+
+// do sends a request with body and headers ("name: value"), checks its status, and returns the response and its body.
+func (c *apiClient) do(method, path, body string, status int, headers ...string) (*http.Response, string) {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("unexpected error: %v", err)
+	}
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ": ")
+		req.Header.Set(name, value)
+	}
+	resp, err := c.server.Client().Do(req)
+	if err != nil {
+		c.t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != status {
+		c.t.Errorf("%s %s: expected status %d, but got: %d %s", method, path, status, resp.StatusCode, data)
+	}
+	return resp, string(data)
+}
+
+// user decodes the body of a response about one user.
+func (c *apiClient) user(body string) UserData {
+	c.t.Helper()
+	var user UserData
+	if err := json.Unmarshal([]byte(body), &user); err != nil {
+		c.t.Fatalf("decoding %q: %v", body, err)
+	}
+	return user
+}
+
+// racingDatabase calls race right after every read of a version, to write behind the back of the reader.
+type racingDatabase struct {
+	*FakeDatabase
+	race func()
+}
+
+func (db *racingDatabase) GetVersion(ctx context.Context, key string) (string, uint64, error) {
+	value, version, err := db.FakeDatabase.GetVersion(ctx, key)
+	db.race()
+	return value, version, err
+}
+
+func TestUserAPI(t *testing.T) {
+	ctx := context.Background()
+
+	// "crud":
+	// users are created, read, listed, updated and deleted, over the fake and the real database alike.
+	for name, open := range map[string]func(t *testing.T) Database{
+		"fake": func(t *testing.T) Database { return NewFakeDatabase() },
+		"real": func(t *testing.T) Database { return openRealDatabase(t) },
+	} {
+		t.Run("crud on the "+name+" database", func(t *testing.T) {
+			c := newAPIClient(t, open(t))
+			resp, body := c.do("PUT", "/users/user1", `{"data": "data 1"}`, http.StatusCreated)
+			if resp.Header.Get("Location") != "/users/user1" || resp.Header.Get("ETag") == "" {
+				t.Errorf("expected a location and an ETag, but got: %v", resp.Header)
+			}
+			if user := c.user(body); user != (UserData{ID: "user1", Data: "data 1"}) {
+				t.Errorf("unexpected user: %+v", user)
+			}
+			created := resp.Header.Get("ETag")
+
+			resp, body = c.do("GET", "/users/user1", "", http.StatusOK)
+			if user := c.user(body); user.Data != "data 1" || resp.Header.Get("ETag") != created {
+				t.Errorf("expected data 1 with ETag %s, but got: %+v with %s", created, user, resp.Header.Get("ETag"))
+			}
+			if resp.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("expected JSON, but got: %s", resp.Header.Get("Content-Type"))
+			}
+
+			resp, _ = c.do("PUT", "/users/user1", `{"id": "user1", "data": "new data"}`, http.StatusOK)
+			if resp.Header.Get("ETag") == created {
+				t.Errorf("expected a new ETag")
+			}
+			c.do("PUT", "/users/user2", `{"data": "data 2"}`, http.StatusCreated)
+			_, body = c.do("GET", "/users", "", http.StatusOK)
+			if body != `{"users":[{"id":"user1","data":"new data"},{"id":"user2","data":"data 2"}]}`+"\n" {
+				t.Errorf("unexpected list: %s", body)
+			}
+
+			c.do("DELETE", "/users/user1", "", http.StatusNoContent)
+			c.do("GET", "/users/user1", "", http.StatusNotFound)
+			c.do("DELETE", "/users/user1", "", http.StatusNotFound)
+		})
+	}
+
+	// "etags":
+	// the preconditions of a request are checked against the version of the user.
+	t.Run("etags", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		c := newAPIClient(t, fakeDB)
+		resp, _ := c.do("PUT", "/users/user1", `{"data": "data 1"}`, http.StatusCreated)
+		first := resp.Header.Get("ETag")
+		c.do("GET", "/users/user1", "", http.StatusNotModified, "If-None-Match: "+first)
+		c.do("GET", "/users/user1", "", http.StatusNotModified, `If-None-Match: "0", W/`+first)
+		c.do("PUT", "/users/user1", `{"data": "data 1"}`, http.StatusPreconditionFailed, "If-None-Match: *")
+
+		// somebody else writes user1: the ETag read before is stale
+		SaveUserData(ctx, fakeDB, "user1", "changed")
+		c.do("GET", "/users/user1", "", http.StatusOK, "If-None-Match: "+first)
+		c.do("PUT", "/users/user1", `{"data": "lost update"}`, http.StatusPreconditionFailed, "If-Match: "+first)
+		c.do("DELETE", "/users/user1", "", http.StatusPreconditionFailed, "If-Match: "+first)
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "changed" {
+			t.Errorf("expected the stale requests to change nothing, but got: %q", data)
+		}
+
+		resp, _ = c.do("GET", "/users/user1", "", http.StatusOK)
+		resp, _ = c.do("PUT", "/users/user1", `{"data": "data 2"}`, http.StatusOK, "If-Match: "+resp.Header.Get("ETag"))
+		c.do("DELETE", "/users/user1", "", http.StatusNoContent, "If-Match: "+resp.Header.Get("ETag"))
+		c.do("PUT", "/users/user1", `{"data": "data 3"}`, http.StatusPreconditionFailed, "If-Match: *")
+		c.do("DELETE", "/users/user1", "", http.StatusPreconditionFailed, "If-Match: *")
+		c.do("PUT", "/users/user1", `{"data": "data 3"}`, http.StatusCreated, "If-None-Match: *")
+	})
+
+	// "delete racing a write":
+	// a write between the read of the version and the delete makes a DELETE with "If-Match: *" try again, and delete the new version.
+	t.Run("delete racing a write", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		var raced uint64
+		racingDB := &racingDatabase{FakeDatabase: fakeDB, race: sync.OnceFunc(func() {
+			raced, _ = fakeDB.CompareAndSwap(ctx, "user1", fakeDB.Seq(), "changed")
+		})}
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		c := newAPIClient(t, racingDB)
+		c.do("DELETE", "/users/user1", "", http.StatusNoContent, "If-Match: *")
+		if raced == 0 {
+			t.Fatalf("expected the write to happen during the DELETE")
+		}
+		AssertState(t, fakeDB, State{})
+	})
+
+	// "delete losing to a write":
+	// the same write fails a DELETE whose ETag is from before it.
+	t.Run("delete losing to a write", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		racingDB := &racingDatabase{FakeDatabase: fakeDB, race: sync.OnceFunc(func() {
+			fakeDB.CompareAndSwap(ctx, "user1", fakeDB.Seq(), "changed")
+		})}
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		c := newAPIClient(t, racingDB)
+		c.do("DELETE", "/users/user1", "", http.StatusPreconditionFailed, "If-Match: "+etag(fakeDB.Seq()))
+		AssertState(t, fakeDB, State{"user1": "changed"})
+	})
+
+	// "steady writes":
+	// a PUT or a DELETE that loses to a write on every try gives up after its attempts, with a 409.
+	t.Run("steady writes", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		reads := 0
+		racingDB := &racingDatabase{FakeDatabase: fakeDB, race: func() {
+			reads++
+			fakeDB.Save(ctx, "user1", fmt.Sprint("changed ", reads))
+		}}
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		c := newAPIClient(t, racingDB, WithMaxAttempts(3), WithBackoff(0, 0))
+		c.do("DELETE", "/users/user1", "", http.StatusConflict, "If-Match: *")
+		c.do("PUT", "/users/user1", `{"data": "mine"}`, http.StatusConflict)
+		if reads != 6 {
+			t.Errorf("expected 3 attempts each, but got: %d reads", reads)
+		}
+		AssertState(t, fakeDB, State{"user1": "changed 6"})
+	})
+
+	// "bad requests":
+	// a request the API can't make sense of is a 4xx, and changes nothing.
+	t.Run("bad requests", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		c := newAPIClient(t, fakeDB)
+		_, body := c.do("PUT", "/users/user1", `{"data": `, http.StatusBadRequest)
+		if !strings.HasPrefix(body, `{"error":"invalid body`) {
+			t.Errorf("expected a JSON error, but got: %s", body)
+		}
+		c.do("PUT", "/users/user1", `{"data": "x", "admin": true}`, http.StatusBadRequest)
+		c.do("PUT", "/users/user1", `{}`, http.StatusBadRequest)
+		c.do("PUT", "/users/user1", `{"id": "user2", "data": "x"}`, http.StatusBadRequest)
+		c.do("PUT", "/users/user1", `{"data": "`+strings.Repeat("x", maxBodySize)+`"}`, http.StatusRequestEntityTooLarge)
+		c.do("POST", "/users/user1", `{"data": "x"}`, http.StatusMethodNotAllowed)
+		c.do("GET", "/users?limit=0", "", http.StatusBadRequest)
+		c.do("GET", "/users?limit=many", "", http.StatusBadRequest)
+		c.do("GET", "/users?cursor=nonsense", "", http.StatusBadRequest)
+		AssertState(t, fakeDB, State{})
+	})
+
+	// "pages":
+	// a list is read page by page, following the next cursor.
+	t.Run("pages", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		for _, userID := range []string{"user1", "user2", "user3"} {
+			SaveUserData(ctx, fakeDB, userID, "data")
+		}
+		c := newAPIClient(t, fakeDB)
+		var ids []string
+		path := "/users?limit=2"
+		for pages := 0; path != ""; pages++ {
+			if pages == 3 {
+				t.Fatalf("expected 2 pages")
+			}
+			_, body := c.do("GET", path, "", http.StatusOK)
+			var list UserList
+			if err := json.Unmarshal([]byte(body), &list); err != nil {
+				t.Fatalf("decoding %q: %v", body, err)
+			}
+			for _, user := range list.Users {
+				ids = append(ids, user.ID)
+			}
+			path = ""
+			if list.Next != "" {
+				path = "/users?limit=2&cursor=" + list.Next
+			}
+		}
+		if strings.Join(ids, " ") != "user1 user2 user3" {
+			t.Errorf("expected user1 user2 user3, but got: %v", ids)
+		}
+	})
+
+	// "database errors":
+	// a fault of the database is a 503, a full database a 507; the client can tell them apart from its own mistakes.
+	t.Run("database errors", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxEntries(1), WithFaults(FailKeysMatching(regexp.MustCompile(`^broken$`))))
+		c := newAPIClient(t, fakeDB)
+		c.do("GET", "/users/broken", "", http.StatusServiceUnavailable)
+		c.do("PUT", "/users/broken", `{"data": "x"}`, http.StatusServiceUnavailable)
+		c.do("PUT", "/users/user1", `{"data": "x"}`, http.StatusCreated)
+		_, body := c.do("PUT", "/users/user2", `{"data": "x"}`, http.StatusInsufficientStorage)
+		if !strings.Contains(body, "database full") {
+			t.Errorf("expected the error of the database, but got: %s", body)
+		}
+	})
+
+	// "tenants":
+	// the API serves whatever Database it is given, a tenant's included.
+	t.Run("tenants", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		acme, err := ForTenant(fakeDB, "acme", WithTenantQuota(1))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c := newAPIClient(t, acme)
+		c.do("PUT", "/users/user1", `{"data": "x"}`, http.StatusCreated)
+		c.do("PUT", "/users/user2", `{"data": "x"}`, http.StatusInsufficientStorage)
+		AssertTenantIsolation(t, fakeDB, "acme")
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Batches: saving and reading many keys in one call.
+// ----------------------------------------------------------------------------
+
+// A bulk import that calls SaveUserData once per user pays for a round trip, a lock and, on the real database,
+// a transaction per user. SaveMany saves a whole batch in one call, and GetMany reads one:
+//
+//	err := db.SaveMany(ctx, []Entry{{Key: "user1", Value: "data 1"}, {Key: "user2", Value: "data 2"}})
+//	values, err := db.GetMany(ctx, []string{"user1", "user2", "user3"}) // user3 is missing from values
+//
+// SaveMany is all-or-nothing: every key is saved, without an expiry time, or none is. If a key appears twice, the last value wins.
+// GetMany returns the keys that exist; the fake reads them all at the same moment.
+//
+// On the fake, SaveMany is applied like a commit (see tx.go): one version, one record of the log, one set of events.
+// On the real database, it runs multi-row statements of up to realBatchSize rows in one transaction,
+// and GetMany runs one query per realBatchSize keys, so a larger GetMany may see writes made between its queries.
+
+// realBatchSize is the most rows a statement of SaveMany or GetMany handles; SQLite limits the number of parameters of a statement.
+const realBatchSize = 500
+
+func (db *FakeDatabase) SaveMany(ctx context.Context, entries []Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	writes := make(map[string]*string, len(entries))
+	for i := range entries {
+		// the values are only read while the batch is written
+		writes[entries[i].Key] = &entries[i].Value
+	}
+	_, err := db.writeBatch(writes, nil)
+	return err
+}
+
+func (db *FakeDatabase) GetMany(ctx context.Context, keys []string) (values map[string]string, err error) {
+	defer func() {
+		for _, key := range keys {
+			value, exists := values[key]
+			db.record(Op{Kind: OpGet, Key: key}, value, found(exists), err)
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := db.injectedFault(Op{Kind: OpGet, Key: key}); err != nil {
+			return nil, err
+		}
+	}
+
+	// holding the read locks of all the shards involved at once gives a consistent view of the keys
+	values = make(map[string]string, len(keys))
+	indexes := db.shardIndexes(slices.Values(keys))
+	for _, i := range indexes {
+		db.shards[i].mu.RLock()
+	}
+	now := db.clock.Now()
+	for _, key := range keys {
+		if it, exists := db.shardFor(key).data[key]; exists && !it.expired(now) {
+			values[key] = it.value
+		}
+	}
+	for _, i := range indexes {
+		db.shards[i].mu.RUnlock()
+	}
+	if db.evictor != nil {
+		for key := range values {
+			db.evictor.touch(key)
+		}
+	}
+	return values, nil
+}
+
+// realSaveManyQuery saves n keys, like realSaveQuery does one.
+func realSaveManyQuery(n int) string {
+	return `INSERT INTO kv (key, value, version, expires_at) VALUES ` +
+		strings.Repeat("(?, ?, "+realFirstVersion+", NULL), ", n-1) + "(?, ?, " + realFirstVersion + ", NULL)" + `
+ON CONFLICT (key) DO UPDATE SET value = excluded.value, version = kv.version + 1, expires_at = NULL`
+}
+
+// realGetManyQuery reads n keys, given as the first n parameters; the last one is the current time.
+func realGetManyQuery(n int) string {
+	return `SELECT key, value FROM kv WHERE key IN (` + strings.Repeat("?, ", n-1) + `?)
+AND (expires_at IS NULL OR expires_at > ?)`
+}
+
+// batches splits items into slices of at most realBatchSize.
+func batches[T any](items []T) [][]T {
+	var chunks [][]T
+	for len(items) > realBatchSize {
+		chunks = append(chunks, items[:realBatchSize])
+		items = items[realBatchSize:]
+	}
+	if len(items) > 0 {
+		chunks = append(chunks, items)
+	}
+	return chunks
+}
+
+// SaveMany uses the statement prepared for realBatchSize rows for every full batch, and prepares one for the rest.
+func (db *RealDatabase) SaveMany(ctx context.Context, entries []Entry) error {
+	// a key saved twice in one statement would count two versions: keep its last value only
+	last := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		last[entry.Key] = entry.Value
+	}
+	keys := slices.Sorted(maps.Keys(last))
+	if len(keys) == 0 {
+		return nil
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("saving %d keys: %w", len(keys), err)
+	}
+	defer tx.Rollback()
+	for _, batch := range batches(keys) {
+		args := make([]any, 0, 2*len(batch))
+		for _, key := range batch {
+			args = append(args, key, []byte(last[key]))
+		}
+		if len(batch) == realBatchSize {
+			_, err = tx.StmtContext(ctx, db.saveMany).ExecContext(ctx, args...)
+		} else {
+			_, err = tx.ExecContext(ctx, realSaveManyQuery(len(batch)), args...)
+		}
+		if err != nil {
+			return fmt.Errorf("saving %d keys: %w", len(keys), err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("saving %d keys: %w", len(keys), err)
+	}
+	return nil
+}
+
+func (db *RealDatabase) GetMany(ctx context.Context, keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	unique := slices.Compact(slices.Sorted(slices.Values(keys)))
+	for _, batch := range batches(unique) {
+		args := make([]any, 0, len(batch)+1)
+		for _, key := range batch {
+			args = append(args, key)
+		}
+		args = append(args, db.now())
+		if err := db.getBatch(ctx, batch, args, values); err != nil {
+			return nil, fmt.Errorf("getting %d keys: %w", len(keys), err)
+		}
+	}
+	return values, nil
+}
+
+func (db *RealDatabase) getBatch(ctx context.Context, batch []string, args []any, values map[string]string) error {
+	stmt := db.getMany
+	if len(batch) < realBatchSize {
+		prepared, err := db.db.PrepareContext(ctx, realGetManyQuery(len(batch)))
+		if err != nil {
+			return err
+		}
+		defer prepared.Close()
+		stmt = prepared
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		values[key] = string(value)
+	}
+	return rows.Err()
+}
+
+// SaveUserDataBatch saves the data of many users at once: either all of it is saved, or none is.
+func SaveUserDataBatch(ctx context.Context, db Database, records map[string]string) error {
+	entries := make([]Entry, 0, len(records))
+	for userID, userData := range records {
+		entries = append(entries, Entry{Key: userID, Value: userData})
+	}
+	return db.SaveMany(ctx, entries)
+}
+
+// GetUserDataBatch returns the data of the users that exist among userIDs.
+func GetUserDataBatch(ctx context.Context, db Database, userIDs []string) (map[string]string, error) {
+	return db.GetMany(ctx, userIDs)
+}
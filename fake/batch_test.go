@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Batches: saving and reading many keys in one call.
+// ----------------------------------------------------------------------------
+
+func TestBatches(t *testing.T) {
+	ctx := context.Background()
+
+	// "all or nothing":
+	// a fault on one key of a batch fails the whole batch, and saves nothing.
+	t.Run("all or nothing", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithFaults(FailKeysMatching(regexp.MustCompile(`^user2$`))))
+		SaveUserData(ctx, fakeDB, "user1", "old data")
+		err := SaveUserDataBatch(ctx, fakeDB, map[string]string{"user1": "data 1", "user2": "data 2", "user3": "data 3"})
+		if !errors.Is(err, ErrInjectedFault) {
+			t.Errorf("expected an injected fault, but got: %v", err)
+		}
+		AssertState(t, fakeDB, State{"user1": "old data"})
+	})
+
+	// "limits and unique indexes":
+	// a batch that doesn't fit, or that breaks a unique index, is rejected whole.
+	t.Run("limits and unique indexes", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxEntries(2))
+		err := SaveUserDataBatch(ctx, fakeDB, map[string]string{"user1": "data 1", "user2": "data 2", "user3": "data 3"})
+		if !errors.Is(err, ErrDatabaseFull) {
+			t.Errorf("expected ErrDatabaseFull, but got: %v", err)
+		}
+		AssertState(t, fakeDB, State{})
+
+		fakeDB = NewFakeDatabase(WithIndex(UserEmailIndex))
+		err = SaveUserDataBatch(ctx, fakeDB, map[string]string{
+			"user1": `{"email": "ada@example.com"}`,
+			"user2": `{"email": "ADA@example.com"}`,
+		})
+		var violation *UniqueViolationError
+		if !errors.As(err, &violation) {
+			t.Errorf("expected a unique violation, but got: %v", err)
+		}
+		AssertState(t, fakeDB, State{})
+	})
+
+	// "one version":
+	// the keys of a batch share a version, and reach the watchers together.
+	t.Run("one version", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithChangeFeed(10, 0))
+		start := fakeDB.Seq()
+		fakeDB.SaveMany(ctx, []Entry{{Key: "user2", Value: "data 2"}, {Key: "user1", Value: "data 1"}})
+		_, v1, _ := fakeDB.GetVersion(ctx, "user1")
+		_, v2, _ := fakeDB.GetVersion(ctx, "user2")
+		if v1 == 0 || v1 != v2 {
+			t.Errorf("expected the same version, but got: %d and %d", v1, v2)
+		}
+		events := collect(t, fakeDB.Watch(ctx, "", start), 2)
+		if events[0].Key != "user1" || events[1].Key != "user2" {
+			t.Errorf("expected the events in key order, but got: %+v", events)
+		}
+	})
+
+	// "journal":
+	// the journal sees a batch as one operation per key.
+	t.Run("journal", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithJournal())
+		SaveUserDataBatch(ctx, fakeDB, map[string]string{"user1": "data 1", "user2": "data 2"})
+		GetUserDataBatch(ctx, fakeDB, []string{"user1", "missing"})
+		if n := fakeDB.Journal().Count(OpSave, ""); n != 2 {
+			t.Errorf("expected 2 saves, but got: %d", n)
+		}
+		gets := fakeDB.Journal().Filter(OpGet, "")
+		if len(gets) != 2 || gets[0].Result != "found" || gets[1].Result != "missing" {
+			t.Errorf("expected a found and a missing read, but got: %v", gets)
+		}
+	})
+
+	// "expired keys":
+	// GetMany leaves out the expired keys, and a batch saves its keys without an expiry time.
+	t.Run("expired keys", func(t *testing.T) {
+		clock := NewManualClock(date("2024-01-01"))
+		fakeDB := NewFakeDatabase(WithClock(clock))
+		SaveUserDataWithTTL(ctx, fakeDB, "session", "token", time.Minute)
+		SaveUserDataWithTTL(ctx, fakeDB, "user1", "old data", time.Minute)
+		SaveUserDataBatch(ctx, fakeDB, map[string]string{"user1": "data 1"})
+		clock.Advance(time.Minute)
+		values, err := GetUserDataBatch(ctx, fakeDB, []string{"session", "user1"})
+		if err != nil || len(values) != 1 || values["user1"] != "data 1" {
+			t.Errorf("expected user1 only, but got: %v (error: %v)", values, err)
+		}
+	})
+}
+
+// batchTargets are the databases the batch benchmarks run on.
+var batchTargets = []struct {
+	name string
+	open func(b *testing.B) Database
+}{
+	{"fake", func(b *testing.B) Database { return NewFakeDatabase() }},
+	{"persistent fake", func(b *testing.B) Database {
+		fakeDB, err := OpenFakeDatabase(b.TempDir())
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		b.Cleanup(func() { fakeDB.Close() })
+		return fakeDB
+	}},
+	{"real", func(b *testing.B) Database { return openRealDatabase(b) }},
+}
+
+// benchmarkUsers returns n users to save.
+func benchmarkUsers(n int) map[string]string {
+	records := make(map[string]string, n)
+	for i := range n {
+		records[fmt.Sprint("user", i)] = "some user data"
+	}
+	return records
+}
+
+// BenchmarkSaveMany compares saving users one by one with saving them in batches. The gain is in the writes to disk:
+// the real database runs one statement and the persistent fake syncs its log once per batch, instead of once per user.
+// The in-memory fake has nothing of the kind to save, and is about as fast either way.
+//
+//	go test -bench Many
+
+func BenchmarkSaveMany(b *testing.B) {
+	ctx := context.Background()
+	records := benchmarkUsers(100)
+	for _, target := range batchTargets {
+		b.Run(target.name+"/loop", func(b *testing.B) {
+			db := target.open(b)
+			b.ResetTimer()
+			for range b.N {
+				for userID, userData := range records {
+					SaveUserData(ctx, db, userID, userData)
+				}
+			}
+		})
+		b.Run(target.name+"/batch", func(b *testing.B) {
+			db := target.open(b)
+			b.ResetTimer()
+			for range b.N {
+				SaveUserDataBatch(ctx, db, records)
+			}
+		})
+	}
+}
+
+// BenchmarkGetMany compares reading users one by one with reading them in batches.
+func BenchmarkGetMany(b *testing.B) {
+	ctx := context.Background()
+	records := benchmarkUsers(100)
+	userIDs := slices.Collect(maps.Keys(records))
+	for _, target := range batchTargets {
+		db := target.open(b)
+		SaveUserDataBatch(ctx, db, records)
+		b.Run(target.name+"/loop", func(b *testing.B) {
+			for range b.N {
+				for _, userID := range userIDs {
+					GetUserData(ctx, db, userID)
+				}
+			}
+		})
+		b.Run(target.name+"/batch", func(b *testing.B) {
+			for range b.N {
+				GetUserDataBatch(ctx, db, userIDs)
+			}
+		})
+	}
+}
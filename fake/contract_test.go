@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// A contract suite that every Database implementation has to pass.
+// ----------------------------------------------------------------------------
+
+// A fake is only useful if it behaves like the thing it stands in for.
+// DatabaseContract writes down the behaviour of the Database interface as a test suite,
+// and we run that same suite against every FakeDatabase variant and against the RealDatabase.
+// A rule that passes for one and fails for the other is a place where the fake has drifted away from the real thing:
+// the fake is verified, not just an approximation.
+//
+// The variants are the subtests of TestDatabaseContract, and a new Database written in this module gets a line there.
+// A Database written in another module can't run the suite: the fake is a command, and the suite sits in its tests,
+// so as not to build the testing package into the binary.
+
+type DatabaseContract struct {
+	// New returns an empty database for one rule; it is called once per subtest.
+	New func(t *testing.T, clock Clock) Database
+	// LargeValueSize is the size in bytes of the value used to check that large values are stored whole.
+	LargeValueSize int
+	// Concurrency is the number of goroutines used to check that the database is safe for concurrent use.
+	Concurrency int
+}
+
+// Run checks the database built by c.New against the contract, one subtest per rule.
+func (c DatabaseContract) Run(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	newDB := func(t *testing.T) Database {
+		return c.New(t, systemClock{})
+	}
+
+	t.Run("saved values can be read back", func(t *testing.T) {
+		db := newDB(t)
+		mustSave(t, db, "user1", "data 1")
+		expectValue(t, db, "user1", "data 1")
+		if exists, err := db.Exists(ctx, "user1"); err != nil || !exists {
+			t.Errorf("expected user1 to exist, but got: %v (error: %v)", exists, err)
+		}
+	})
+
+	t.Run("save overwrites", func(t *testing.T) {
+		db := newDB(t)
+		mustSave(t, db, "user1", "data 1")
+		mustSave(t, db, "user1", "data 2")
+		expectValue(t, db, "user1", "data 2")
+		expectLen(t, db, 1)
+	})
+
+	t.Run("missing keys are not errors", func(t *testing.T) {
+		db := newDB(t)
+		value, exists, err := db.Get(ctx, "missing")
+		if err != nil || exists || value != "" {
+			t.Errorf("expected no value and no error, but got: %q (exists: %v, error: %v)", value, exists, err)
+		}
+		if exists, err := db.Exists(ctx, "missing"); err != nil || exists {
+			t.Errorf("expected missing not to exist, but got: %v (error: %v)", exists, err)
+		}
+		if deleted, err := db.Delete(ctx, "missing"); err != nil || deleted {
+			t.Errorf("expected nothing to be deleted, but got: %v (error: %v)", deleted, err)
+		}
+		expectLen(t, db, 0)
+	})
+
+	t.Run("empty values and the empty key exist", func(t *testing.T) {
+		db := newDB(t)
+		mustSave(t, db, "user1", "")
+		mustSave(t, db, "", "the empty key")
+		expectValue(t, db, "user1", "")
+		expectValue(t, db, "", "the empty key")
+		expectLen(t, db, 2)
+	})
+
+	t.Run("deleted keys are gone", func(t *testing.T) {
+		db := newDB(t)
+		mustSave(t, db, "user1", "data 1")
+		mustSave(t, db, "user2", "data 2")
+		if deleted, err := db.Delete(ctx, "user1"); err != nil || !deleted {
+			t.Errorf("expected user1 to be deleted, but got: %v (error: %v)", deleted, err)
+		}
+		if deleted, _ := db.Delete(ctx, "user1"); deleted {
+			t.Errorf("expected the second delete to report nothing was deleted")
+		}
+		expectMissing(t, db, "user1")
+		expectValue(t, db, "user2", "data 2")
+		expectLen(t, db, 1)
+	})
+
+	t.Run("unicode keys and values", func(t *testing.T) {
+		db := newDB(t)
+		keys := []string{"ユーザー", "naïve", "naïve", "emoji 🙂", "Ωmega", "zebra", "ß"}
+		for _, key := range keys {
+			mustSave(t, db, key, strings.ToUpper(key)+" ✓")
+		}
+		for _, key := range keys {
+			expectValue(t, db, key, strings.ToUpper(key)+" ✓")
+		}
+		// keys are compared byte by byte: no collation, no normalisation
+		slices.Sort(keys)
+		if got := allKeys(t, db); !slices.Equal(got, keys) {
+			t.Errorf("expected keys in byte order %q, but got: %q", keys, got)
+		}
+	})
+
+	t.Run("values are binary-safe", func(t *testing.T) {
+		db := newDB(t)
+		value := "\x00\x01 not UTF-8: \xff\xfe \x00"
+		mustSave(t, db, "binary", value)
+		expectValue(t, db, "binary", value)
+	})
+
+	t.Run("large values are stored whole", func(t *testing.T) {
+		db := newDB(t)
+		var b strings.Builder
+		for i := 0; b.Len() < c.LargeValueSize; i++ {
+			fmt.Fprintf(&b, "%d,", i)
+		}
+		mustSave(t, db, "large", b.String())
+		expectValue(t, db, "large", b.String())
+	})
+
+	t.Run("len, scan and all agree", func(t *testing.T) {
+		db := newDB(t)
+		for i := range 25 {
+			mustSave(t, db, fmt.Sprintf("user%02d", i), "data")
+		}
+		mustSave(t, db, "admin", "data")
+		db.Delete(ctx, "user07")
+		expectLen(t, db, 25)
+		all := allKeys(t, db)
+		if len(all) != 25 || !slices.IsSorted(all) {
+			t.Errorf("expected 25 sorted keys, but got: %q", all)
+		}
+		var scanned []string
+		for entry, err := range Entries(ctx, db, ScanOptions{Prefix: "user", Limit: 4}) {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			scanned = append(scanned, entry.Key)
+		}
+		if !slices.Equal(scanned, all[1:]) {
+			t.Errorf("expected the scan of the users to return %q, but got: %q", all[1:], scanned)
+		}
+	})
+
+	t.Run("keys expire after their TTL", func(t *testing.T) {
+		clock := NewManualClock(time.Now())
+		db := c.New(t, clock)
+		if err := db.SaveWithTTL(ctx, "session", "token", 0); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("expected ErrInvalidTTL, but got: %v", err)
+		}
+		if err := db.SaveWithTTL(ctx, "session", "token", time.Minute); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		mustSave(t, db, "user1", "data 1")
+		clock.Advance(time.Minute - time.Nanosecond)
+		expectValue(t, db, "session", "token")
+		clock.Advance(time.Nanosecond)
+		expectMissing(t, db, "session")
+		expectLen(t, db, 1)
+		if got := allKeys(t, db); !slices.Equal(got, []string{"user1"}) {
+			t.Errorf("expected keys [user1], but got: %q", got)
+		}
+		// saving the key again brings it back, without an expiry time
+		mustSave(t, db, "session", "new token")
+		clock.Advance(time.Hour)
+		expectValue(t, db, "session", "new token")
+	})
+
+	t.Run("transactions are all or nothing", func(t *testing.T) {
+		db := newDB(t)
+		mustSave(t, db, "user1", "data 1")
+		errInvalid := errors.New("invalid user")
+		err := WithTx(ctx, db, func(tx Tx) error {
+			tx.Save("user2", "data 2")
+			tx.Delete("user1")
+			if _, exists, _ := tx.Get("user1"); exists {
+				t.Errorf("expected the transaction to see its own delete")
+			}
+			return errInvalid
+		})
+		if !errors.Is(err, errInvalid) {
+			t.Errorf("expected the function's error, but got: %v", err)
+		}
+		expectValue(t, db, "user1", "data 1")
+		expectMissing(t, db, "user2")
+
+		if err := SaveUserRecords(ctx, db, map[string]string{"user2": "data 2", "user3": "data 3"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expectValue(t, db, "user2", "data 2")
+		expectValue(t, db, "user3", "data 3")
+
+		tx, _ := db.Begin(ctx)
+		tx.Commit()
+		if err := tx.Save("user4", "too late"); !errors.Is(err, ErrTxDone) {
+			t.Errorf("expected ErrTxDone for a save after commit, but got: %v", err)
+		}
+		if err := tx.Rollback(); !errors.Is(err, ErrTxDone) {
+			t.Errorf("expected ErrTxDone for a rollback after commit, but got: %v", err)
+		}
+	})
+
+	t.Run("versions change on every write and never come back", func(t *testing.T) {
+		clock := NewManualClock(time.Now())
+		db := c.New(t, clock)
+		seen := map[uint64]bool{}
+		expectNewVersion := func(step string) {
+			t.Helper()
+			_, version, err := db.GetVersion(ctx, "user1")
+			if err != nil || version == 0 || seen[version] {
+				t.Errorf("%s: expected a new version, but got: %d (error: %v)", step, version, err)
+			}
+			seen[version] = true
+		}
+		expectVersion0 := func(step string) {
+			t.Helper()
+			if value, version, err := db.GetVersion(ctx, "user1"); err != nil || version != 0 || value != "" {
+				t.Errorf("%s: expected version 0, but got: %q at version %d (error: %v)", step, value, version, err)
+			}
+		}
+
+		expectVersion0("missing")
+		mustSave(t, db, "user1", "data 1")
+		expectNewVersion("saved")
+		mustSave(t, db, "user1", "data 1")
+		expectNewVersion("saved again")
+		db.Delete(ctx, "user1")
+		expectVersion0("deleted")
+		mustSave(t, db, "user1", "data 2")
+		expectNewVersion("saved after the delete")
+		WithTx(ctx, db, func(tx Tx) error { return tx.Save("user1", "data 3") })
+		expectNewVersion("committed")
+		db.SaveWithTTL(ctx, "user1", "data 4", time.Minute)
+		expectNewVersion("saved with a TTL")
+		clock.Advance(time.Minute)
+		expectVersion0("expired")
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		db := newDB(t)
+		v1, err := db.CompareAndSwap(ctx, "user1", 0, "data 1")
+		if err != nil {
+			t.Fatalf("expected version 0 to create a missing key, but got: %v", err)
+		}
+		if _, err := db.CompareAndSwap(ctx, "user1", 0, "created twice"); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected ErrVersionConflict for version 0 on an existing key, but got: %v", err)
+		}
+		v2, err := db.CompareAndSwap(ctx, "user1", v1, "data 2")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if value, version, _ := db.GetVersion(ctx, "user1"); value != "data 2" || version != v2 {
+			t.Errorf("expected data 2 at version %d, but got: %s at version %d", v2, value, version)
+		}
+		if _, err := db.CompareAndSwap(ctx, "user1", v1, "stale write"); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected ErrVersionConflict for a stale version, but got: %v", err)
+		}
+		expectValue(t, db, "user1", "data 2")
+
+		// the version of a deleted key doesn't come back when it is saved again
+		db.Delete(ctx, "user1")
+		if _, err := db.CompareAndSwap(ctx, "user1", v2, "after delete"); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected ErrVersionConflict for the version of a deleted key, but got: %v", err)
+		}
+		if _, err := db.CompareAndSwap(ctx, "user1", 0, "recreated"); err != nil {
+			t.Errorf("expected version 0 to create a deleted key, but got: %v", err)
+		}
+		if _, err := db.CompareAndSwap(ctx, "user1", v2, "stale write"); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected ErrVersionConflict for the version before the delete, but got: %v", err)
+		}
+		expectValue(t, db, "user1", "recreated")
+	})
+
+	t.Run("compare and delete", func(t *testing.T) {
+		db := newDB(t)
+		if err := db.CompareAndDelete(ctx, "user1", 0); err != nil {
+			t.Errorf("expected version 0 to match a missing key, but got: %v", err)
+		}
+		v1, _ := db.CompareAndSwap(ctx, "user1", 0, "data 1")
+		if err := db.CompareAndDelete(ctx, "user1", 0); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected ErrVersionConflict for version 0 on an existing key, but got: %v", err)
+		}
+		v2, _ := db.CompareAndSwap(ctx, "user1", v1, "data 2")
+		if err := db.CompareAndDelete(ctx, "user1", v1); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected ErrVersionConflict for a stale version, but got: %v", err)
+		}
+		expectValue(t, db, "user1", "data 2")
+		if err := db.CompareAndDelete(ctx, "user1", v2); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expectMissing(t, db, "user1")
+		if err := db.CompareAndDelete(ctx, "user1", v2); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected ErrVersionConflict for the version of a deleted key, but got: %v", err)
+		}
+		// the next version of the key is a new one
+		if v3, err := db.CompareAndSwap(ctx, "user1", 0, "recreated"); err != nil || v3 == v2 {
+			t.Errorf("expected a new version, but got: %d (error: %v)", v3, err)
+		}
+	})
+
+	t.Run("concurrent updates are not lost", func(t *testing.T) {
+		db := newDB(t)
+		const increments = 10
+		var wg sync.WaitGroup
+		for range c.Concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range increments {
+					_, err := Update(ctx, db, "counter", func(value string, exists bool) (string, error) {
+						n := 0
+						if exists {
+							n, _ = strconv.Atoi(value)
+						}
+						return strconv.Itoa(n + 1), nil
+					})
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		expectValue(t, db, "counter", strconv.Itoa(c.Concurrency*increments))
+	})
+
+	t.Run("concurrent access is safe", func(t *testing.T) {
+		// run with -race to get the most out of this one
+		db := newDB(t)
+		const usersPerGoroutine = 20
+		var wg sync.WaitGroup
+		errs := make(chan error, c.Concurrency*usersPerGoroutine*3)
+		for g := range c.Concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range usersPerGoroutine {
+					userID := fmt.Sprintf("user%d-%d", g, i)
+					if err := db.Save(ctx, userID, "data for "+userID); err != nil {
+						errs <- err
+					}
+					if _, _, err := db.Get(ctx, "shared"); err != nil {
+						errs <- err
+					}
+					if err := db.Save(ctx, "shared", userID); err != nil {
+						errs <- err
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("unexpected result from a concurrent call: %v", err)
+		}
+		for g := range c.Concurrency {
+			for i := range usersPerGoroutine {
+				userID := fmt.Sprintf("user%d-%d", g, i)
+				expectValue(t, db, userID, "data for "+userID)
+			}
+		}
+		expectLen(t, db, c.Concurrency*usersPerGoroutine+1)
+	})
+
+	t.Run("batches are saved and read whole", func(t *testing.T) {
+		db := newDB(t)
+		mustSave(t, db, "user1", "old data")
+		mustSave(t, db, "session", "token")
+		_, before, _ := db.GetVersion(ctx, "user1")
+		err := db.SaveMany(ctx, []Entry{{Key: "user1", Value: "data 1"}, {Key: "user2", Value: "first"}, {Key: "user2", Value: "data 2"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expectValue(t, db, "user1", "data 1")
+		expectValue(t, db, "user2", "data 2")
+		expectLen(t, db, 3)
+		if _, after, _ := db.GetVersion(ctx, "user1"); after <= before {
+			t.Errorf("expected the version of user1 to grow from %d, but got: %d", before, after)
+		}
+		values, err := db.GetMany(ctx, []string{"user2", "missing", "user1", "user1"})
+		if err != nil || len(values) != 2 || values["user1"] != "data 1" || values["user2"] != "data 2" {
+			t.Errorf("expected user1 and user2, but got: %v (error: %v)", values, err)
+		}
+		if err := db.SaveMany(ctx, nil); err != nil {
+			t.Errorf("expected an empty batch to succeed, but got: %v", err)
+		}
+		if values, err := db.GetMany(ctx, nil); err != nil || len(values) != 0 {
+			t.Errorf("expected no values, but got: %v (error: %v)", values, err)
+		}
+	})
+
+	t.Run("large batches", func(t *testing.T) {
+		db := newDB(t)
+		// more than a statement of the real database takes at once
+		var entries []Entry
+		var keys []string
+		for i := range 2*realBatchSize + 7 {
+			key := fmt.Sprint("user", i)
+			entries = append(entries, Entry{Key: key, Value: "data for " + key})
+			keys = append(keys, key)
+		}
+		if err := db.SaveMany(ctx, entries); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expectLen(t, db, len(entries))
+		values, err := db.GetMany(ctx, keys)
+		if err != nil || len(values) != len(keys) {
+			t.Fatalf("expected %d values, but got: %d (error: %v)", len(keys), len(values), err)
+		}
+		for _, entry := range entries {
+			if values[entry.Key] != entry.Value {
+				t.Errorf("%q: expected %q, but got: %q", entry.Key, entry.Value, values[entry.Key])
+			}
+		}
+	})
+
+	t.Run("context cancellation is honoured", func(t *testing.T) {
+		db := newDB(t)
+		mustSave(t, db, "user1", "data 1")
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		checks := map[string]error{}
+		checks["save"] = db.Save(cancelled, "user2", "data 2")
+		_, _, checks["get"] = db.Get(cancelled, "user1")
+		_, checks["delete"] = db.Delete(cancelled, "user1")
+		_, checks["exists"] = db.Exists(cancelled, "user1")
+		_, checks["len"] = db.Len(cancelled)
+		_, checks["scan"] = db.Scan(cancelled, ScanOptions{})
+		_, checks["begin"] = db.Begin(cancelled)
+		_, _, checks["get version"] = db.GetVersion(cancelled, "user1")
+		_, checks["compare and swap"] = db.CompareAndSwap(cancelled, "user2", 0, "data 2")
+		checks["compare and delete"] = db.CompareAndDelete(cancelled, "user1", 1)
+		checks["save many"] = db.SaveMany(cancelled, []Entry{{Key: "user2", Value: "data 2"}})
+		_, checks["get many"] = db.GetMany(cancelled, []string{"user1"})
+		for op, err := range checks {
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s: expected context.Canceled, but got: %v", op, err)
+			}
+		}
+		expectValue(t, db, "user1", "data 1")
+		expectMissing(t, db, "user2")
+	})
+}
+
+func mustSave(t *testing.T, db Database, key, value string) {
+	t.Helper()
+	if err := db.Save(context.Background(), key, value); err != nil {
+		t.Fatalf("saving %q: unexpected error: %v", key, err)
+	}
+}
+
+func expectValue(t *testing.T, db Database, key, expected string) {
+	t.Helper()
+	value, exists, err := db.Get(context.Background(), key)
+	if err != nil || !exists || value != expected {
+		t.Errorf("%q: expected value %.40q, but got: %.40q (exists: %v, error: %v)", key, expected, value, exists, err)
+	}
+}
+
+func expectMissing(t *testing.T, db Database, key string) {
+	t.Helper()
+	if value, exists, err := db.Get(context.Background(), key); err != nil || exists {
+		t.Errorf("%q: expected no value, but got: %q (exists: %v, error: %v)", key, value, exists, err)
+	}
+	if exists, err := db.Exists(context.Background(), key); err != nil || exists {
+		t.Errorf("%q: expected Exists to be false, but got: %v (error: %v)", key, exists, err)
+	}
+}
+
+func expectLen(t *testing.T, db Database, expected int) {
+	t.Helper()
+	if n, err := db.Len(context.Background()); err != nil || n != expected {
+		t.Errorf("expected %d keys, but got: %d (error: %v)", expected, n, err)
+	}
+}
+
+func allKeys(t *testing.T, db Database) []string {
+	t.Helper()
+	var keys []string
+	for entry, err := range db.All(context.Background()) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func TestDatabaseContract(t *testing.T) {
+	contract := DatabaseContract{LargeValueSize: 1 << 20, Concurrency: 8}
+
+	t.Run("fake database", func(t *testing.T) {
+		contract.New = func(t *testing.T, clock Clock) Database {
+			return NewFakeDatabase(WithClock(clock))
+		}
+		contract.Run(t)
+	})
+
+	t.Run("fake database with a single shard", func(t *testing.T) {
+		contract.New = func(t *testing.T, clock Clock) Database {
+			return NewFakeDatabase(WithClock(clock), WithShards(1))
+		}
+		contract.Run(t)
+	})
+
+	t.Run("persistent fake database", func(t *testing.T) {
+		contract.New = func(t *testing.T, clock Clock) Database {
+			fakeDB, err := OpenFakeDatabase(t.TempDir(), WithClock(clock), WithFsync(FsyncNever))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			t.Cleanup(func() { fakeDB.Close() })
+			return fakeDB
+		}
+		contract.Run(t)
+	})
+
+	t.Run("tenant of a fake database", func(t *testing.T) {
+		contract.New = func(t *testing.T, clock Clock) Database {
+			fakeDB := NewFakeDatabase(WithClock(clock))
+			// the keys of another tenant, and of no tenant, are invisible to the one under test
+			fakeDB.Save(context.Background(), TenantPrefix("other")+"user1", "other data")
+			fakeDB.Save(context.Background(), "user1", "no tenant")
+			tenantDB, err := ForTenant(fakeDB, "acme", WithTenantQuota(1<<20))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return tenantDB
+		}
+		contract.Run(t)
+	})
+
+	t.Run("fake database with latency", func(t *testing.T) {
+		contract.New = func(t *testing.T, clock Clock) Database {
+			latency := PercentileLatency{{Percent: 50, Latency: 20 * time.Microsecond}, {Percent: 99, Latency: 200 * time.Microsecond}}
+			return newLatencyDatabase(t, NewFakeDatabase(WithClock(clock)), 1, WithDefaultLatency(latency), WithLockContention(8))
+		}
+		contract.Run(t)
+	})
+
+	t.Run("real database", func(t *testing.T) {
+		contract.New = func(t *testing.T, clock Clock) Database {
+			realDB := openRealDatabase(t)
+			realDB.clock = clock
+			return realDB
+		}
+		contract.Run(t)
+	})
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Memory bounds: limits on the size of the fake, and eviction.
+// ----------------------------------------------------------------------------
+
+// In a long local run the fake grows without limit. WithMaxEntries and WithMaxBytes bound it,
+// counting the bytes of the keys and values, and WithEvictionPolicy decides what happens when a write goes over a limit:
+//
+//   - RejectWrites, the default, fails the write with ErrDatabaseFull and keeps the data, like a database that ran out of space;
+//   - EvictLRU, EvictLFU and EvictRandom let the write in and then delete keys, the least recently used ones,
+//     the least frequently used ones or random ones, until the fake is within its limits again, like a cache.
+//
+//	fakeDB := NewFakeDatabase(WithMaxEntries(1000), WithEvictionPolicy(EvictLRU),
+//		WithEvictionCallback(func(key, value string) { evicted = append(evicted, key) }))
+//
+// A read of a key (Get, Exists, GetVersion, TTL) counts as a use; so does a write. Scans don't.
+// An eviction is a delete: it is logged, watched and unindexed like any other, so the code under test can see its keys disappear.
+// The keys the write itself saved are never its victims, and a write that could not fit even in an empty fake fails with ErrDatabaseFull
+// whatever the policy. Expired keys still count until they are purged, as they would in memory.
+//
+// EvictionStats returns the current size of the fake, and how many keys were evicted and how many writes rejected.
+
+// The fake takes a shortcut for EvictLFU: it finds the least frequently used key with a scan of all the keys,
+// which is O(n) per eviction. EvictRandom draws from a generator with a fixed seed, so a test evicts the same keys every run.
+
+// ErrDatabaseFull is returned by a write that would take the fake over its limits.
+var ErrDatabaseFull = errors.New("database full")
+
+type EvictionPolicy int
+
+const (
+	// RejectWrites fails the writes that would go over a limit.
+	RejectWrites EvictionPolicy = iota
+	// EvictLRU evicts the least recently used keys.
+	EvictLRU
+	// EvictLFU evicts the least frequently used keys; among those, the least recently used.
+	EvictLFU
+	// EvictRandom evicts random keys.
+	EvictRandom
+)
+
+// WithMaxEntries limits the number of keys in the fake.
+func WithMaxEntries(n int) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.maxEntries = n
+	}
+}
+
+// WithMaxBytes limits the total size of the keys and values in the fake.
+func WithMaxBytes(n int64) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.maxBytes = n
+	}
+}
+
+// WithEvictionPolicy sets what the fake does when a write goes over its limits.
+func WithEvictionPolicy(policy EvictionPolicy) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.evictionPolicy = policy
+	}
+}
+
+// WithEvictionCallback calls fn with every key the fake evicts, and the value it had. fn is called by the writer
+// whose write caused the eviction, after the key is gone and without any lock held: it can use the fake.
+func WithEvictionCallback(fn func(key, value string)) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.onEvict = fn
+	}
+}
+
+// EvictionStats is the size of a fake with limits, and what the limits did to it.
+type EvictionStats struct {
+	Entries    int
+	Bytes      int64
+	Evictions  uint64
+	Rejections uint64
+}
+
+// EvictionStats returns the current size of the fake and its eviction counters. Without limits, it returns zeros.
+func (db *FakeDatabase) EvictionStats() EvictionStats {
+	ev := db.evictor
+	if ev == nil {
+		return EvictionStats{}
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return EvictionStats{Entries: len(ev.entries), Bytes: ev.bytes, Evictions: ev.evictions, Rejections: ev.rejections}
+}
+
+// evictor keeps track of the size and the uses of every key. Its mutex is taken after the shard locks and the indexes,
+// and before the change feed (see stamp); reads take it on its own.
+type evictor struct {
+	// evicting makes the evictions run one at a time, so that two writers over the limits don't both evict for the same excess;
+	// it is taken before any other lock of the fake
+	evicting   sync.Mutex
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	policy     EvictionPolicy
+	onEvict    func(key, value string)
+
+	entries map[string]*tracked
+	bytes   int64
+	// recent orders the keys from the most to the least recently used, and keys holds them in no order, for EvictRandom
+	recent *list.List
+	keys   []*tracked
+	rng    *rand.Rand
+	// tick counts the uses, to order them
+	tick                  uint64
+	evictions, rejections uint64
+}
+
+type tracked struct {
+	key      string
+	size     int64
+	uses     uint64
+	lastUsed uint64
+	elem     *list.Element
+	pos      int
+}
+
+func newEvictor(config fakeConfig) *evictor {
+	return &evictor{
+		maxEntries: config.maxEntries,
+		maxBytes:   config.maxBytes,
+		policy:     config.evictionPolicy,
+		onEvict:    config.onEvict,
+		entries:    make(map[string]*tracked),
+		recent:     list.New(),
+		rng:        rand.New(rand.NewPCG(0, 0)),
+	}
+}
+
+func entrySize(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// admit checks that the writes in ops fit in the limits, or returns ErrDatabaseFull. The caller holds ev.mu.
+func (ev *evictor) admit(ops []walOp) error {
+	// what the writes need on their own, and what the fake would hold after them
+	var needEntries int
+	var needBytes int64
+	entries, bytes := len(ev.entries), ev.bytes
+	for _, op := range ops {
+		if old, ok := ev.entries[op.key]; ok {
+			entries--
+			bytes -= old.size
+		}
+		if !op.deleted {
+			needEntries++
+			needBytes += entrySize(op.key, op.value)
+		}
+	}
+	entries += needEntries
+	bytes += needBytes
+
+	tooBig := ev.over(needEntries, needBytes)
+	if ev.policy == RejectWrites {
+		// a write that doesn't make the fake bigger is always let in, even when it is already too big
+		tooBig = (ev.maxEntries > 0 && entries > ev.maxEntries && entries > len(ev.entries)) ||
+			(ev.maxBytes > 0 && bytes > ev.maxBytes && bytes > ev.bytes)
+	}
+	if tooBig {
+		ev.rejections++
+		return fmt.Errorf("%w: the write would make %d entries of %d bytes, but the limits are %d entries and %d bytes",
+			ErrDatabaseFull, entries, bytes, ev.maxEntries, ev.maxBytes)
+	}
+	return nil
+}
+
+// over reports whether entries and bytes are over the limits.
+func (ev *evictor) over(entries int, bytes int64) bool {
+	return (ev.maxEntries > 0 && entries > ev.maxEntries) || (ev.maxBytes > 0 && bytes > ev.maxBytes)
+}
+
+// apply accounts for the writes in ops, which count as uses of their keys. The caller holds ev.mu.
+func (ev *evictor) apply(ops []walOp) {
+	for _, op := range ops {
+		if op.deleted {
+			ev.remove(op.key)
+			continue
+		}
+		t, ok := ev.entries[op.key]
+		if !ok {
+			t = &tracked{key: op.key, pos: len(ev.keys)}
+			t.elem = ev.recent.PushFront(t)
+			ev.keys = append(ev.keys, t)
+			ev.entries[op.key] = t
+		}
+		ev.bytes += entrySize(op.key, op.value) - t.size
+		t.size = entrySize(op.key, op.value)
+		ev.use(t)
+	}
+}
+
+func (ev *evictor) use(t *tracked) {
+	ev.tick++
+	t.uses++
+	t.lastUsed = ev.tick
+	ev.recent.MoveToFront(t.elem)
+}
+
+// touch records a read of key.
+func (ev *evictor) touch(key string) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if t, ok := ev.entries[key]; ok {
+		ev.use(t)
+	}
+}
+
+// remove stops tracking key. The caller holds ev.mu.
+func (ev *evictor) remove(key string) {
+	t, ok := ev.entries[key]
+	if !ok {
+		return
+	}
+	delete(ev.entries, key)
+	ev.bytes -= t.size
+	ev.recent.Remove(t.elem)
+	// the last key takes the place of the removed one
+	last := ev.keys[len(ev.keys)-1]
+	ev.keys[t.pos] = last
+	last.pos = t.pos
+	ev.keys = ev.keys[:len(ev.keys)-1]
+}
+
+// victim picks the next key to evict, other than the protected ones, or returns false if the fake is within its limits.
+// The caller holds ev.mu.
+func (ev *evictor) victim(protected []string) (string, bool) {
+	if ev.policy == RejectWrites || !ev.over(len(ev.entries), ev.bytes) {
+		return "", false
+	}
+	isProtected := func(t *tracked) bool {
+		for _, key := range protected {
+			if t.key == key {
+				return true
+			}
+		}
+		return false
+	}
+	var best *tracked
+	switch ev.policy {
+	case EvictLRU:
+		for e := ev.recent.Back(); e != nil; e = e.Prev() {
+			if t := e.Value.(*tracked); !isProtected(t) {
+				return t.key, true
+			}
+		}
+	case EvictLFU:
+		for _, t := range ev.keys {
+			if !isProtected(t) && (best == nil || t.uses < best.uses || (t.uses == best.uses && t.lastUsed < best.lastUsed)) {
+				best = t
+			}
+		}
+	case EvictRandom:
+		// the protected keys are few: a handful of draws finds another key, if there is one
+		unprotected := len(ev.keys)
+		for _, key := range protected {
+			if _, ok := ev.entries[key]; ok {
+				unprotected--
+			}
+		}
+		if unprotected > 0 {
+			for best == nil {
+				if t := ev.keys[ev.rng.IntN(len(ev.keys))]; !isProtected(t) {
+					best = t
+				}
+			}
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.key, true
+}
+
+// evict deletes keys until the fake is within its limits again, sparing the keys of the write that called it.
+// The caller must not hold any lock of the fake.
+func (db *FakeDatabase) evict(protected ...string) {
+	ev := db.evictor
+	if ev == nil {
+		return
+	}
+	for {
+		ev.evicting.Lock()
+		ev.mu.Lock()
+		key, ok := ev.victim(protected)
+		ev.mu.Unlock()
+		if !ok {
+			ev.evicting.Unlock()
+			return
+		}
+		value, evicted, err := db.evictKey(key)
+		ev.evicting.Unlock()
+		if err != nil {
+			// the log can't take the delete; the fake stays too big until the next write tries again
+			return
+		}
+		// the callback runs without any lock, as it may use the fake
+		if evicted && ev.onEvict != nil {
+			ev.onEvict(key, value)
+		}
+	}
+}
+
+// evictKey deletes key as an eviction and returns its value, and whether it was evicted after all.
+// The caller holds ev.evicting.
+func (db *FakeDatabase) evictKey(key string) (string, bool, error) {
+	s := db.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, exists := s.data[key]
+	if !exists {
+		// a writer deleted it in the meantime, and stopped tracking it already
+		return "", false, nil
+	}
+	// and the deletes since the victim was chosen may have brought the fake within its limits
+	db.evictor.mu.Lock()
+	over := db.evictor.over(len(db.evictor.entries), db.evictor.bytes)
+	db.evictor.mu.Unlock()
+	if !over {
+		return "", false, nil
+	}
+	seq, err := db.stamp(func() []walOp { return []walOp{{deleted: true, key: key}} })
+	if err != nil {
+		return "", false, err
+	}
+	db.retain(s, key, seq)
+	delete(s.data, key)
+	db.evictor.mu.Lock()
+	db.evictor.evictions++
+	db.evictor.mu.Unlock()
+	return it.value, true, nil
+}
+
+// forget stops tracking a key that expired and was purged. The caller holds the lock of the key's shard.
+func (db *FakeDatabase) forget(key string) {
+	db.unindex(key)
+	if db.evictor != nil {
+		db.evictor.mu.Lock()
+		db.evictor.remove(key)
+		db.evictor.mu.Unlock()
+	}
+}
+
+// rebuildEvictor accounts for the data the fake already has, after a recovery (see wal.go), and evicts what doesn't fit any more.
+func (db *FakeDatabase) rebuildEvictor() {
+	if db.evictor == nil {
+		return
+	}
+	db.evictor.mu.Lock()
+	for _, s := range db.shards {
+		for key, it := range s.data {
+			db.evictor.apply([]walOp{{key: key, value: it.value}})
+		}
+	}
+	db.evictor.mu.Unlock()
+	db.evict()
+}
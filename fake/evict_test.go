@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Limits on the size of the fake, and the eviction policies.
+// ----------------------------------------------------------------------------
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+
+	// "reject writes":
+	// by default a write over a limit fails and changes nothing; overwrites and deletes that don't grow the fake still work.
+	t.Run("reject writes", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxEntries(2))
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		SaveUserData(ctx, fakeDB, "user2", "data 2")
+		if err := SaveUserData(ctx, fakeDB, "user3", "data 3"); !errors.Is(err, ErrDatabaseFull) {
+			t.Errorf("expected ErrDatabaseFull, but got: %v", err)
+		}
+		if exists, _ := fakeDB.Exists(ctx, "user3"); exists {
+			t.Errorf("expected user3 not to be saved")
+		}
+		if err := SaveUserData(ctx, fakeDB, "user1", "new data"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		DeleteUserData(ctx, fakeDB, "user2")
+		if err := SaveUserData(ctx, fakeDB, "user3", "data 3"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if stats := fakeDB.EvictionStats(); stats.Entries != 2 || stats.Rejections != 1 || stats.Evictions != 0 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	// "max bytes":
+	// the keys and the values count; a value that can't fit even in an empty fake is rejected whatever the policy.
+	t.Run("max bytes", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxBytes(20), WithEvictionPolicy(EvictLRU))
+		SaveUserData(ctx, fakeDB, "a", "123456789") // 10 bytes
+		SaveUserData(ctx, fakeDB, "b", "123456789") // 20
+		if stats := fakeDB.EvictionStats(); stats.Bytes != 20 {
+			t.Errorf("expected 20 bytes, but got: %d", stats.Bytes)
+		}
+		SaveUserData(ctx, fakeDB, "c", "1234") // 25: a goes
+		AssertState(t, fakeDB, State{"b": "123456789", "c": "1234"})
+		if err := SaveUserData(ctx, fakeDB, "d", "too big for the whole fake"); !errors.Is(err, ErrDatabaseFull) {
+			t.Errorf("expected ErrDatabaseFull, but got: %v", err)
+		}
+		AssertState(t, fakeDB, State{"b": "123456789", "c": "1234"})
+	})
+
+	// "lru":
+	// reads keep a key alive; the least recently used key is evicted.
+	t.Run("lru", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxEntries(3), WithEvictionPolicy(EvictLRU))
+		for _, key := range []string{"a", "b", "c"} {
+			SaveUserData(ctx, fakeDB, key, "data")
+		}
+		GetUserData(ctx, fakeDB, "a")
+		SaveUserData(ctx, fakeDB, "d", "data") // b is the least recently used
+		fakeDB.Exists(ctx, "c")
+		SaveUserData(ctx, fakeDB, "e", "data") // then a
+		AssertState(t, fakeDB, State{"c": "data", "d": "data", "e": "data"})
+	})
+
+	// "lfu":
+	// the least frequently used key is evicted, and a new key is never evicted by its own write.
+	t.Run("lfu", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxEntries(3), WithEvictionPolicy(EvictLFU))
+		for _, key := range []string{"a", "b", "c"} {
+			SaveUserData(ctx, fakeDB, key, "data")
+		}
+		for range 3 {
+			GetUserData(ctx, fakeDB, "a")
+			GetUserData(ctx, fakeDB, "c")
+		}
+		GetUserData(ctx, fakeDB, "b")
+		SaveUserData(ctx, fakeDB, "d", "data") // b has 2 uses, a and c 4
+		AssertState(t, fakeDB, State{"a": "data", "c": "data", "d": "data"})
+		SaveUserData(ctx, fakeDB, "e", "data") // d has 1 use
+		AssertState(t, fakeDB, State{"a": "data", "c": "data", "e": "data"})
+	})
+
+	// "random":
+	// random evictions keep the fake within its limits, and are the same every run.
+	t.Run("random", func(t *testing.T) {
+		run := func() []string {
+			var evicted []string
+			fakeDB := NewFakeDatabase(WithMaxEntries(10), WithEvictionPolicy(EvictRandom),
+				WithEvictionCallback(func(key, value string) { evicted = append(evicted, key) }))
+			for i := range 50 {
+				SaveUserData(ctx, fakeDB, fmt.Sprint("user", i), "data")
+				if n, _ := fakeDB.Len(ctx); n > 10 {
+					t.Fatalf("expected at most 10 keys, but got: %d", n)
+				}
+			}
+			if exists, _ := fakeDB.Exists(ctx, "user49"); !exists {
+				t.Errorf("expected the last key to be kept")
+			}
+			return evicted
+		}
+		first, second := run(), run()
+		if len(first) != 40 || !slices.Equal(first, second) {
+			t.Errorf("expected the same 40 evictions twice, but got: %v and %v", first, second)
+		}
+	})
+
+	// "callback, stats and the change feed":
+	// an eviction calls the callback with the value, counts in the stats, and is a delete for the watchers.
+	t.Run("callback, stats and the change feed", func(t *testing.T) {
+		var evicted []string
+		var fakeDB *FakeDatabase
+		fakeDB = NewFakeDatabase(WithMaxEntries(1), WithEvictionPolicy(EvictLRU), WithChangeFeed(10, 0),
+			WithEvictionCallback(func(key, value string) {
+				evicted = append(evicted, key+"="+value)
+				// the callback may use the fake
+				fakeDB.Exists(ctx, key)
+			}))
+		start := fakeDB.Seq()
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		SaveUserData(ctx, fakeDB, "user2", "data 2")
+		if !slices.Equal(evicted, []string{"user1=data 1"}) {
+			t.Errorf("expected user1 to be evicted, but got: %v", evicted)
+		}
+		if stats := fakeDB.EvictionStats(); stats != (EvictionStats{Entries: 1, Bytes: 11, Evictions: 1}) {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+		events := collect(t, fakeDB.Watch(ctx, "", start), 3)
+		if events[2].Kind != EventDelete || events[2].Key != "user1" {
+			t.Errorf("expected a delete of user1, but got: %+v", events[2])
+		}
+	})
+
+	// "commits":
+	// the keys of a commit are not its victims; a commit bigger than the limits is rejected.
+	t.Run("commits", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxEntries(2), WithEvictionPolicy(EvictLRU))
+		SaveUserData(ctx, fakeDB, "old", "data")
+		if err := SaveUserRecords(ctx, fakeDB, map[string]string{"user1": "data 1", "user2": "data 2"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		AssertState(t, fakeDB, State{"user1": "data 1", "user2": "data 2"})
+		err := SaveUserRecords(ctx, fakeDB, map[string]string{"a": "1", "b": "2", "c": "3"})
+		if !errors.Is(err, ErrDatabaseFull) {
+			t.Errorf("expected ErrDatabaseFull, but got: %v", err)
+		}
+	})
+
+	// "expired keys":
+	// purged keys no longer count.
+	t.Run("expired keys", func(t *testing.T) {
+		clock := NewManualClock(time.Now())
+		fakeDB := NewFakeDatabase(WithClock(clock), WithMaxEntries(1))
+		SaveUserDataWithTTL(ctx, fakeDB, "session", "token", time.Minute)
+		clock.Advance(time.Minute)
+		if err := SaveUserData(ctx, fakeDB, "user1", "data"); !errors.Is(err, ErrDatabaseFull) {
+			t.Errorf("expected the expired key to count until it is purged, but got: %v", err)
+		}
+		fakeDB.PurgeExpired()
+		if err := SaveUserData(ctx, fakeDB, "user1", "data"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	// "concurrent writers":
+	// writers on every shard keep the fake within its limits, and the stats agree with the data.
+	t.Run("concurrent writers", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxEntries(50), WithEvictionPolicy(EvictLRU))
+		var wg sync.WaitGroup
+		for g := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 200 {
+					key := fmt.Sprintf("user%d-%d", g, i)
+					if err := SaveUserData(ctx, fakeDB, key, "data"); err != nil {
+						t.Errorf("unexpected error: %v", err)
+						return
+					}
+					GetUserData(ctx, fakeDB, key)
+				}
+			}()
+		}
+		wg.Wait()
+		n, _ := fakeDB.Len(ctx)
+		if stats := fakeDB.EvictionStats(); n > 50 || stats.Entries != n || stats.Evictions != uint64(1600-n) {
+			t.Errorf("expected at most 50 keys and stats to match, but got %d keys and %+v", n, stats)
+		}
+	})
+
+	// "concurrent deletes":
+	// a victim that another writer deletes first is not evicted, and not reported to the callback.
+	t.Run("concurrent deletes", func(t *testing.T) {
+		var callbacks atomic.Uint64
+		fakeDB := NewFakeDatabase(WithMaxEntries(2), WithEvictionPolicy(EvictLRU),
+			WithEvictionCallback(func(key, value string) { callbacks.Add(1) }))
+		var wg sync.WaitGroup
+		for g := range 16 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 5000 {
+					key := fmt.Sprint("user", i%8)
+					if g%2 == 0 {
+						SaveUserData(ctx, fakeDB, key, "data")
+					} else {
+						DeleteUserData(ctx, fakeDB, key)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		stats := fakeDB.EvictionStats()
+		if callbacks.Load() != stats.Evictions {
+			t.Errorf("expected a callback per eviction, but got %d callbacks and %d evictions", callbacks.Load(), stats.Evictions)
+		}
+		if n, _ := fakeDB.Len(ctx); n > 2 || stats.Entries != n {
+			t.Errorf("expected at most 2 keys and stats to match, but got %d keys and %+v", n, stats)
+		}
+	})
+
+	// "recovered over the limits":
+	// a persistent fake reopened with smaller limits evicts what doesn't fit, and the evictions are durable.
+	t.Run("recovered over the limits", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDB, err := OpenFakeDatabase(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := range 5 {
+			SaveUserData(ctx, fakeDB, fmt.Sprint("user", i), "data")
+		}
+		fakeDB.Close()
+
+		fakeDB, err = OpenFakeDatabase(dir, WithMaxEntries(3), WithEvictionPolicy(EvictRandom))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n, _ := fakeDB.Len(ctx); n != 3 {
+			t.Errorf("expected 3 keys, but got: %d", n)
+		}
+		kept := DumpState(t, fakeDB)
+		fakeDB.Close()
+		fakeDB, err = OpenFakeDatabase(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer fakeDB.Close()
+		AssertState(t, fakeDB, kept)
+	})
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+)
+
+// ----------------------------------------------------------------------------
+// Import and export: moving the contents of a Database in and out as files.
+// ----------------------------------------------------------------------------
+
+// Export writes every entry of a Database, in key order, and Import loads such a file into a Database,
+// which is how a fake gets seeded with production-shaped data:
+//
+//	n, err := Export(ctx, realDB, file, FormatJSONLines)
+//	result, err := Import(ctx, fakeDB, file, ImportOptions{Format: FormatJSONLines, OnConflict: ConflictSkip})
+//
+// Two formats are supported: JSON lines, one {"key": ..., "value": ...} object per line, and CSV, with a "key,value" header.
+// JSON lines keep every value as it is; CSV reads a "\r\n" inside a value back as "\n", as encoding/csv does.
+// Both stream: Export reads the entries with Scan, a page of exportPageSize at a time, and writes them as it goes,
+// and Import saves them in batches of ImportOptions.BatchSize with SaveMany (see batch.go),
+// so neither holds the whole data set in memory.
+//
+// OnConflict says what Import does with a key that already has another value: overwrite it (the default), skip it, or fail.
+// A key that already has the same value is left alone. With DryRun, Import saves nothing and returns the diff it would make.
+//
+// "go run . export" and "go run . import" do the same from the command line (see runExport and runImport).
+
+// Every batch is saved at once, but an import as a whole isn't: when it fails, with ConflictFail or otherwise,
+// the batches before the one that failed are saved. A dry run first shows what an import will do.
+// A dry run keeps its diff in memory, one change per key that would change.
+
+type ExportFormat string
+
+const (
+	FormatJSONLines ExportFormat = "jsonl"
+	FormatCSV       ExportFormat = "csv"
+)
+
+// FormatOf returns the format of a file from its extension: .jsonl or .ndjson for JSON lines, .csv for CSV.
+func FormatOf(path string) (ExportFormat, error) {
+	switch filepath.Ext(path) {
+	case ".jsonl", ".ndjson":
+		return FormatJSONLines, nil
+	case ".csv":
+		return FormatCSV, nil
+	default:
+		return "", fmt.Errorf("unknown format of %s: expected a .jsonl, .ndjson or .csv file", path)
+	}
+}
+
+// ConflictMode says what Import does with a key that already has another value.
+type ConflictMode int
+
+const (
+	// ConflictOverwrite saves the imported value.
+	ConflictOverwrite ConflictMode = iota
+	// ConflictSkip keeps the current value.
+	ConflictSkip
+	// ConflictFail stops the import with ErrImportConflict.
+	ConflictFail
+)
+
+// ErrImportConflict is returned by an import in ConflictFail mode that meets a key with another value.
+var ErrImportConflict = errors.New("import conflict")
+
+// defaultImportBatchSize is the number of entries Import saves at once unless ImportOptions.BatchSize says otherwise.
+const defaultImportBatchSize = 500
+
+type ImportOptions struct {
+	Format     ExportFormat
+	OnConflict ConflictMode
+	// DryRun reads the file and compares it with the database, but saves nothing.
+	DryRun bool
+	// BatchSize is the number of entries saved at once; 0 means defaultImportBatchSize.
+	BatchSize int
+}
+
+// ImportResult counts the entries of an import by what happened to them.
+type ImportResult struct {
+	Read      int
+	Added     int
+	Modified  int
+	Unchanged int
+	Skipped   int
+	// Diff is what the import changes in the database, in key order; it is only filled in by a dry run.
+	Diff StateDiff
+}
+
+// exportPageSize is how many entries Export asks Scan for at a time.
+const exportPageSize = 1000
+
+// exportRecord is an entry in JSON lines.
+type exportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Export writes every entry of db to w in the given format, and returns how many it wrote.
+func Export(ctx context.Context, db Database, w io.Writer, format ExportFormat) (int, error) {
+	var write func(Entry) error
+	var flush func() error
+	switch format {
+	case FormatJSONLines:
+		buffered := bufio.NewWriter(w)
+		encoder := json.NewEncoder(buffered)
+		encoder.SetEscapeHTML(false)
+		write = func(entry Entry) error { return encoder.Encode(exportRecord(entry)) }
+		flush = buffered.Flush
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"key", "value"}); err != nil {
+			return 0, err
+		}
+		write = func(entry Entry) error { return writer.Write([]string{entry.Key, entry.Value}) }
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+
+	n := 0
+	for entry, err := range Entries(ctx, db, ScanOptions{Limit: exportPageSize}) {
+		if err != nil {
+			return n, fmt.Errorf("exporting: %w", err)
+		}
+		if err := write(entry); err != nil {
+			return n, fmt.Errorf("exporting %q: %w", entry.Key, err)
+		}
+		n++
+	}
+	if err := flush(); err != nil {
+		return n, fmt.Errorf("exporting: %w", err)
+	}
+	return n, nil
+}
+
+// recordReader reads the entries of an export one at a time; next returns io.EOF after the last one.
+type recordReader func() (Entry, error)
+
+func newRecordReader(r io.Reader, format ExportFormat) (recordReader, error) {
+	switch format {
+	case FormatJSONLines:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 64<<20)
+		line := 0
+		return func() (Entry, error) {
+			for scanner.Scan() {
+				line++
+				if len(scanner.Bytes()) == 0 {
+					continue
+				}
+				var record exportRecord
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					return Entry{}, fmt.Errorf("line %d: %w", line, err)
+				}
+				return Entry(record), nil
+			}
+			if err := scanner.Err(); err != nil {
+				return Entry{}, err
+			}
+			return Entry{}, io.EOF
+		}, nil
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = 2
+		reader.ReuseRecord = true
+		header, err := reader.Read()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == nil && (header[0] != "key" || header[1] != "value") {
+			return nil, fmt.Errorf(`expected a "key,value" header, but got: %q`, header)
+		}
+		return func() (Entry, error) {
+			if header == nil {
+				return Entry{}, io.EOF
+			}
+			record, err := reader.Read()
+			if err != nil {
+				return Entry{}, err
+			}
+			return Entry{Key: record[0], Value: record[1]}, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+}
+
+// ReadExport reads a whole export into a State; a key that appears twice keeps its last value.
+func ReadExport(r io.Reader, format ExportFormat) (State, error) {
+	next, err := newRecordReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+	state := make(State)
+	for {
+		entry, err := next()
+		if err == io.EOF {
+			return state, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		state[entry.Key] = entry.Value
+	}
+}
+
+// Import loads the entries read from r into db, as opts says.
+func Import(ctx context.Context, db Database, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	next, err := newRecordReader(r, opts.Format)
+	if err != nil {
+		return result, fmt.Errorf("importing: %w", err)
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	// a dry run plans its writes instead of saving them, and the entries after see them: before and after make its diff
+	var before, after State
+	if opts.DryRun {
+		before, after = make(State), make(State)
+	}
+	var batch []Entry
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := importBatch(ctx, db, batch, opts, &result, before, after)
+		batch = batch[:0]
+		return err
+	}
+	for {
+		entry, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("importing: %w", err)
+		}
+		result.Read++
+		batch = append(batch, entry)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+	if opts.DryRun {
+		result.Diff = Diff(before, after)
+	}
+	return result, nil
+}
+
+// importBatch compares a batch with the database and saves it, or plans it in after for a dry run.
+func importBatch(ctx context.Context, db Database, batch []Entry, opts ImportOptions, result *ImportResult, before, after State) error {
+	keys := make([]string, len(batch))
+	for i, entry := range batch {
+		keys[i] = entry.Key
+	}
+	current, err := db.GetMany(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("importing: %w", err)
+	}
+	if opts.DryRun {
+		for key, value := range current {
+			if _, seen := after[key]; !seen {
+				before[key], after[key] = value, value
+			}
+		}
+		// the planned writes of the batches before take the place of the database
+		for _, key := range keys {
+			if value, planned := after[key]; planned {
+				current[key] = value
+			}
+		}
+	}
+
+	var writes []Entry
+	for _, entry := range batch {
+		value, exists := current[entry.Key]
+		switch {
+		case !exists:
+			result.Added++
+		case value == entry.Value:
+			result.Unchanged++
+			continue
+		case opts.OnConflict == ConflictSkip:
+			result.Skipped++
+			continue
+		case opts.OnConflict == ConflictFail:
+			return fmt.Errorf("%w on key %q: the database has %.40q, the import %.40q", ErrImportConflict, entry.Key, value, entry.Value)
+		default:
+			result.Modified++
+		}
+		// the entries after this one in the batch see it
+		current[entry.Key] = entry.Value
+		writes = append(writes, entry)
+	}
+
+	if opts.DryRun {
+		for _, entry := range writes {
+			after[entry.Key] = entry.Value
+		}
+		return nil
+	}
+	if err := db.SaveMany(ctx, writes); err != nil {
+		return fmt.Errorf("importing: %w", err)
+	}
+	return nil
+}
+
+// runExport writes the contents of a database to a file, or to the standard output:
+//
+//	go run . export -backend real -data users.db -o users.jsonl
+//	go run . export -data ./data -format csv
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	backend := addBackendFlags(flags)
+	output := flags.String("o", "", "the file to write; the standard output if empty")
+	format := flags.String("format", "", "jsonl or csv; by default, the format of the -o file, or jsonl")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	exportFormat := ExportFormat(*format)
+	if exportFormat == "" {
+		exportFormat = FormatJSONLines
+		if *output != "" {
+			var err error
+			if exportFormat, err = FormatOf(*output); err != nil {
+				return err
+			}
+		}
+	}
+	db, name, closeDB, err := backend.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	w := os.Stdout
+	if *output != "" {
+		if w, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	n, err := Export(ctx, db, w, exportFormat)
+	if *output != "" {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s - exported %d entries\n", name, n)
+	return nil
+}
+
+// runImport loads a file into a database:
+//
+//	go run . import -data ./data -on-conflict skip fixtures/users.jsonl
+//	go run . import -backend real -data users.db -dry-run users.csv
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	backend := addBackendFlags(flags)
+	format := flags.String("format", "", "jsonl or csv; by default, the format of the file")
+	onConflict := flags.String("on-conflict", "overwrite", "what to do with a key that has another value: overwrite, skip or fail")
+	dryRun := flags.Bool("dry-run", false, "show what the import would change, and change nothing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("expected the file to import")
+	}
+	path := flags.Arg(0)
+
+	opts := ImportOptions{Format: ExportFormat(*format), DryRun: *dryRun}
+	if opts.Format == "" {
+		var err error
+		if opts.Format, err = FormatOf(path); err != nil {
+			return err
+		}
+	}
+	switch *onConflict {
+	case "overwrite":
+		opts.OnConflict = ConflictOverwrite
+	case "skip":
+		opts.OnConflict = ConflictSkip
+	case "fail":
+		opts.OnConflict = ConflictFail
+	default:
+		return fmt.Errorf("unknown conflict mode %q: expected overwrite, skip or fail", *onConflict)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	db, name, closeDB, err := backend.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	result, err := Import(ctx, db, file, opts)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		fmt.Print(result.Diff)
+	}
+	fmt.Fprintf(os.Stderr, "%s - read %d entries: %d added, %d modified, %d unchanged, %d skipped\n",
+		name, result.Read, result.Added, result.Modified, result.Unchanged, result.Skipped)
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------
+// Import and export.
+// ----------------------------------------------------------------------------
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	// values that need escaping in one format or the other
+	tricky := State{
+		"comma, and \"quotes\"": "a,b,\"c\"",
+		"lines":                 "one\ntwo\nthree",
+		"html":                  "<b>&amp;</b>",
+		"unicode":               "héllo, 世界",
+		"empty":                 "",
+	}
+
+	// "round trip":
+	// what is exported from one database is imported whole into another, in both formats.
+	for _, format := range []ExportFormat{FormatJSONLines, FormatCSV} {
+		t.Run("round trip in "+string(format), func(t *testing.T) {
+			source := NewFakeDatabase()
+			Seed(ctx, source, tricky)
+			var buf bytes.Buffer
+			if n, err := Export(ctx, source, &buf, format); err != nil || n != len(tricky) {
+				t.Fatalf("expected %d entries, but got: %d (error: %v)", len(tricky), n, err)
+			}
+			target := NewFakeDatabase()
+			result, err := Import(ctx, target, &buf, ImportOptions{Format: format})
+			if err != nil || result.Read != len(tricky) || result.Added != len(tricky) {
+				t.Errorf("unexpected result: %+v (error: %v)", result, err)
+			}
+			AssertState(t, target, tricky)
+		})
+	}
+
+	// "paged":
+	// a large database is read a page at a time, not copied whole before the first entry is written.
+	t.Run("paged", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithJournal())
+		state := State{}
+		for i := range 2*exportPageSize + 1 {
+			state[fmt.Sprintf("user%05d", i)] = "data"
+		}
+		Seed(ctx, fakeDB, state)
+		fakeDB.Journal().Reset()
+		var buf bytes.Buffer
+		if n, err := Export(ctx, fakeDB, &buf, FormatCSV); err != nil || n != len(state) {
+			t.Fatalf("expected %d entries, but got: %d (error: %v)", len(state), n, err)
+		}
+		if n := fakeDB.Journal().Count(OpScan, ""); n != 3 {
+			t.Errorf("expected 3 pages, but got: %d", n)
+		}
+		read, _ := ReadExport(&buf, FormatCSV)
+		AssertState(t, fakeDB, read)
+	})
+
+	// "from the real database":
+	// a real database seeds a fake, which is what the tooling is for; JSON lines keep even carriage returns.
+	t.Run("from the real database", func(t *testing.T) {
+		realDB := openRealDatabase(t)
+		Seed(ctx, realDB, tricky)
+		Seed(ctx, realDB, State{"crlf": "one\r\ntwo"})
+		var buf bytes.Buffer
+		if _, err := Export(ctx, realDB, &buf, FormatJSONLines); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		fakeDB := NewFakeDatabase()
+		if _, err := Import(ctx, fakeDB, &buf, ImportOptions{Format: FormatJSONLines}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := maps.Clone(tricky)
+		expected["crlf"] = "one\r\ntwo"
+		AssertState(t, fakeDB, expected)
+	})
+
+	// "format":
+	// the entries are written in key order, one per line, as in testdata.
+	for _, path := range []string{"testdata/users.jsonl", "testdata/users.csv"} {
+		t.Run("format of "+path, func(t *testing.T) {
+			fakeDB := NewFakeDatabase()
+			SeedFromFile(t, fakeDB, "testdata/users.yaml")
+			format, _ := FormatOf(path)
+			var buf bytes.Buffer
+			Export(ctx, fakeDB, &buf, format)
+			expected, _ := os.ReadFile(path)
+			if buf.String() != string(expected) {
+				t.Errorf("expected:\n%s\nbut got:\n%s", expected, buf.String())
+			}
+		})
+	}
+
+	// "conflicts":
+	// a key with another value is overwritten, skipped or fails the import; a key with the same value is left alone.
+	for _, test := range []struct {
+		mode     ConflictMode
+		expected State
+		result   ImportResult
+	}{
+		{ConflictOverwrite, State{"user1": "new", "user2": "same", "user3": "new"}, ImportResult{Read: 3, Added: 1, Modified: 1, Unchanged: 1}},
+		{ConflictSkip, State{"user1": "old", "user2": "same", "user3": "new"}, ImportResult{Read: 3, Added: 1, Skipped: 1, Unchanged: 1}},
+	} {
+		t.Run(fmt.Sprint("conflict mode ", test.mode), func(t *testing.T) {
+			fakeDB := NewFakeDatabase(WithJournal())
+			Seed(ctx, fakeDB, State{"user1": "old", "user2": "same"})
+			fakeDB.Journal().Reset()
+			input := "key,value\nuser1,new\nuser2,same\nuser3,new\n"
+			result, err := Import(ctx, fakeDB, strings.NewReader(input), ImportOptions{Format: FormatCSV, OnConflict: test.mode})
+			if err != nil || fmt.Sprint(result) != fmt.Sprint(test.result) {
+				t.Errorf("expected %+v, but got: %+v (error: %v)", test.result, result, err)
+			}
+			AssertState(t, fakeDB, test.expected)
+			if n := fakeDB.Journal().Count(OpSave, "user2"); n != 0 {
+				t.Errorf("expected the unchanged key not to be saved, but it was %d times", n)
+			}
+		})
+	}
+
+	// "fail on conflict":
+	// the import stops at the first conflict; the batches before it are saved.
+	t.Run("fail on conflict", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		Seed(ctx, fakeDB, State{"user3": "old"})
+		input := "key,value\nuser1,new\nuser2,new\nuser3,new\nuser4,new\n"
+		result, err := Import(ctx, fakeDB, strings.NewReader(input), ImportOptions{Format: FormatCSV, OnConflict: ConflictFail, BatchSize: 2})
+		if !errors.Is(err, ErrImportConflict) || !strings.Contains(err.Error(), `"user3"`) {
+			t.Errorf("expected a conflict on user3, but got: %v", err)
+		}
+		if result.Read != 4 || result.Added != 2 {
+			t.Errorf("unexpected result: %+v", result)
+		}
+		AssertState(t, fakeDB, State{"user1": "new", "user2": "new", "user3": "old"})
+	})
+
+	// "dry run":
+	// a dry run saves nothing, and returns the diff the import would make, with repeated keys seen as the import would.
+	t.Run("dry run", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		Seed(ctx, fakeDB, State{"user1": "old", "user2": "same"})
+		input := `{"key": "user1", "value": "new"}
+{"key": "user2", "value": "same"}
+{"key": "user3", "value": "first"}
+
+{"key": "user3", "value": "second"}
+{"key": "user1", "value": "newer"}
+`
+		result, err := Import(ctx, fakeDB, strings.NewReader(input), ImportOptions{Format: FormatJSONLines, DryRun: true, BatchSize: 2})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.Read != 5 || result.Added != 1 || result.Modified != 3 || result.Unchanged != 1 {
+			t.Errorf("unexpected result: %+v", result)
+		}
+		expected := "\t~ \"user1\": \"old\" -> \"newer\"\n\t+ \"user3\": \"second\"\n"
+		if result.Diff.String() != expected {
+			t.Errorf("expected the diff:\n%s\nbut got:\n%s", expected, result.Diff)
+		}
+		AssertState(t, fakeDB, State{"user1": "old", "user2": "same"})
+	})
+
+	// "large imports":
+	// entries are streamed and saved in batches.
+	t.Run("large imports", func(t *testing.T) {
+		r, w := io.Pipe()
+		go func() {
+			for i := range 5000 {
+				fmt.Fprintf(w, "{\"key\": \"user%05d\", \"value\": \"data\"}\n", i)
+			}
+			w.Close()
+		}()
+		fakeDB := NewFakeDatabase()
+		result, err := Import(ctx, fakeDB, r, ImportOptions{Format: FormatJSONLines})
+		if err != nil || result.Added != 5000 {
+			t.Errorf("unexpected result: %+v (error: %v)", result, err)
+		}
+		if n, _ := fakeDB.Len(ctx); n != 5000 {
+			t.Errorf("expected 5000 keys, but got: %d", n)
+		}
+	})
+
+	// "bad input":
+	// a file that can't be read says where, and an empty one imports nothing.
+	t.Run("bad input", func(t *testing.T) {
+		for _, test := range []struct {
+			format   ExportFormat
+			input    string
+			expected string
+		}{
+			{FormatJSONLines, "{\"key\": \"a\", \"value\": \"b\"}\n{\"key\": \n", "line 2"},
+			{FormatCSV, "id,data\na,b\n", `"key,value" header`},
+			{FormatCSV, "key,value\na,b,c\n", "wrong number of fields"},
+			{"xml", "", "unknown import format"},
+		} {
+			_, err := Import(ctx, NewFakeDatabase(), strings.NewReader(test.input), ImportOptions{Format: test.format})
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("%q: expected an error about %s, but got: %v", test.input, test.expected, err)
+			}
+		}
+		for _, format := range []ExportFormat{FormatJSONLines, FormatCSV} {
+			if result, err := Import(ctx, NewFakeDatabase(), strings.NewReader(""), ImportOptions{Format: format}); err != nil || result.Read != 0 {
+				t.Errorf("%s: expected nothing to import, but got: %+v (error: %v)", format, result, err)
+			}
+		}
+		if _, err := FormatOf("users.txt"); err == nil {
+			t.Errorf("expected an unknown format")
+		}
+	})
+
+	// "command line":
+	// export and import move the data of a persistent fake to another one.
+	t.Run("command line", func(t *testing.T) {
+		source, target := t.TempDir(), t.TempDir()
+		file := filepath.Join(t.TempDir(), "users.csv")
+		fakeDB, err := OpenFakeDatabase(source)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		Seed(ctx, fakeDB, tricky)
+		fakeDB.Close()
+
+		if err := runExport([]string{"-data", source, "-o", file}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := runImport([]string{"-data", target, "-dry-run", file}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := runImport([]string{"-data", target, "-on-conflict", "fail", file}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := runImport([]string{"-data", target, "-on-conflict", "maybe", file}); err == nil {
+			t.Errorf("expected an unknown conflict mode")
+		}
+		fakeDB, err = OpenFakeDatabase(target)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer fakeDB.Close()
+		AssertState(t, fakeDB, tricky)
+	})
+}
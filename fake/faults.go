@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// ----------------------------------------------------------------------------
+// Fault injection: making the fake fail on purpose.
+// ----------------------------------------------------------------------------
+
+// A fake that never fails can't test the error handling of the code that uses it.
+// The FakeDatabase accepts a fault plan: a list of Faults, each of which looks at every operation and decides whether it should fail.
+// A failing operation returns an error wrapping ErrInjectedFault and has no effect on the data.
+//
+//	fakeDB.InjectFaults(
+//		FailNthWrite(3),                                  // the third write fails
+//		FailKeysMatching(regexp.MustCompile(`^admin:`)),  // anything touching admin keys fails
+//		FailWithProbability(0.01, 42),                    // 1% of operations fail, reproducibly
+//		FailOnce(FailKeysMatching(regexp.MustCompile(`^user1$`))), // user1 fails once, then recovers
+//	)
+
+// ErrInjectedFault is wrapped by every error caused by the fault plan.
+var ErrInjectedFault = errors.New("injected fault")
+
+type OpKind string
+
+const (
+	OpGet    OpKind = "get"
+	OpSave   OpKind = "save"
+	OpDelete OpKind = "delete"
+	OpExists OpKind = "exists"
+	OpLen    OpKind = "len"
+	OpScan   OpKind = "scan"
+	OpBegin  OpKind = "begin"
+)
+
+// Op describes one operation on the database. A transaction's commit is seen as one write Op per key it writes.
+type Op struct {
+	Kind OpKind
+	Key  string // empty for operations that are not about a single key
+}
+
+func (op Op) IsWrite() bool {
+	return op.Kind == OpSave || op.Kind == OpDelete
+}
+
+// A Fault decides whether an operation fails. Faults are called from many goroutines at once.
+type Fault interface {
+	Fail(op Op) bool
+}
+
+// FaultFunc turns a function into a Fault.
+type FaultFunc func(op Op) bool
+
+func (f FaultFunc) Fail(op Op) bool {
+	return f(op)
+}
+
+// FailNthWrite fails the nth write (counting from 1) after the fault is installed, and only that one.
+func FailNthWrite(n int64) Fault {
+	var writes atomic.Int64
+	return FaultFunc(func(op Op) bool {
+		return op.IsWrite() && writes.Add(1) == n
+	})
+}
+
+// FailKeysMatching fails every operation on a key that matches pattern.
+func FailKeysMatching(pattern *regexp.Regexp) Fault {
+	return FaultFunc(func(op Op) bool {
+		return op.Key != "" && pattern.MatchString(op.Key)
+	})
+}
+
+// FailWithProbability fails each operation with probability p.
+// The random numbers come from a generator seeded with seed, so the same sequence of operations fails the same way every run.
+func FailWithProbability(p float64, seed uint64) Fault {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewPCG(seed, seed))
+	return FaultFunc(func(op Op) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rng.Float64() < p
+	})
+}
+
+// FailOnce lets fault fail a single operation, and lets every operation through after that: the database "recovers".
+func FailOnce(fault Fault) Fault {
+	var failed atomic.Bool
+	return FaultFunc(func(op Op) bool {
+		return !failed.Load() && fault.Fail(op) && failed.CompareAndSwap(false, true)
+	})
+}
+
+// OnlyWrites restricts fault to writes: reads always succeed.
+func OnlyWrites(fault Fault) Fault {
+	return FaultFunc(func(op Op) bool {
+		return op.IsWrite() && fault.Fail(op)
+	})
+}
+
+// WithFaults installs a fault plan when the fake is created.
+func WithFaults(faults ...Fault) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.faults = append(c.faults, faults...)
+	}
+}
+
+// InjectFaults replaces the fault plan of the fake; calling it without faults makes the fake reliable again.
+// Every fault in the plan sees every operation, so counters like FailNthWrite count from the moment they are installed.
+func (db *FakeDatabase) InjectFaults(faults ...Fault) {
+	db.faults.Store(&faults)
+}
+
+// check returns the error op should fail with: the context's error if it is done, an injected fault, or nil.
+func (db *FakeDatabase) check(ctx context.Context, op Op) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.injectedFault(op)
+}
+
+func (db *FakeDatabase) injectedFault(op Op) error {
+	faults := db.faults.Load()
+	if faults == nil {
+		return nil
+	}
+	failed := false
+	// every fault sees the operation, even after one of them has decided to fail it, so their counters stay in step
+	for _, fault := range *faults {
+		if fault.Fail(op) {
+			failed = true
+		}
+	}
+	if !failed {
+		return nil
+	}
+	if op.Key == "" {
+		return fmt.Errorf("%w: %s", ErrInjectedFault, op.Kind)
+	}
+	return fmt.Errorf("%w: %s %q", ErrInjectedFault, op.Kind, op.Key)
+}
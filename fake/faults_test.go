@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------
+// Fault injection in the fake database.
+// ----------------------------------------------------------------------------
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+
+	// "fail the nth write":
+	// only the third write fails, reads don't count, and a failed write leaves no trace.
+	t.Run("fail the nth write", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithFaults(FailNthWrite(3)))
+		var failed []int
+		for i := 1; i <= 5; i++ {
+			GetUserData(ctx, fakeDB, "user1")
+			if err := SaveUserData(ctx, fakeDB, fmt.Sprintf("user%d", i), "data"); err != nil {
+				if !errors.Is(err, ErrInjectedFault) {
+					t.Errorf("expected ErrInjectedFault, but got: %v", err)
+				}
+				failed = append(failed, i)
+			}
+		}
+		if !slices.Equal(failed, []int{3}) {
+			t.Errorf("expected only write 3 to fail, but got: %v", failed)
+		}
+		if exists, _ := fakeDB.Exists(ctx, "user3"); exists {
+			t.Errorf("expected the failed write to have no effect")
+		}
+	})
+
+	// "fail keys matching a pattern":
+	// every operation on a matching key fails, other keys are fine.
+	t.Run("fail keys matching a pattern", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, fakeDB, "admin:root", "data")
+		fakeDB.InjectFaults(FailKeysMatching(regexp.MustCompile(`^admin:`)))
+		if _, _, err := GetUserData(ctx, fakeDB, "admin:root"); !errors.Is(err, ErrInjectedFault) {
+			t.Errorf("expected ErrInjectedFault for a read, but got: %v", err)
+		}
+		if _, err := DeleteUserData(ctx, fakeDB, "admin:root"); !errors.Is(err, ErrInjectedFault) {
+			t.Errorf("expected ErrInjectedFault for a delete, but got: %v", err)
+		}
+		if err := SaveUserData(ctx, fakeDB, "user:1", "data"); err != nil {
+			t.Errorf("unexpected error for another key: %v", err)
+		}
+
+		// and without a fault plan everything works again
+		fakeDB.InjectFaults()
+		if _, _, err := GetUserData(ctx, fakeDB, "admin:root"); err != nil {
+			t.Errorf("unexpected error after clearing the faults: %v", err)
+		}
+	})
+
+	// "fail with probability":
+	// about the right fraction fails, and the same seed fails exactly the same operations.
+	t.Run("fail with probability", func(t *testing.T) {
+		failures := func(seed uint64) []bool {
+			fakeDB := NewFakeDatabase(WithFaults(FailWithProbability(0.2, seed)))
+			result := make([]bool, 1000)
+			for i := range result {
+				result[i] = SaveUserData(ctx, fakeDB, "user1", "data") != nil
+			}
+			return result
+		}
+		first := failures(1)
+		n := 0
+		for _, f := range first {
+			if f {
+				n++
+			}
+		}
+		if n < 150 || n > 250 {
+			t.Errorf("expected about 200 failures out of 1000, but got: %d", n)
+		}
+		if !slices.Equal(first, failures(1)) {
+			t.Errorf("expected the same failures for the same seed")
+		}
+		if slices.Equal(first, failures(2)) {
+			t.Errorf("expected different failures for a different seed")
+		}
+	})
+
+	// "fail once and recover":
+	// the first matching operation fails, the retry succeeds.
+	t.Run("fail once and recover", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithFaults(FailOnce(OnlyWrites(FailKeysMatching(regexp.MustCompile(`^user1$`))))))
+		if err := SaveUserData(ctx, fakeDB, "user1", "data"); !errors.Is(err, ErrInjectedFault) {
+			t.Errorf("expected the first save to fail, but got: %v", err)
+		}
+		if err := SaveUserData(ctx, fakeDB, "user1", "data"); err != nil {
+			t.Errorf("expected the retry to succeed, but got: %v", err)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "data" {
+			t.Errorf("expected the retried data to be saved, but got: %q", data)
+		}
+	})
+
+	// "failed commit":
+	// a fault on any key of a transaction fails the commit, and none of its writes are applied.
+	t.Run("failed commit", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithFaults(FailKeysMatching(regexp.MustCompile(`^user2$`))))
+		records := map[string]string{"user1": "data 1", "user2": "data 2", "user3": "data 3"}
+		if err := SaveUserRecords(ctx, fakeDB, records); !errors.Is(err, ErrInjectedFault) {
+			t.Errorf("expected ErrInjectedFault, but got: %v", err)
+		}
+		if n, _ := fakeDB.Len(ctx); n != 0 {
+			t.Errorf("expected no users to be saved, but got %d", n)
+		}
+	})
+
+	// "cancelled context":
+	// every operation gives up when the context is done.
+	t.Run("cancelled context", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := SaveUserData(cancelled, fakeDB, "user1", "data"); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, but got: %v", err)
+		}
+		if _, err := fakeDB.Len(cancelled); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, but got: %v", err)
+		}
+		if _, err := fakeDB.Begin(cancelled); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, but got: %v", err)
+		}
+	})
+}
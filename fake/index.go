@@ -0,0 +1,308 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Secondary indexes: finding keys by what is in their values.
+// ----------------------------------------------------------------------------
+
+// The database finds a user by ID, but not by email or by signup date. WithIndex declares a secondary index on the fake:
+// an extractor function reads the indexed term out of each value, and the fake keeps a map from terms to keys
+// that every write updates along with the data.
+//
+//	fakeDB := NewFakeDatabase(WithIndex(UserEmailIndex), WithIndex(UserSignupIndex))
+//	entries, err := fakeDB.Lookup(ctx, "email", "alice@example.com")
+//	entries, err = fakeDB.LookupRange(ctx, "signup", "2024-01-01", "2024-02-01")
+//
+// Lookup finds the keys with exactly one term, LookupRange the keys with a term in [start, end);
+// both return the entries ordered by term, then by key. Terms compare as strings, so an extractor
+// has to produce strings that sort in the order it wants, like the zero-padded dates of UserSignupIndex.
+//
+// A unique index allows one key per term: a write that would give a second key the same term fails with a *UniqueViolationError
+// and changes nothing. The writes of a transaction are checked together, so two users can swap their emails in one commit.
+
+// Like the scans, the queries take a shortcut: they sort the matching terms on every call.
+
+// Index declares a secondary index.
+type Index struct {
+	Name string
+	// Extract returns the term of a key and its value, or false to leave the key out of the index.
+	// It is called with the locks of the fake held: it must be fast and must not use the fake.
+	Extract func(key, value string) (string, bool)
+	Unique  bool
+}
+
+// ErrNoSuchIndex is returned for a query on an index the fake doesn't have.
+var ErrNoSuchIndex = errors.New("no such index")
+
+// UniqueViolationError is returned by a write that would give two keys the same term in a unique index.
+type UniqueViolationError struct {
+	Index       string
+	Term        string
+	Key         string // the key that was written
+	ExistingKey string // the key that already has the term
+}
+
+func (e *UniqueViolationError) Error() string {
+	return fmt.Sprintf("unique index %q: %q of key %q is already used by key %q", e.Index, e.Term, e.Key, e.ExistingKey)
+}
+
+// WithIndex adds a secondary index to the fake.
+func WithIndex(index Index) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.indexes = append(c.indexes, index)
+	}
+}
+
+// indexSet holds the indexes of a fake. Writes lock it after the shards they write, in stamp;
+// queries only ever hold it on its own, and read the values afterwards.
+type indexSet struct {
+	mu      sync.RWMutex
+	indexes map[string]*index
+}
+
+type index struct {
+	Index
+	// terms maps every indexed key to its term and its expiry time, and keys maps every term to its keys
+	terms map[string]indexedTerm
+	keys  map[string]map[string]struct{}
+}
+
+type indexedTerm struct {
+	term      string
+	expiresAt time.Time
+}
+
+func newIndexSet(indexes []Index) *indexSet {
+	set := &indexSet{indexes: make(map[string]*index)}
+	for _, ix := range indexes {
+		set.indexes[ix.Name] = &index{Index: ix, terms: make(map[string]indexedTerm), keys: make(map[string]map[string]struct{})}
+	}
+	return set
+}
+
+// prepare checks that the writes in ops keep the unique indexes unique, and returns the function that updates the indexes.
+// The caller holds s.mu, and the locks of the shards of ops.
+func (s *indexSet) prepare(ops []walOp, now time.Time) (func(), error) {
+	type change struct {
+		ix      *index
+		key     string
+		term    indexedTerm
+		indexed bool
+	}
+	var changes []change
+	writing := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		writing[op.key] = true
+	}
+	for _, ix := range s.indexes {
+		claimed := make(map[string]string)
+		for _, op := range ops {
+			c := change{ix: ix, key: op.key, term: indexedTerm{expiresAt: op.expiresAt}}
+			if !op.deleted {
+				c.term.term, c.indexed = ix.Extract(op.key, op.value)
+			}
+			changes = append(changes, c)
+			if !c.indexed || !ix.Unique {
+				continue
+			}
+			if other, ok := claimed[c.term.term]; ok && other != op.key {
+				return nil, &UniqueViolationError{Index: ix.Name, Term: c.term.term, Key: op.key, ExistingKey: other}
+			}
+			claimed[c.term.term] = op.key
+			// a key written in the same batch gives its term up, and an expired key has none
+			for holder := range ix.keys[c.term.term] {
+				if !writing[holder] && !ix.expired(holder, now) {
+					return nil, &UniqueViolationError{Index: ix.Name, Term: c.term.term, Key: op.key, ExistingKey: holder}
+				}
+			}
+		}
+	}
+	return func() {
+		for _, c := range changes {
+			c.ix.remove(c.key)
+			if c.indexed {
+				c.ix.add(c.key, c.term)
+			}
+		}
+	}, nil
+}
+
+func (ix *index) expired(key string, now time.Time) bool {
+	t := ix.terms[key]
+	return !t.expiresAt.IsZero() && !now.Before(t.expiresAt)
+}
+
+func (ix *index) add(key string, t indexedTerm) {
+	ix.terms[key] = t
+	if ix.keys[t.term] == nil {
+		ix.keys[t.term] = make(map[string]struct{})
+	}
+	ix.keys[t.term][key] = struct{}{}
+}
+
+func (ix *index) remove(key string) {
+	t, ok := ix.terms[key]
+	if !ok {
+		return
+	}
+	delete(ix.terms, key)
+	delete(ix.keys[t.term], key)
+	if len(ix.keys[t.term]) == 0 {
+		delete(ix.keys, t.term)
+	}
+}
+
+// unindex drops an expired key from the indexes when the fake purges it (see forget in evict.go). The caller holds the lock of the key's shard.
+func (db *FakeDatabase) unindex(key string) {
+	if db.indexes == nil {
+		return
+	}
+	db.indexes.mu.Lock()
+	defer db.indexes.mu.Unlock()
+	for _, ix := range db.indexes.indexes {
+		ix.remove(key)
+	}
+}
+
+// rebuildIndexes indexes the data the fake already has, after a recovery (see wal.go).
+func (db *FakeDatabase) rebuildIndexes() error {
+	if db.indexes == nil {
+		return nil
+	}
+	now := db.clock.Now()
+	var ops []walOp
+	for _, s := range db.shards {
+		for key, it := range s.data {
+			if !it.expired(now) {
+				ops = append(ops, walOp{key: key, value: it.value, expiresAt: it.expiresAt})
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	db.indexes.mu.Lock()
+	defer db.indexes.mu.Unlock()
+	update, err := db.indexes.prepare(ops, now)
+	if err != nil {
+		return err
+	}
+	update()
+	return nil
+}
+
+// Lookup returns the entries whose term in the index is term, ordered by key.
+func (db *FakeDatabase) Lookup(ctx context.Context, index, term string) ([]Entry, error) {
+	return db.lookup(ctx, index, func(t string) bool { return t == term })
+}
+
+// LookupRange returns the entries whose term in the index is in [start, end), ordered by term and then by key.
+// An empty end means no upper bound.
+func (db *FakeDatabase) LookupRange(ctx context.Context, index, start, end string) ([]Entry, error) {
+	return db.lookup(ctx, index, func(t string) bool { return t >= start && (end == "" || t < end) })
+}
+
+func (db *FakeDatabase) lookup(ctx context.Context, name string, match func(term string) bool) (entries []Entry, err error) {
+	defer func() { db.record(Op{Kind: OpScan}, "", fmt.Sprint(len(entries), " entries"), err) }()
+	if err := db.check(ctx, Op{Kind: OpScan}); err != nil {
+		return nil, err
+	}
+	if db.indexes == nil {
+		return nil, fmt.Errorf("%w: %q", ErrNoSuchIndex, name)
+	}
+	db.indexes.mu.RLock()
+	ix, ok := db.indexes.indexes[name]
+	if !ok {
+		db.indexes.mu.RUnlock()
+		return nil, fmt.Errorf("%w: %q", ErrNoSuchIndex, name)
+	}
+	type hit struct{ term, key string }
+	var hits []hit
+	for term, keys := range ix.keys {
+		if match(term) {
+			for key := range keys {
+				hits = append(hits, hit{term, key})
+			}
+		}
+	}
+	db.indexes.mu.RUnlock()
+
+	slices.SortFunc(hits, func(a, b hit) int {
+		return cmp.Or(strings.Compare(a.term, b.term), strings.Compare(a.key, b.key))
+	})
+	// the values are read after the index is released, so a key may have changed in between:
+	// it is returned only if its value still has the term
+	for _, h := range hits {
+		it, exists := db.live(h.key)
+		if !exists {
+			continue
+		}
+		if term, ok := ix.Extract(h.key, it.value); ok && term == h.term {
+			entries = append(entries, Entry{Key: h.key, Value: it.value})
+		}
+	}
+	return entries, nil
+}
+
+// The indexes of the users, for users stored as JSON with NewUserStore (see store.go).
+var (
+	// UserEmailIndex finds users by email, ignoring case; no two users can have the same email.
+	UserEmailIndex = Index{Name: "email", Unique: true, Extract: func(key, value string) (string, bool) {
+		var user User
+		if json.Unmarshal([]byte(value), &user) != nil || user.Email == "" {
+			return "", false
+		}
+		return strings.ToLower(user.Email), true
+	}}
+	// UserSignupIndex finds users by signup date, as a UTC date like 2024-01-31.
+	UserSignupIndex = Index{Name: "signup", Extract: func(key, value string) (string, bool) {
+		var user User
+		if json.Unmarshal([]byte(value), &user) != nil || user.SignupDate.IsZero() {
+			return "", false
+		}
+		return user.SignupDate.UTC().Format(time.DateOnly), true
+	}}
+)
+
+// FindUserByEmail returns the user with the given email, with the fake created WithIndex(UserEmailIndex).
+func FindUserByEmail(ctx context.Context, db *FakeDatabase, email string) (User, bool, error) {
+	entries, err := db.Lookup(ctx, UserEmailIndex.Name, strings.ToLower(email))
+	if err != nil || len(entries) == 0 {
+		return User{}, false, err
+	}
+	user, err := JSONCodec[User]{}.Decode(entries[0].Value)
+	if err != nil {
+		return User{}, false, &DecodeError{Key: entries[0].Key, Err: err}
+	}
+	return user, true, nil
+}
+
+// UsersSignedUpBetween returns the users who signed up on the days from first to last, both included, ordered by signup date,
+// with the fake created WithIndex(UserSignupIndex).
+func UsersSignedUpBetween(ctx context.Context, db *FakeDatabase, first, last time.Time) ([]User, error) {
+	entries, err := db.LookupRange(ctx, UserSignupIndex.Name,
+		first.UTC().Format(time.DateOnly), last.UTC().AddDate(0, 0, 1).Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(entries))
+	for _, entry := range entries {
+		user, err := JSONCodec[User]{}.Decode(entry.Value)
+		if err != nil {
+			return nil, &DecodeError{Key: entry.Key, Err: err}
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Secondary indexes and the queries on them.
+// ----------------------------------------------------------------------------
+
+func date(s string) time.Time {
+	d, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// lookupKeys returns the keys of the entries a query found, or its error.
+func lookupKeys(entries []Entry, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	var keys []string
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestIndexes(t *testing.T) {
+	ctx := context.Background()
+	newUsers := func(opts ...FakeDatabaseOption) *FakeDatabase {
+		return NewFakeDatabase(append(opts, WithIndex(UserEmailIndex), WithIndex(UserSignupIndex))...)
+	}
+
+	// "equality and range queries":
+	// users are found by email, ignoring case, and by signup date, in the order of the dates and then of the keys.
+	t.Run("equality and range queries", func(t *testing.T) {
+		fakeDB := newUsers()
+		for _, user := range []User{
+			{ID: "u3", Email: "carol@example.com", SignupDate: date("2024-01-15")},
+			{ID: "u1", Email: "Alice@example.com", SignupDate: date("2024-01-20")},
+			{ID: "u2", Email: "bob@example.com", SignupDate: date("2024-01-15")},
+			{ID: "u4", Email: "dave@example.com", SignupDate: date("2024-02-01")},
+		} {
+			if err := SaveUser(ctx, fakeDB, user); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		SaveUserData(ctx, fakeDB, "not a user", "plain data")
+
+		user, found, err := FindUserByEmail(ctx, fakeDB, "alice@EXAMPLE.com")
+		if err != nil || !found || user.ID != "u1" {
+			t.Errorf("expected to find u1, but got: %+v, %v, %v", user, found, err)
+		}
+		if _, found, err := FindUserByEmail(ctx, fakeDB, "nobody@example.com"); err != nil || found {
+			t.Errorf("expected no user, but got: %v, %v", found, err)
+		}
+		users, err := UsersSignedUpBetween(ctx, fakeDB, date("2024-01-15"), date("2024-01-31"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var ids []string
+		for _, user := range users {
+			ids = append(ids, user.ID)
+		}
+		if got := strings.Join(ids, ","); got != "u2,u3,u1" {
+			t.Errorf("expected u2,u3,u1, but got: %s", got)
+		}
+		if got := lookupKeys(fakeDB.LookupRange(ctx, "signup", "2024-01-16", "")); got != "u1,u4" {
+			t.Errorf("expected u1,u4 with no upper bound, but got: %s", got)
+		}
+	})
+
+	// "kept up to date":
+	// overwrites, deletes and commits move the keys in the indexes.
+	t.Run("kept up to date", func(t *testing.T) {
+		fakeDB := newUsers()
+		SaveUser(ctx, fakeDB, User{ID: "u1", Email: "old@example.com"})
+		SaveUser(ctx, fakeDB, User{ID: "u1", Email: "new@example.com"})
+		if got := lookupKeys(fakeDB.Lookup(ctx, "email", "old@example.com")); got != "" {
+			t.Errorf("expected the old email to be gone, but got: %s", got)
+		}
+		if got := lookupKeys(fakeDB.Lookup(ctx, "email", "new@example.com")); got != "u1" {
+			t.Errorf("expected u1, but got: %s", got)
+		}
+
+		tx, _ := fakeDB.Begin(ctx)
+		tx.Delete("u1")
+		tx.Save("u2", `{"id":"u2","email":"new@example.com"}`)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := lookupKeys(fakeDB.Lookup(ctx, "email", "new@example.com")); got != "u2" {
+			t.Errorf("expected u2 after the commit, but got: %s", got)
+		}
+		DeleteUserData(ctx, fakeDB, "u2")
+		if got := lookupKeys(fakeDB.Lookup(ctx, "email", "new@example.com")); got != "" {
+			t.Errorf("expected nothing after the delete, but got: %s", got)
+		}
+	})
+
+	// "unique violation":
+	// a second user with the same email is rejected, and neither the data nor the indexes change.
+	t.Run("unique violation", func(t *testing.T) {
+		fakeDB := newUsers(WithChangeFeed(10, 0))
+		SaveUser(ctx, fakeDB, User{ID: "u1", Email: "alice@example.com"})
+		seq := fakeDB.Seq()
+
+		err := SaveUser(ctx, fakeDB, User{ID: "u2", Email: "ALICE@example.com", SignupDate: date("2024-01-01")})
+		var violation *UniqueViolationError
+		if !errors.As(err, &violation) {
+			t.Fatalf("expected a *UniqueViolationError, but got: %v", err)
+		}
+		if violation.Index != "email" || violation.Key != "u2" || violation.ExistingKey != "u1" || violation.Term != "alice@example.com" {
+			t.Errorf("unexpected violation: %+v", violation)
+		}
+		if _, found, _ := GetUser(ctx, fakeDB, "u2"); found {
+			t.Errorf("expected u2 not to be saved")
+		}
+		if got := lookupKeys(fakeDB.Lookup(ctx, "signup", "2024-01-01")); got != "" {
+			t.Errorf("expected u2 not to be indexed, but got: %s", got)
+		}
+		if fakeDB.Seq() != seq {
+			t.Errorf("expected the rejected write not to take a seq")
+		}
+		// saving the same user again is not a violation
+		if err := SaveUser(ctx, fakeDB, User{ID: "u1", Email: "alice@example.com", Name: "Alice"}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	// "unique within a commit":
+	// two users can swap their emails in one commit, but a commit can't give one email to two users.
+	t.Run("unique within a commit", func(t *testing.T) {
+		fakeDB := newUsers()
+		SaveUser(ctx, fakeDB, User{ID: "u1", Email: "a@example.com"})
+		SaveUser(ctx, fakeDB, User{ID: "u2", Email: "b@example.com"})
+
+		tx, _ := fakeDB.Begin(ctx)
+		tx.Save("u1", `{"id":"u1","email":"b@example.com"}`)
+		tx.Save("u2", `{"id":"u2","email":"a@example.com"}`)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := lookupKeys(fakeDB.Lookup(ctx, "email", "a@example.com")); got != "u2" {
+			t.Errorf("expected u2, but got: %s", got)
+		}
+
+		tx, _ = fakeDB.Begin(ctx)
+		tx.Save("u3", `{"id":"u3","email":"c@example.com"}`)
+		tx.Save("u4", `{"id":"u4","email":"c@example.com"}`)
+		var violation *UniqueViolationError
+		if err := tx.Commit(); !errors.As(err, &violation) {
+			t.Fatalf("expected a *UniqueViolationError, but got: %v", err)
+		}
+		if exists, _ := fakeDB.Exists(ctx, "u3"); exists {
+			t.Errorf("expected nothing of the commit to be saved")
+		}
+	})
+
+	// "expired keys":
+	// an expired user leaves the indexes, and its email can be used again.
+	t.Run("expired keys", func(t *testing.T) {
+		clock := NewManualClock(time.Now())
+		fakeDB := newUsers(WithClock(clock))
+		fakeDB.SaveWithTTL(ctx, "u1", `{"id":"u1","email":"a@example.com"}`, time.Minute)
+		clock.Advance(time.Hour)
+		if got := lookupKeys(fakeDB.Lookup(ctx, "email", "a@example.com")); got != "" {
+			t.Errorf("expected the expired user not to be found, but got: %s", got)
+		}
+		if err := SaveUser(ctx, fakeDB, User{ID: "u2", Email: "a@example.com"}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		fakeDB.PurgeExpired()
+		if got := lookupKeys(fakeDB.Lookup(ctx, "email", "a@example.com")); got != "u2" {
+			t.Errorf("expected u2, but got: %s", got)
+		}
+	})
+
+	// "no such index":
+	t.Run("no such index", func(t *testing.T) {
+		if _, err := newUsers().Lookup(ctx, "name", "Alice"); !errors.Is(err, ErrNoSuchIndex) {
+			t.Errorf("expected ErrNoSuchIndex, but got: %v", err)
+		}
+		if _, err := NewFakeDatabase().Lookup(ctx, "email", "a@example.com"); !errors.Is(err, ErrNoSuchIndex) {
+			t.Errorf("expected ErrNoSuchIndex, but got: %v", err)
+		}
+	})
+
+	// "rebuilt after a restart":
+	// a persistent fake indexes the data it recovers.
+	t.Run("rebuilt after a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDB, err := OpenFakeDatabase(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		SaveUser(ctx, fakeDB, User{ID: "u1", Email: "a@example.com"})
+		fakeDB.Close()
+
+		fakeDB, err = OpenFakeDatabase(dir, WithIndex(UserEmailIndex))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer fakeDB.Close()
+		if got := lookupKeys(fakeDB.Lookup(ctx, "email", "a@example.com")); got != "u1" {
+			t.Errorf("expected u1, but got: %s", got)
+		}
+		var violation *UniqueViolationError
+		if err := SaveUser(ctx, fakeDB, User{ID: "u2", Email: "a@example.com"}); !errors.As(err, &violation) {
+			t.Errorf("expected a *UniqueViolationError, but got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// An operation journal: what the code under test did to the fake.
+// ----------------------------------------------------------------------------
+
+// The state of the fake says what the code wrote, but not what it read, nor how often.
+// With WithJournal, the fake records every operation in a Journal, once it has run:
+// its kind and key, the value it read or wrote, its result and its error, the fake's time, and a sequence number.
+//
+//	fakeDB := NewFakeDatabase(WithJournal())
+//	SaveUserData(ctx, fakeDB, "user1", "data")
+//	fakeDB.Journal().Reset()
+//	GetUserData(ctx, fakeDB, "user1")
+//	if n := fakeDB.Journal().Count(OpGet, "user1"); n != 1 {
+//		t.Errorf("expected GetUserData to read once, but it read %d times", n)
+//	}
+//	if writes := fakeDB.Journal().Writes(); len(writes) > 0 {
+//		t.Errorf("expected no writes on the read path, but got: %v", writes)
+//	}
+//
+// The journal sees the operations the fault plan sees (see faults.go): a commit is one save or delete per key it writes,
+// and a helper like Update shows up as the reads and writes it is made of. Operations that fail are recorded too, with their error.
+// The sequence numbers order the entries by the time the operations finished, whatever goroutine ran them.
+//
+// LogJournalOnFailure (see journal_test.go) prints the journal as JSON when a test fails, which is often all it takes to see what went wrong.
+
+// JournalEntry is one operation in the journal.
+type JournalEntry struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Op   OpKind    `json:"op"`
+	Key  string    `json:"key,omitempty"`
+	// Value is the value written, or the value read
+	Value string `json:"value,omitempty"`
+	// Result is what the operation returned: "found" or "missing", a version, a count
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (e JournalEntry) String() string {
+	s := fmt.Sprintf("#%d %s", e.Seq, e.Op)
+	if e.Key != "" {
+		s += fmt.Sprintf(" %q", e.Key)
+	}
+	if e.Error != "" {
+		return s + ": " + e.Error
+	}
+	return s + " -> " + e.Result
+}
+
+// Journal is the list of the operations on a fake. It is safe for concurrent use.
+type Journal struct {
+	mu      sync.Mutex
+	seq     uint64
+	entries []JournalEntry
+}
+
+// WithJournal makes the fake record its operations in a Journal.
+func WithJournal() FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.journal = true
+	}
+}
+
+// Journal returns the journal of the fake, or nil if it was created without WithJournal.
+func (db *FakeDatabase) Journal() *Journal {
+	return db.journal
+}
+
+// record adds an operation to the journal, if the fake keeps one.
+func (db *FakeDatabase) record(op Op, value, result string, err error) {
+	if db.journal == nil {
+		return
+	}
+	entry := JournalEntry{Time: db.clock.Now(), Op: op.Kind, Key: op.Key, Value: value, Result: result}
+	if err != nil {
+		entry.Error = err.Error()
+		entry.Result = ""
+	}
+	db.journal.add(entry)
+}
+
+func (j *Journal) add(entry JournalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	entry.Seq = j.seq
+	j.entries = append(j.entries, entry)
+}
+
+// found is the result of an operation that looks for a key.
+func found(exists bool) string {
+	if exists {
+		return "found"
+	}
+	return "missing"
+}
+
+// Entries returns a copy of the entries, in order.
+func (j *Journal) Entries() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.entries)
+}
+
+// Filter returns the entries of the given kind on key; an empty key matches every key.
+func (j *Journal) Filter(kind OpKind, key string) []JournalEntry {
+	var entries []JournalEntry
+	for _, entry := range j.Entries() {
+		if entry.Op == kind && (key == "" || entry.Key == key) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Count returns how many operations of the given kind were run on key; an empty key counts every key.
+func (j *Journal) Count(kind OpKind, key string) int {
+	return len(j.Filter(kind, key))
+}
+
+// Writes returns the saves and deletes, including the failed ones.
+func (j *Journal) Writes() []JournalEntry {
+	var writes []JournalEntry
+	for _, entry := range j.Entries() {
+		if (Op{Kind: entry.Op}).IsWrite() {
+			writes = append(writes, entry)
+		}
+	}
+	return writes
+}
+
+// Reset empties the journal, typically once a test has set up its data. The sequence numbers go on.
+func (j *Journal) Reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = nil
+}
+
+// MarshalJSON encodes the journal as the array of its entries.
+func (j *Journal) MarshalJSON() ([]byte, error) {
+	entries := j.Entries()
+	if entries == nil {
+		entries = []JournalEntry{}
+	}
+	return json.Marshal(entries)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// The operation journal.
+// ----------------------------------------------------------------------------
+
+// LogJournalOnFailure logs the journal of db as JSON at the end of the test, if the test failed.
+func LogJournalOnFailure(t testing.TB, db *FakeDatabase) {
+	t.Helper()
+	t.Cleanup(func() {
+		if !t.Failed() || db.journal == nil {
+			return
+		}
+		data, err := json.MarshalIndent(db.journal, "", "  ")
+		if err != nil {
+			t.Logf("encoding the journal: %v", err)
+			return
+		}
+		t.Logf("journal of the fake database:\n%s", data)
+	})
+}
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+
+	// "read exactly once":
+	// GetUserData reads the store once and writes nothing.
+	t.Run("read exactly once", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithJournal())
+		LogJournalOnFailure(t, fakeDB)
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		fakeDB.Journal().Reset()
+
+		GetUserData(ctx, fakeDB, "user1")
+		if n := fakeDB.Journal().Count(OpGet, "user1"); n != 1 {
+			t.Errorf("expected 1 read of user1, but got: %d", n)
+		}
+		if writes := fakeDB.Journal().Writes(); len(writes) > 0 {
+			t.Errorf("expected no writes, but got: %v", writes)
+		}
+	})
+
+	// "entries":
+	// every operation is recorded with its key, value, result and the fake's time, in order.
+	t.Run("entries", func(t *testing.T) {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := NewManualClock(start)
+		fakeDB := NewFakeDatabase(WithJournal(), WithClock(clock))
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		clock.Advance(time.Second)
+		GetUserData(ctx, fakeDB, "user1")
+		GetUserData(ctx, fakeDB, "missing")
+		DeleteUserData(ctx, fakeDB, "user1")
+		fakeDB.Exists(ctx, "user1")
+		ListUsers(ctx, fakeDB)
+
+		entries := fakeDB.Journal().Entries()
+		expected := []string{
+			`#1 save "user1" -> version 1`,
+			`#2 get "user1" -> found`,
+			`#3 get "missing" -> missing`,
+			`#4 delete "user1" -> found`,
+			`#5 exists "user1" -> missing`,
+			`#6 scan -> 0 entries`,
+		}
+		if len(entries) != len(expected) {
+			t.Fatalf("expected %d entries, but got: %v", len(expected), entries)
+		}
+		for i, entry := range entries {
+			if entry.String() != expected[i] {
+				t.Errorf("entry %d: expected %s, but got: %s", i, expected[i], entry)
+			}
+		}
+		if entries[0].Value != "data 1" || entries[1].Value != "data 1" {
+			t.Errorf("expected the value written and read, but got: %q and %q", entries[0].Value, entries[1].Value)
+		}
+		if !entries[0].Time.Equal(start) || !entries[1].Time.Equal(start.Add(time.Second)) {
+			t.Errorf("expected the fake's time, but got: %v and %v", entries[0].Time, entries[1].Time)
+		}
+	})
+
+	// "failures and commits":
+	// failed operations are recorded with their error, and a commit as one write per key.
+	t.Run("failures and commits", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithJournal(), WithFaults(FailKeysMatching(regexp.MustCompile(`^admin$`))))
+		SaveUserData(ctx, fakeDB, "admin", "data")
+		SaveUserRecords(ctx, fakeDB, map[string]string{"user2": "data 2", "user1": "data 1"})
+
+		entries := fakeDB.Journal().Entries()
+		if entries[0].Op != OpSave || entries[0].Error == "" || entries[0].Result != "" {
+			t.Errorf("expected a failed save, but got: %+v", entries[0])
+		}
+		if saves := fakeDB.Journal().Filter(OpSave, ""); len(saves) != 3 || saves[1].Key != "user1" || saves[2].Key != "user2" {
+			t.Errorf("expected the failed save and the commit's saves in key order, but got: %v", saves)
+		}
+		if n := fakeDB.Journal().Count(OpBegin, ""); n != 1 {
+			t.Errorf("expected 1 begin, but got: %d", n)
+		}
+	})
+
+	// "concurrent operations":
+	// the sequence numbers are unique and in order, whatever goroutine ran the operation.
+	t.Run("concurrent operations", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithJournal())
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 50 {
+					SaveUserData(ctx, fakeDB, "user", "data")
+					GetUserData(ctx, fakeDB, "user")
+				}
+			}()
+		}
+		wg.Wait()
+		entries := fakeDB.Journal().Entries()
+		if len(entries) != 800 {
+			t.Fatalf("expected 800 entries, but got: %d", len(entries))
+		}
+		for i, entry := range entries {
+			if entry.Seq != uint64(i+1) {
+				t.Fatalf("entry %d: expected seq %d, but got: %d", i, i+1, entry.Seq)
+			}
+		}
+	})
+
+	// "json":
+	// the journal encodes as an array of entries.
+	t.Run("json", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithJournal())
+		data, _ := json.Marshal(fakeDB.Journal())
+		if string(data) != "[]" {
+			t.Errorf("expected an empty array, but got: %s", data)
+		}
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		data, err := json.Marshal(fakeDB.Journal())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var decoded []JournalEntry
+		if err := json.Unmarshal(data, &decoded); err != nil || len(decoded) != 1 || decoded[0].Key != "user1" || decoded[0].Op != OpSave {
+			t.Errorf("expected to decode the save back, but got: %s (%v)", data, err)
+		}
+	})
+
+	// "off by default":
+	t.Run("off by default", func(t *testing.T) {
+		if NewFakeDatabase().Journal() != nil {
+			t.Errorf("expected no journal")
+		}
+	})
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"iter"
+	"maps"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Latency: a Database wrapper that makes every operation take time.
+// ----------------------------------------------------------------------------
+
+// The fake answers at once, so a test never sees the code under test wait for the database: a timeout that is too short,
+// a request that forgets its deadline, a loop of reads that is fine on a map and slow over a network.
+// WithLatency wraps any Database, and delays every operation before it runs it:
+//
+//	slowDB, err := WithLatency(fakeDB, 42,
+//		WithDefaultLatency(FixedLatency(2*time.Millisecond)),
+//		WithOpLatency(OpScan, PercentileLatency{{Percent: 50, Latency: 5 * time.Millisecond}, {Percent: 99, Latency: 50 * time.Millisecond}}),
+//		WithHotKeys(regexp.MustCompile(`^user:celebrity`), FixedLatency(20*time.Millisecond)),
+//		WithLockContention(1),
+//	)
+//	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+//	_, _, err := GetUserData(ctx, slowDB, "user:celebrity1") // context.DeadlineExceeded, after 10ms
+//
+// The latency of an operation is chosen in this order: the first hot spot whose pattern matches one of its keys,
+// the latency of its kind of operation (the kinds of faults.go: GetVersion is a get, CompareAndSwap and SaveWithTTL are saves,
+// CompareAndDelete is a delete),
+// and the default latency, which is none unless WithDefaultLatency sets one.
+// A batch, a scan, All and a commit are one round trip each, delayed once; the Get of a transaction is delayed like any get,
+// and its Save and Delete are buffered and not delayed.
+//
+// The delays honour the context: an operation whose context is done while it waits returns the context's error,
+// and doesn't reach the Database underneath.
+//
+// WithLockContention makes the writes to the same keys wait for each other, like the row locks of a busy database:
+// a write holds the locks of its keys for its delay and the write itself, and the writes that come in the meantime queue up.
+//
+// The delays are drawn from a generator seeded with seed, so the same sequence of operations gets the same delays every run.
+// WithLatencyCallback reports each delay, which is how a test can check them without timing anything.
+
+// The keys are spread over the contention locks by a hash, so two keys may share a lock, as they would share a page;
+// WithLockContention(1) is one lock for the whole database, a table lock.
+// A write takes the locks of its keys in order, so two writes over the same keys can't deadlock.
+
+// ErrInvalidLatency is returned by WithLatency for a latency that makes no sense, like percentiles out of order.
+var ErrInvalidLatency = errors.New("invalid latency")
+
+// Latency decides how long an operation takes. Latencies are called under the lock of the wrapper's generator.
+type Latency interface {
+	Delay(rng *rand.Rand) time.Duration
+}
+
+// LatencyFunc turns a function into a Latency.
+type LatencyFunc func(rng *rand.Rand) time.Duration
+
+func (f LatencyFunc) Delay(rng *rand.Rand) time.Duration {
+	return f(rng)
+}
+
+// FixedLatency makes every operation take d.
+func FixedLatency(d time.Duration) Latency {
+	return LatencyFunc(func(*rand.Rand) time.Duration { return d })
+}
+
+// LatencyPercentile says that Percent percent of the operations take at most Latency.
+type LatencyPercentile struct {
+	Percent float64
+	Latency time.Duration
+}
+
+// PercentileLatency describes a long-tail distribution by a few of its percentiles, e.g. p50=5ms, p99=50ms, p99.9=500ms,
+// in increasing order. Delays between two given percentiles are interpolated linearly; the fastest operations take no time at all
+// and the slowest take the latency of the highest percentile. Only the percentiles given shape the distribution:
+// with p50 and p99 alone, p80 falls on the line between them. WithLatency rejects percentiles out of order,
+// and latencies that drop as the percentiles rise.
+type PercentileLatency []LatencyPercentile
+
+func (l PercentileLatency) Delay(rng *rand.Rand) time.Duration {
+	percent := rng.Float64() * 100
+	lowPercent, lowLatency := 0.0, time.Duration(0)
+	for _, p := range l {
+		if percent <= p.Percent {
+			fraction := (percent - lowPercent) / (p.Percent - lowPercent)
+			return lowLatency + time.Duration(fraction*float64(p.Latency-lowLatency))
+		}
+		lowPercent, lowLatency = p.Percent, p.Latency
+	}
+	return lowLatency
+}
+
+// validate checks that the percentiles are between 0 and 100, and that both they and their latencies increase.
+func (l PercentileLatency) validate() error {
+	if len(l) == 0 {
+		return fmt.Errorf("%w: no percentiles", ErrInvalidLatency)
+	}
+	lowPercent, lowLatency := 0.0, time.Duration(0)
+	for _, p := range l {
+		if p.Percent <= lowPercent || p.Percent > 100 {
+			return fmt.Errorf("%w: percentile %v after %v", ErrInvalidLatency, p.Percent, lowPercent)
+		}
+		if p.Latency < lowLatency {
+			return fmt.Errorf("%w: p%v is %v, less than the %v before it", ErrInvalidLatency, p.Percent, p.Latency, lowLatency)
+		}
+		lowPercent, lowLatency = p.Percent, p.Latency
+	}
+	return nil
+}
+
+type LatencyOption func(*latencyConfig)
+
+type latencyConfig struct {
+	defaultLatency Latency
+	ops            map[OpKind]Latency
+	hotSpots       []hotSpot
+	stripes        int
+	onDelay        func(op Op, delay time.Duration)
+}
+
+// hotSpot is a latency for the keys that match pattern.
+type hotSpot struct {
+	pattern *regexp.Regexp
+	latency Latency
+}
+
+// WithDefaultLatency sets the latency of the operations that have no other.
+func WithDefaultLatency(latency Latency) LatencyOption {
+	return func(c *latencyConfig) {
+		c.defaultLatency = latency
+	}
+}
+
+// WithOpLatency sets the latency of one kind of operation.
+func WithOpLatency(kind OpKind, latency Latency) LatencyOption {
+	return func(c *latencyConfig) {
+		c.ops[kind] = latency
+	}
+}
+
+// WithHotKeys sets the latency of the operations on the keys that match pattern, whatever their kind.
+func WithHotKeys(pattern *regexp.Regexp, latency Latency) LatencyOption {
+	return func(c *latencyConfig) {
+		c.hotSpots = append(c.hotSpots, hotSpot{pattern: pattern, latency: latency})
+	}
+}
+
+// WithLockContention makes the writes lock their keys, with stripes locks for the whole key space; 0 means no locks.
+func WithLockContention(stripes int) LatencyOption {
+	return func(c *latencyConfig) {
+		c.stripes = stripes
+	}
+}
+
+// WithLatencyCallback calls fn with every operation and its delay, before the delay. The key of op is empty
+// for the operations on several keys or none. fn is called from the goroutine of the operation, without any lock held.
+func WithLatencyCallback(fn func(op Op, delay time.Duration)) LatencyOption {
+	return func(c *latencyConfig) {
+		c.onDelay = fn
+	}
+}
+
+// LatencyDatabase is a Database whose operations take time. It is safe for concurrent use, like the Database it wraps.
+type LatencyDatabase struct {
+	db     Database
+	config latencyConfig
+	// mu guards rng: the delays are drawn one at a time, in the order of the operations
+	mu  sync.Mutex
+	rng *rand.Rand
+	// locks are the contention locks, each a channel with room for one holder
+	locks []chan struct{}
+}
+
+// WithLatency returns db with the latencies of opts, drawn from a generator seeded with seed.
+func WithLatency(db Database, seed uint64, opts ...LatencyOption) (*LatencyDatabase, error) {
+	config := latencyConfig{ops: make(map[OpKind]Latency)}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	latencies := []Latency{config.defaultLatency}
+	for _, latency := range config.ops {
+		latencies = append(latencies, latency)
+	}
+	for _, spot := range config.hotSpots {
+		latencies = append(latencies, spot.latency)
+	}
+	for _, latency := range latencies {
+		if l, ok := latency.(interface{ validate() error }); ok {
+			if err := l.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ldb := &LatencyDatabase{db: db, config: config, rng: rand.New(rand.NewPCG(seed, seed))}
+	for range config.stripes {
+		ldb.locks = append(ldb.locks, make(chan struct{}, 1))
+	}
+	return ldb, nil
+}
+
+// latency returns the Latency of an operation of kind on keys, or nil for none.
+func (ldb *LatencyDatabase) latency(kind OpKind, keys []string) Latency {
+	for _, spot := range ldb.config.hotSpots {
+		for _, key := range keys {
+			if spot.pattern.MatchString(key) {
+				return spot.latency
+			}
+		}
+	}
+	if latency, ok := ldb.config.ops[kind]; ok {
+		return latency
+	}
+	return ldb.config.defaultLatency
+}
+
+// do runs op once the operation of kind on keys has waited for its delay, and for the locks of its keys if it is a write.
+// If ctx is done first, op doesn't run and do returns the context's error.
+func (ldb *LatencyDatabase) do(ctx context.Context, kind OpKind, keys []string, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var delay time.Duration
+	if latency := ldb.latency(kind, keys); latency != nil {
+		ldb.mu.Lock()
+		delay = latency.Delay(ldb.rng)
+		ldb.mu.Unlock()
+	}
+	if ldb.config.onDelay != nil {
+		callbackOp := Op{Kind: kind}
+		if len(keys) == 1 {
+			callbackOp.Key = keys[0]
+		}
+		ldb.config.onDelay(callbackOp, delay)
+	}
+	if (kind == OpSave || kind == OpDelete) && len(ldb.locks) > 0 {
+		unlock, err := ldb.lock(ctx, keys)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if delay > 0 {
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+	return op()
+}
+
+// lock takes the contention locks of keys, in order, and returns the function that releases them.
+func (ldb *LatencyDatabase) lock(ctx context.Context, keys []string) (func(), error) {
+	var stripes []int
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		stripes = append(stripes, int(h.Sum32()%uint32(len(ldb.locks))))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+	unlock := func(held []int) {
+		for _, i := range held {
+			<-ldb.locks[i]
+		}
+	}
+	for n, i := range stripes {
+		select {
+		case ldb.locks[i] <- struct{}{}:
+		case <-ctx.Done():
+			unlock(stripes[:n])
+			return nil, ctx.Err()
+		}
+	}
+	return func() { unlock(stripes) }, nil
+}
+
+func (ldb *LatencyDatabase) Save(ctx context.Context, key, value string) error {
+	return ldb.do(ctx, OpSave, []string{key}, func() error {
+		return ldb.db.Save(ctx, key, value)
+	})
+}
+
+func (ldb *LatencyDatabase) Get(ctx context.Context, key string) (value string, exists bool, err error) {
+	err = ldb.do(ctx, OpGet, []string{key}, func() error {
+		value, exists, err = ldb.db.Get(ctx, key)
+		return err
+	})
+	return value, exists, err
+}
+
+func (ldb *LatencyDatabase) Delete(ctx context.Context, key string) (deleted bool, err error) {
+	err = ldb.do(ctx, OpDelete, []string{key}, func() error {
+		deleted, err = ldb.db.Delete(ctx, key)
+		return err
+	})
+	return deleted, err
+}
+
+func (ldb *LatencyDatabase) Exists(ctx context.Context, key string) (exists bool, err error) {
+	err = ldb.do(ctx, OpExists, []string{key}, func() error {
+		exists, err = ldb.db.Exists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (ldb *LatencyDatabase) Len(ctx context.Context) (n int, err error) {
+	err = ldb.do(ctx, OpLen, nil, func() error {
+		n, err = ldb.db.Len(ctx)
+		return err
+	})
+	return n, err
+}
+
+func (ldb *LatencyDatabase) Scan(ctx context.Context, opts ScanOptions) (page ScanPage, err error) {
+	err = ldb.do(ctx, OpScan, nil, func() error {
+		page, err = ldb.db.Scan(ctx, opts)
+		return err
+	})
+	return page, err
+}
+
+// All waits once, before the first entry.
+func (ldb *LatencyDatabase) All(ctx context.Context) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		err := ldb.do(ctx, OpScan, nil, func() error {
+			for entry, err := range ldb.db.All(ctx) {
+				if !yield(entry, err) {
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			yield(Entry{}, err)
+		}
+	}
+}
+
+func (ldb *LatencyDatabase) SaveWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	return ldb.do(ctx, OpSave, []string{key}, func() error {
+		return ldb.db.SaveWithTTL(ctx, key, value, ttl)
+	})
+}
+
+func (ldb *LatencyDatabase) GetVersion(ctx context.Context, key string) (value string, version uint64, err error) {
+	err = ldb.do(ctx, OpGet, []string{key}, func() error {
+		value, version, err = ldb.db.GetVersion(ctx, key)
+		return err
+	})
+	return value, version, err
+}
+
+func (ldb *LatencyDatabase) CompareAndSwap(ctx context.Context, key string, version uint64, value string) (newVersion uint64, err error) {
+	err = ldb.do(ctx, OpSave, []string{key}, func() error {
+		newVersion, err = ldb.db.CompareAndSwap(ctx, key, version, value)
+		return err
+	})
+	return newVersion, err
+}
+
+func (ldb *LatencyDatabase) CompareAndDelete(ctx context.Context, key string, version uint64) error {
+	return ldb.do(ctx, OpDelete, []string{key}, func() error {
+		return ldb.db.CompareAndDelete(ctx, key, version)
+	})
+}
+
+func (ldb *LatencyDatabase) SaveMany(ctx context.Context, entries []Entry) error {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return ldb.do(ctx, OpSave, keys, func() error {
+		return ldb.db.SaveMany(ctx, entries)
+	})
+}
+
+func (ldb *LatencyDatabase) GetMany(ctx context.Context, keys []string) (values map[string]string, err error) {
+	err = ldb.do(ctx, OpGet, keys, func() error {
+		values, err = ldb.db.GetMany(ctx, keys)
+		return err
+	})
+	return values, err
+}
+
+func (ldb *LatencyDatabase) Begin(ctx context.Context) (tx Tx, err error) {
+	err = ldb.do(ctx, OpBegin, nil, func() error {
+		tx, err = ldb.db.Begin(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &latencyTx{ctx: ctx, tx: tx, ldb: ldb, written: make(map[string]bool)}, nil
+}
+
+// latencyTx delays the reads and the commit of a transaction. It keeps the keys it writes, for the latency and the locks of the commit.
+type latencyTx struct {
+	ctx     context.Context
+	tx      Tx
+	ldb     *LatencyDatabase
+	written map[string]bool
+}
+
+func (tx *latencyTx) Get(key string) (value string, exists bool, err error) {
+	err = tx.ldb.do(tx.ctx, OpGet, []string{key}, func() error {
+		value, exists, err = tx.tx.Get(key)
+		return err
+	})
+	return value, exists, err
+}
+
+func (tx *latencyTx) Save(key, value string) error {
+	tx.written[key] = true
+	return tx.tx.Save(key, value)
+}
+
+func (tx *latencyTx) Delete(key string) (bool, error) {
+	tx.written[key] = true
+	return tx.tx.Delete(key)
+}
+
+// Commit is a write of every key of the transaction, delayed once.
+func (tx *latencyTx) Commit() error {
+	err := tx.ldb.do(tx.ctx, OpSave, slices.Sorted(maps.Keys(tx.written)), tx.tx.Commit)
+	if err != nil {
+		// a commit whose context ended while it waited never reached the database; the transaction is over all the same
+		tx.tx.Rollback()
+	}
+	return err
+}
+
+func (tx *latencyTx) Rollback() error {
+	return tx.tx.Rollback()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// The latency wrapper: slow operations, deadlines and lock contention.
+// ----------------------------------------------------------------------------
+
+// delayRecorder collects the delays reported by WithLatencyCallback.
+type delayRecorder struct {
+	mu     sync.Mutex
+	ops    []Op
+	delays []time.Duration
+}
+
+func (r *delayRecorder) option() LatencyOption {
+	return WithLatencyCallback(func(op Op, delay time.Duration) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.ops = append(r.ops, op)
+		r.delays = append(r.delays, delay)
+	})
+}
+
+func newLatencyDatabase(t *testing.T, db Database, seed uint64, opts ...LatencyOption) *LatencyDatabase {
+	t.Helper()
+	slowDB, err := WithLatency(db, seed, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return slowDB
+}
+
+func TestLatency(t *testing.T) {
+	ctx := context.Background()
+
+	// "slow operations":
+	// an operation takes at least its latency, and then does what the database underneath does.
+	t.Run("slow operations", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		slowDB := newLatencyDatabase(t, fakeDB, 1, WithDefaultLatency(FixedLatency(20*time.Millisecond)))
+		start := time.Now()
+		SaveUserData(ctx, slowDB, "user1", "data")
+		data, _, err := GetUserData(ctx, slowDB, "user1")
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			t.Errorf("expected 2 operations to take 40ms, but they took: %v", elapsed)
+		}
+		if err != nil || data != "data" {
+			t.Errorf("expected data, but got: %q (error: %v)", data, err)
+		}
+		AssertState(t, fakeDB, State{"user1": "data"})
+	})
+
+	// "deadlines":
+	// an operation gives up when its context is done before its latency has passed, and doesn't reach the database.
+	t.Run("deadlines", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithJournal())
+		slowDB := newLatencyDatabase(t, fakeDB, 1, WithDefaultLatency(FixedLatency(time.Minute)))
+		timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := SaveUserData(timeout, slowDB, "user1", "data"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, but got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("expected the save to give up at its deadline, but it took: %v", elapsed)
+		}
+		if _, _, err := GetUserData(timeout, slowDB, "user1"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, but got: %v", err)
+		}
+		if n := len(fakeDB.Journal().Entries()); n != 0 {
+			t.Errorf("expected no operation to reach the fake, but got: %d", n)
+		}
+	})
+
+	// "latency profiles":
+	// a hot spot wins over the latency of the operation, which wins over the default.
+	t.Run("latency profiles", func(t *testing.T) {
+		var r delayRecorder
+		slowDB := newLatencyDatabase(t, NewFakeDatabase(), 1,
+			WithDefaultLatency(FixedLatency(1*time.Microsecond)),
+			WithOpLatency(OpGet, FixedLatency(2*time.Microsecond)),
+			WithHotKeys(regexp.MustCompile(`^hot`), FixedLatency(3*time.Microsecond)),
+			r.option())
+		slowDB.Save(ctx, "user1", "data")
+		slowDB.Get(ctx, "user1")
+		slowDB.GetVersion(ctx, "user1")
+		slowDB.Save(ctx, "hot1", "data")
+		slowDB.GetMany(ctx, []string{"user1", "hot1"})
+		expected := []time.Duration{1 * time.Microsecond, 2 * time.Microsecond, 2 * time.Microsecond, 3 * time.Microsecond, 3 * time.Microsecond}
+		if !slices.Equal(r.delays, expected) {
+			t.Errorf("expected the delays %v, but got: %v", expected, r.delays)
+		}
+		if r.ops[3] != (Op{Kind: OpSave, Key: "hot1"}) || r.ops[4] != (Op{Kind: OpGet}) {
+			t.Errorf("unexpected operations: %v", r.ops)
+		}
+	})
+
+	// "percentiles":
+	// the latencies drawn from percentiles have those percentiles, and only the given ones count.
+	for name, test := range map[string]struct {
+		latency  PercentileLatency
+		expected map[float64]time.Duration
+	}{
+		"all of them": {
+			PercentileLatency{{50, 2 * time.Millisecond}, {90, 10 * time.Millisecond}, {99, 50 * time.Millisecond}, {100, 100 * time.Millisecond}},
+			map[float64]time.Duration{50: 2 * time.Millisecond, 90: 10 * time.Millisecond, 99: 50 * time.Millisecond},
+		},
+		"p50 and p99": {
+			PercentileLatency{{50, 5 * time.Millisecond}, {99, 50 * time.Millisecond}},
+			map[float64]time.Duration{25: 2500 * time.Microsecond, 50: 5 * time.Millisecond, 80: 32551 * time.Microsecond, 99: 50 * time.Millisecond},
+		},
+	} {
+		t.Run("percentiles, "+name, func(t *testing.T) {
+			rng := rand.New(rand.NewPCG(1, 1))
+			delays := make([]time.Duration, 100000)
+			for i := range delays {
+				delays[i] = test.latency.Delay(rng)
+			}
+			slices.Sort(delays)
+			for percent, expected := range test.expected {
+				got := delays[int(percent/100*float64(len(delays)))]
+				if got < expected*90/100 || got > expected*110/100 {
+					t.Errorf("expected a p%v of about %v, but got: %v", percent, expected, got)
+				}
+			}
+			if highest := test.latency[len(test.latency)-1].Latency; delays[len(delays)-1] > highest {
+				t.Errorf("expected at most %v, but got: %v", highest, delays[len(delays)-1])
+			}
+		})
+	}
+
+	// "invalid percentiles":
+	// percentiles that are missing, out of order, out of range or with latencies that go down are rejected.
+	t.Run("invalid percentiles", func(t *testing.T) {
+		for _, latency := range []PercentileLatency{
+			{},
+			{{99, 50 * time.Millisecond}, {50, 5 * time.Millisecond}},
+			{{50, 5 * time.Millisecond}, {50, 6 * time.Millisecond}},
+			{{50, 5 * time.Millisecond}, {150, 50 * time.Millisecond}},
+			{{50, 5 * time.Millisecond}, {90, 0}, {99, 50 * time.Millisecond}},
+		} {
+			if _, err := WithLatency(NewFakeDatabase(), 1, WithHotKeys(regexp.MustCompile(`.`), latency)); !errors.Is(err, ErrInvalidLatency) {
+				t.Errorf("%v: expected ErrInvalidLatency, but got: %v", latency, err)
+			}
+		}
+	})
+
+	// "reproducible":
+	// the same seed gives the same delays to the same operations, and another seed other ones.
+	t.Run("reproducible", func(t *testing.T) {
+		run := func(seed uint64) []time.Duration {
+			var r delayRecorder
+			latency := PercentileLatency{{Percent: 50, Latency: time.Microsecond}, {Percent: 99, Latency: 10 * time.Microsecond}}
+			slowDB := newLatencyDatabase(t, NewFakeDatabase(), seed, WithDefaultLatency(latency), r.option())
+			for range 20 {
+				SaveUserData(ctx, slowDB, "user1", "data")
+				GetUserData(ctx, slowDB, "user1")
+			}
+			return r.delays
+		}
+		if first, second := run(42), run(42); !slices.Equal(first, second) {
+			t.Errorf("expected the same delays, but got: %v and %v", first, second)
+		}
+		if slices.Equal(run(42), run(43)) {
+			t.Errorf("expected other delays with another seed")
+		}
+	})
+
+	// "lock contention":
+	// writes to the same key wait for each other; writes to other keys and reads don't.
+	t.Run("lock contention", func(t *testing.T) {
+		slowDB := newLatencyDatabase(t, NewFakeDatabase(), 1, WithDefaultLatency(FixedLatency(20*time.Millisecond)), WithLockContention(1024))
+		run := func(keys ...string) time.Duration {
+			start := time.Now()
+			var wg sync.WaitGroup
+			for _, key := range keys {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					SaveUserData(ctx, slowDB, key, "data")
+				}()
+			}
+			wg.Wait()
+			return time.Since(start)
+		}
+		if elapsed := run("user1", "user1", "user1", "user1", "user1"); elapsed < 100*time.Millisecond {
+			t.Errorf("expected 5 writes to the same key to take 100ms, but they took: %v", elapsed)
+		}
+		// the keys of the other writes could share a lock; one in 1024 is unlikely enough, and the same every run
+		if elapsed := run("user1", "user2", "user3", "user4", "user5"); elapsed > 80*time.Millisecond {
+			t.Errorf("expected 5 writes to other keys to run together, but they took: %v", elapsed)
+		}
+	})
+
+	// "waiting for a lock":
+	// a write that waits for a lock gives up at its deadline too.
+	t.Run("waiting for a lock", func(t *testing.T) {
+		slowDB := newLatencyDatabase(t, NewFakeDatabase(), 1, WithOpLatency(OpSave, FixedLatency(time.Second)), WithLockContention(1))
+		go SaveUserData(ctx, slowDB, "user1", "data")
+		time.Sleep(10 * time.Millisecond)
+		timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if err := SaveUserData(timeout, slowDB, "user2", "data"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, but got: %v", err)
+		}
+		// reads take no lock
+		start := time.Now()
+		if _, _, err := GetUserData(ctx, slowDB, "user1"); err != nil || time.Since(start) > 500*time.Millisecond {
+			t.Errorf("expected the read not to wait, but it took: %v (error: %v)", time.Since(start), err)
+		}
+	})
+
+	// "transactions":
+	// the reads of a transaction are delayed, and its commit once for all its writes.
+	t.Run("transactions", func(t *testing.T) {
+		var r delayRecorder
+		fakeDB := NewFakeDatabase()
+		slowDB := newLatencyDatabase(t, fakeDB, 1, WithDefaultLatency(FixedLatency(time.Microsecond)), WithLockContention(1), r.option())
+		err := WithTx(ctx, slowDB, func(tx Tx) error {
+			tx.Get("user1")
+			tx.Save("user1", "data 1")
+			return tx.Save("user2", "data 2")
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []Op{{Kind: OpBegin}, {Kind: OpGet, Key: "user1"}, {Kind: OpSave}}
+		if !slices.Equal(r.ops, expected) {
+			t.Errorf("expected the operations %v, but got: %v", expected, r.ops)
+		}
+		AssertState(t, fakeDB, State{"user1": "data 1", "user2": "data 2"})
+	})
+}
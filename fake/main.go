@@ -1,15 +1,26 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // A "fake" is a lightweight implementation of a real object that takes shortcuts to simplify its behaviour.
 
 // We define the Database interface and two structs: RealDatabase and FakeDatabase.
 
-// The RealDatabase simulates a real database implementation, where saving and retrieving data would typically involve interacting with an actual database. For simplicity, it just prints messages to indicate the operations.
+// The RealDatabase is a real database implementation: it stores the data in an embedded SQLite database through database/sql (see real.go).
 
-// The FakeDatabase is a lightweight implementation of the Database interface that uses an in-memory map to store key-value pairs.
-// It provides simplified implementations of the Save and Get methods.
+// The FakeDatabase is a lightweight implementation of the Database interface that uses in-memory maps to store key-value pairs.
+// It provides simplified implementations of the Save and Get methods, and it is safe to use from many goroutines at once.
 
 // The SaveUserData function takes a Database interface and userID and userData strings.
 // It calls the Save method of the provided database to store the user data.
@@ -18,77 +29,469 @@ import "fmt"
 // It calls the Get method of the provided database to retrieve the user data.
 
 // We demonstrate the usage of both the real database and the fake database.
-// When using the RealDatabase, it simulates saving and retrieving data from a real database.
+// When using the RealDatabase, it saves and retrieves data from a SQLite file.
 // When using the FakeDatabase, it stores and retrieves data using the in-memory map.
 
 // The purpose of the fake database in this example is to provide a lightweight implementation of the database that simplifies its behaviour.
-// Instead of relying on a real database, which might require setup, teardown, and external dependencies, we use an in-memory map to simulate the database operations.
+// Instead of relying on a real database, which requires setup, teardown, and external dependencies (a driver, a file, a schema), we use an in-memory map to simulate the database operations.
 // This allows us to test the behaviour of SaveUserData and GetUserData without the need for an actual database.
 
 // In real-world usage, you would typically use the RealDatabase (or any other concrete database implementation) to interact with an actual database.
 // The fake database is primarily used in testing or in situations where you want to simplify the database behaviour for testing or development purposes.
 
+// The Database interface covers the basic CRUD operations, ordered scans (see scan.go) and transactions (see tx.go).
+// Every operation takes a context and returns an error: a real database can fail at any time (lost connection, full disk, timeout),
+// and code using a Database has to be ready for that. The fake can be told to fail on purpose, to test exactly that code (see faults.go).
+
 type Database interface {
-	Save(key, value string)
-	Get(key string) (string, bool)
+	Save(ctx context.Context, key, value string) error
+	// Get returns the value of key and whether it exists.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Delete removes key and reports whether it was there.
+	Delete(ctx context.Context, key string) (bool, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	// Len returns the number of keys.
+	Len(ctx context.Context) (int, error)
+	// Scan returns one page of the keys selected by opts, in key order.
+	Scan(ctx context.Context, opts ScanOptions) (ScanPage, error)
+	// All iterates over every entry in key order; an error ends the iteration.
+	All(ctx context.Context) iter.Seq2[Entry, error]
+	// SaveWithTTL saves key like Save, but the key expires once ttl has passed (see ttl.go).
+	SaveWithTTL(ctx context.Context, key, value string, ttl time.Duration) error
+	// Begin starts a transaction (see tx.go).
+	Begin(ctx context.Context) (Tx, error)
+	// GetVersion returns the value of key and its version; a missing key has version 0 (see version.go).
+	GetVersion(ctx context.Context, key string) (string, uint64, error)
+	// CompareAndSwap saves key only if its version is still version, and returns the new version (see version.go).
+	CompareAndSwap(ctx context.Context, key string, version uint64, value string) (uint64, error)
+	// CompareAndDelete deletes key only if its version is still version (see version.go).
+	CompareAndDelete(ctx context.Context, key string, version uint64) error
+	// SaveMany saves every entry, or none of them; if a key appears twice, the last value wins (see batch.go).
+	SaveMany(ctx context.Context, entries []Entry) error
+	// GetMany returns the values of the keys that exist among keys (see batch.go).
+	GetMany(ctx context.Context, keys []string) (map[string]string, error)
 }
 
-type RealDatabase struct{}
+// defaultShards is the number of shards a FakeDatabase uses unless WithShards says otherwise.
+const defaultShards = 32
+
+// The FakeDatabase is safe for concurrent use.
+// Instead of one map behind one lock, the keys are spread over several shards, each a map with its own lock.
+// Goroutines working on keys in different shards never wait for each other, so the fake doesn't become the bottleneck in parallel tests and benchmarks.
+
+type FakeDatabase struct {
+	shards []*shard
+	// seq counts the writes; every write stamps the items it touches with the next value (see tx.go)
+	seq atomic.Uint64
+	// faults is the current fault plan (see faults.go)
+	faults atomic.Pointer[[]Fault]
+	// clock tells the time for key expiry, and janitor purges expired keys in the background (see ttl.go)
+	clock   Clock
+	janitor *janitor
+	// wal is the write-ahead log of a fake opened with OpenFakeDatabase, nil for an in-memory one (see wal.go)
+	wal *wal
+	// feed publishes the writes to the watchers, if WithChangeFeed turned it on (see watch.go)
+	feed *changeFeed
+	// indexes are the secondary indexes that WithIndex declared, nil if there are none (see index.go)
+	indexes *indexSet
+	// journal records the operations, if WithJournal turned it on (see journal.go)
+	journal *Journal
+	// evictor keeps the fake within its limits, nil if it has none (see evict.go)
+	evictor *evictor
+	// snapshots are the open snapshots, which keep the history of the shards (see snapshot.go)
+	snapshots snapshots
+}
 
-func (db *RealDatabase) Save(key, value string) {
-	// simulating saving data to a real database
-	fmt.Printf("saving data: key=%s, value=%s\n", key, value)
-	// in a real implementation, this would store the data in an actual database
+// shard is one independently locked part of the key space.
+type shard struct {
+	mu   sync.RWMutex
+	data map[string]item
+	// history holds the states the open snapshots still read, oldest first (see snapshot.go)
+	history map[string][]pastItem
 }
 
-func (db *RealDatabase) Get(key string) (string, bool) {
-	// simulating retrieving data from a real database
-	fmt.Printf("retrieving data: key=%s\n", key)
-	// in a real implementation, this would fetch the data from an actual database
-	// but for simplicity, we just return a value and true to indicate success
-	return "some user data", true
+// item is a stored value together with the seq of the write that stored it, and when it expires (zero for never).
+type item struct {
+	value     string
+	version   uint64
+	expiresAt time.Time
 }
 
-type FakeDatabase struct {
-	data map[string]string
+// fakeConfig collects the settings of a FakeDatabase before it is built.
+type fakeConfig struct {
+	shards         int
+	faults         []Fault
+	clock          Clock
+	expiryInterval time.Duration
+	// the durability settings only apply to OpenFakeDatabase
+	fsync            FsyncPolicy
+	fsyncInterval    time.Duration
+	snapshotInterval time.Duration
+	// the change feed is off unless feedHistory is positive
+	feedHistory    int
+	feedMaxPending int
+	indexes        []Index
+	journal        bool
+	// there are no limits unless maxEntries or maxBytes is positive
+	maxEntries     int
+	maxBytes       int64
+	evictionPolicy EvictionPolicy
+	onEvict        func(key, value string)
+}
+
+type FakeDatabaseOption func(*fakeConfig)
+
+// WithShards sets the number of shards; 1 gives a fake with a single global lock.
+func WithShards(n int) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.shards = max(n, 1)
+	}
+}
+
+func NewFakeDatabase(opts ...FakeDatabaseOption) *FakeDatabase {
+	return newFakeDatabase(newFakeConfig(opts))
+}
+
+func newFakeConfig(opts []FakeDatabaseOption) fakeConfig {
+	config := fakeConfig{shards: defaultShards, clock: systemClock{}}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+func newFakeDatabase(config fakeConfig) *FakeDatabase {
+	db := &FakeDatabase{shards: make([]*shard, config.shards), clock: config.clock}
+	for i := range db.shards {
+		db.shards[i] = &shard{data: make(map[string]item)}
+	}
+	db.InjectFaults(config.faults...)
+	if config.expiryInterval > 0 {
+		db.janitor = startJanitor(db, config.expiryInterval)
+	}
+	if config.feedHistory > 0 {
+		db.feed = newChangeFeed(config.feedHistory, config.feedMaxPending)
+	}
+	if len(config.indexes) > 0 {
+		db.indexes = newIndexSet(config.indexes)
+	}
+	if config.journal {
+		db.journal = &Journal{}
+	}
+	if config.maxEntries > 0 || config.maxBytes > 0 {
+		db.evictor = newEvictor(config)
+	}
+	return db
+}
+
+// shardFor returns the shard that owns key.
+func (db *FakeDatabase) shardFor(key string) *shard {
+	return db.shards[db.shardIndex(key)]
+}
+
+// shardIndex returns the position of the shard that owns key, using an inlined FNV-1a hash so that no allocation is needed.
+func (db *FakeDatabase) shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(db.shards)))
+}
+
+// Every operation of the fake starts with check: it gives up if the context is done,
+// and then asks the fault plan whether this operation should fail (see faults.go).
+
+func (db *FakeDatabase) Save(ctx context.Context, key, value string) error {
+	return db.save(ctx, key, value, time.Time{})
+}
+
+func (db *FakeDatabase) save(ctx context.Context, key, value string, expiresAt time.Time) error {
+	_, err := db.saveIf(ctx, key, value, expiresAt, anyVersion)
+	return err
+}
+
+// saveIf saves key if its version is expected (or for anyVersion, whatever it is), and returns the new version.
+func (db *FakeDatabase) saveIf(ctx context.Context, key, value string, expiresAt time.Time, expected uint64) (version uint64, err error) {
+	defer func() { db.record(Op{Kind: OpSave, Key: key}, value, fmt.Sprint("version ", version), err) }()
+	if err := db.check(ctx, Op{Kind: OpSave, Key: key}); err != nil {
+		return 0, err
+	}
+	// the eviction runs once the shard is unlocked, as it locks the shards of its victims
+	defer db.evict(key)
+	s := db.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expected != anyVersion {
+		if current := s.data[key].liveVersion(db.clock.Now()); current != expected {
+			return 0, versionConflict(key, expected, current)
+		}
+	}
+	version, err = db.stamp(func() []walOp {
+		return []walOp{{key: key, value: value, expiresAt: expiresAt}}
+	})
+	if err != nil {
+		return 0, err
+	}
+	db.retain(s, key, version)
+	s.data[key] = item{value: value, version: version, expiresAt: expiresAt}
+	return version, nil
+}
+
+// stamp gives a write the next version, and logs it (see wal.go) and publishes it to the watchers (see watch.go)
+// before the caller applies it. The caller holds the locks of the shards it writes; ops is only called when somebody needs the writes.
+// With a change feed, the version is taken under the feed's lock, so that the events are published in the order of their versions.
+// With indexes, the write is checked against the unique ones first, and the indexes are updated under their lock.
+// With limits, it is checked against them and accounted for, under the evictor's lock.
+func (db *FakeDatabase) stamp(ops func() []walOp) (uint64, error) {
+	if db.wal == nil && db.feed == nil && db.indexes == nil && db.evictor == nil {
+		return db.seq.Add(1), nil
+	}
+	r := walRecord{ops: ops()}
+	// a write that breaks a unique index fails before it takes a seq (see index.go)
+	updateIndexes := func() {}
+	if db.indexes != nil {
+		db.indexes.mu.Lock()
+		defer db.indexes.mu.Unlock()
+		var err error
+		if updateIndexes, err = db.indexes.prepare(r.ops, db.clock.Now()); err != nil {
+			return 0, err
+		}
+	}
+	// and so does a write that goes over the limits of the fake, if they reject writes (see evict.go)
+	if db.evictor != nil {
+		db.evictor.mu.Lock()
+		defer db.evictor.mu.Unlock()
+		if err := db.evictor.admit(r.ops); err != nil {
+			return 0, err
+		}
+	}
+	if db.feed != nil {
+		db.feed.mu.Lock()
+		defer db.feed.mu.Unlock()
+	}
+	r.seq = db.seq.Add(1)
+	if err := db.logWrite(r); err != nil {
+		return 0, err
+	}
+	if db.feed != nil {
+		db.feed.publish(r)
+	}
+	updateIndexes()
+	if db.evictor != nil {
+		db.evictor.apply(r.ops)
+	}
+	return r.seq, nil
 }
 
-func NewFakeDatabase() *FakeDatabase {
-	return &FakeDatabase{
-		data: make(map[string]string),
+func (db *FakeDatabase) Get(ctx context.Context, key string) (value string, exists bool, err error) {
+	defer func() { db.record(Op{Kind: OpGet, Key: key}, value, found(exists), err) }()
+	if err := db.check(ctx, Op{Kind: OpGet, Key: key}); err != nil {
+		return "", false, err
 	}
+	it, exists := db.live(key)
+	return it.value, exists, nil
 }
 
-func (db *FakeDatabase) Save(key, value string) {
-	db.data[key] = value
+func (db *FakeDatabase) Delete(ctx context.Context, key string) (bool, error) {
+	return db.deleteIf(ctx, key, anyVersion)
 }
 
-func (db *FakeDatabase) Get(key string) (string, bool) {
-	value, exists := db.data[key]
-	return value, exists
+// deleteIf deletes key if its version is expected, or whatever its version with anyVersion, and reports whether it was there.
+// An expected version of 0 deletes nothing.
+func (db *FakeDatabase) deleteIf(ctx context.Context, key string, expected uint64) (deleted bool, err error) {
+	defer func() { db.record(Op{Kind: OpDelete, Key: key}, "", found(deleted), err) }()
+	if err := db.check(ctx, Op{Kind: OpDelete, Key: key}); err != nil {
+		return false, err
+	}
+	s := db.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, exists := s.data[key]
+	now := db.clock.Now()
+	if expected != anyVersion {
+		if current := it.liveVersion(now); current != expected {
+			return false, versionConflict(key, expected, current)
+		}
+		if expected == 0 {
+			return false, nil
+		}
+	}
+	if !exists {
+		return false, nil
+	}
+	if it.expired(now) {
+		// the key is already missing: it is purged like a read would, with no version, event or log record of its own (see ttl.go)
+		db.retain(s, key, db.seq.Load()+1)
+		delete(s.data, key)
+		db.forget(key)
+		return false, nil
+	}
+	seq, err := db.stamp(func() []walOp { return []walOp{{deleted: true, key: key}} })
+	if err != nil {
+		return false, err
+	}
+	db.retain(s, key, seq)
+	delete(s.data, key)
+	return true, nil
 }
 
-func SaveUserData(db Database, userID, userData string) {
-	db.Save(userID, userData)
+func (db *FakeDatabase) Exists(ctx context.Context, key string) (exists bool, err error) {
+	defer func() { db.record(Op{Kind: OpExists, Key: key}, "", found(exists), err) }()
+	if err := db.check(ctx, Op{Kind: OpExists, Key: key}); err != nil {
+		return false, err
+	}
+	_, exists = db.live(key)
+	return exists, nil
+}
+
+func (db *FakeDatabase) Len(ctx context.Context) (n int, err error) {
+	defer func() { db.record(Op{Kind: OpLen}, "", fmt.Sprint(n), err) }()
+	if err := db.check(ctx, Op{Kind: OpLen}); err != nil {
+		return 0, err
+	}
+	now := db.clock.Now()
+	for _, s := range db.shards {
+		s.mu.RLock()
+		for _, it := range s.data {
+			if !it.expired(now) {
+				n++
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return n, nil
 }
 
-func GetUserData(db Database, userID string) (string, bool) {
-	return db.Get(userID)
+func SaveUserData(ctx context.Context, db Database, userID, userData string) error {
+	return db.Save(ctx, userID, userData)
+}
+
+func GetUserData(ctx context.Context, db Database, userID string) (string, bool, error) {
+	return db.Get(ctx, userID)
+}
+
+// DeleteUserData removes the data of a user and reports whether there was any.
+func DeleteUserData(ctx context.Context, db Database, userID string) (bool, error) {
+	return db.Delete(ctx, userID)
+}
+
+// ListUsers returns the IDs of all users with data, in order.
+func ListUsers(ctx context.Context, db Database) ([]string, error) {
+	var userIDs []string
+	for entry, err := range db.All(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, entry.Key)
+	}
+	return userIDs, nil
 }
 
 func main() {
+	// go run . <subcommand> runs one of the tools around the example instead
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s - %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	ctx := context.Background()
 	userID := "user123"
 	userData := "some user data"
 
-	// using a real database
-	realDB := &RealDatabase{}
-	SaveUserData(realDB, userID, userData)
-	data, exists := GetUserData(realDB, userID)
-	fmt.Printf("Real Database - User data for %s: %s (exists: %v)\n", userID, data, exists)
+	// using a real database, in a file that is removed at the end
+	dir, err := os.MkdirTemp("", "fake-example")
+	if err != nil {
+		fmt.Printf("Real Database - error creating a directory: %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	realDB, err := OpenRealDatabase(ctx, filepath.Join(dir, "users.db"))
+	if err != nil {
+		fmt.Printf("Real Database - error opening: %v\n", err)
+		return
+	}
+	defer realDB.Close()
+	if err := SaveUserData(ctx, realDB, userID, userData); err != nil {
+		fmt.Printf("Real Database - error saving user data: %v\n", err)
+	}
+	data, exists, err := GetUserData(ctx, realDB, userID)
+	fmt.Printf("Real Database - User data for %s: %s (exists: %v, error: %v)\n", userID, data, exists, err)
 
 	// using a fake database (! typically only used in the tests)
 	fakeDB := NewFakeDatabase()
-	SaveUserData(fakeDB, userID, userData)
-	data, exists = GetUserData(fakeDB, userID)
-	fmt.Printf("Fake Database - User data for %s: %s (exists: %v)\n", userID, data, exists)
+	if err := SaveUserData(ctx, fakeDB, userID, userData); err != nil {
+		fmt.Printf("Fake Database - error saving user data: %v\n", err)
+	}
+	data, exists, err = GetUserData(ctx, fakeDB, userID)
+	fmt.Printf("Fake Database - User data for %s: %s (exists: %v, error: %v)\n", userID, data, exists, err)
+	SaveUserData(ctx, fakeDB, "user456", "more user data")
+	users, _ := ListUsers(ctx, fakeDB)
+	fmt.Printf("Fake Database - Users: %v\n", users)
+	DeleteUserData(ctx, fakeDB, userID)
+	users, _ = ListUsers(ctx, fakeDB)
+	fmt.Printf("Fake Database - Users after deleting %s: %v\n", userID, users)
+
+	// the fake can also be told to fail, to show how the code copes with a failing database
+	fakeDB.InjectFaults(FailNthWrite(1))
+	if err := SaveUserData(ctx, fakeDB, userID, userData); err != nil {
+		fmt.Printf("Fake Database - error saving user data: %v\n", err)
+	}
+}
+
+// subcommands are the tools that come with the example.
+var subcommands = map[string]func(args []string) error{
+	// resp serves a fake to Redis clients (see resp.go)
+	"resp": runRESP,
+	// serve serves the user API over HTTP (see api.go)
+	"serve": runServe,
+	// export and import move the contents of a database in and out as files (see export.go)
+	"export": runExport,
+	"import": runImport,
+}
+
+// backendFlags are the flags of the subcommands that choose the database they work on.
+type backendFlags struct {
+	kind, data *string
+}
+
+// addBackendFlags adds -backend and -data to flags. With the fake backend, -data is the directory of a persistent fake,
+// and the data is in memory if it is empty; with the real one, it is the SQLite file.
+func addBackendFlags(flags *flag.FlagSet) backendFlags {
+	return backendFlags{
+		kind: flags.String("backend", "fake", "the database to use: fake or real"),
+		data: flags.String("data", "", "where the data is: a directory for the fake, in memory if empty; a file for the real database"),
+	}
+}
+
+// open opens the database chosen by the flags, and returns it with its name, for messages, and a function that closes it.
+func (b backendFlags) open(ctx context.Context) (Database, string, func() error, error) {
+	switch *b.kind {
+	case "fake":
+		if *b.data == "" {
+			fakeDB := NewFakeDatabase()
+			return fakeDB, "Fake Database", fakeDB.Close, nil
+		}
+		fakeDB, err := OpenFakeDatabase(*b.data)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return fakeDB, "Fake Database", fakeDB.Close, nil
+	case "real":
+		if *b.data == "" {
+			return nil, "", nil, errors.New("the real backend needs a -data file")
+		}
+		realDB, err := OpenRealDatabase(ctx, *b.data)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return realDB, "Real Database", realDB.Close, nil
+	default:
+		return nil, "", nil, fmt.Errorf("unknown backend %q: expected fake or real", *b.kind)
+	}
 }
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -11,14 +16,21 @@ import (
 // TestSaveUserData tests the SaveUserData function with both the real database and the fake database.
 
 func TestSaveUserData(t *testing.T) {
+	ctx := context.Background()
+
 	// "with real database":
-	// creates an instance of RealDatabase and passes it to SaveUserData.
-	// no assertions are needed here because the real database is used, and its behaviour is not being tested.
+	// opens a RealDatabase in a temporary file and passes it to SaveUserData.
+	// the real database runs in-process, so the same assertions as for the fake can be made against it.
 	t.Run("with real database", func(t *testing.T) {
-		realDB := &RealDatabase{}
+		realDB := openRealDatabase(t)
 		userID := "user123"
 		userData := "some user data"
-		SaveUserData(realDB, userID, userData)
+		if err := SaveUserData(ctx, realDB, userID, userData); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if retrievedData, exists, err := GetUserData(ctx, realDB, userID); err != nil || !exists || retrievedData != userData {
+			t.Errorf("expected user data: %s, but got: %s (exists: %v, error: %v)", userData, retrievedData, exists, err)
+		}
 	})
 
 	// "with fake database":
@@ -28,8 +40,13 @@ func TestSaveUserData(t *testing.T) {
 		fakeDB := NewFakeDatabase()
 		userID := "user123"
 		userData := "some user data"
-		SaveUserData(fakeDB, userID, userData)
-		retrievedData, exists := GetUserData(fakeDB, userID)
+		if err := SaveUserData(ctx, fakeDB, userID, userData); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		retrievedData, exists, err := GetUserData(ctx, fakeDB, userID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
 		if !exists {
 			t.Errorf("expected user data to exist for user %s", userID)
 		}
@@ -38,3 +55,100 @@ func TestSaveUserData(t *testing.T) {
 		}
 	})
 }
+
+// TestFakeDatabaseConcurrency saves and reads user data from many goroutines at once.
+// Run it with -race: any unsynchronised access to the fake's maps is reported by the race detector.
+
+func TestFakeDatabaseConcurrency(t *testing.T) {
+	ctx := context.Background()
+	for _, shards := range []int{1, defaultShards} {
+		t.Run(fmt.Sprintf("with %d shards", shards), func(t *testing.T) {
+			fakeDB := NewFakeDatabase(WithShards(shards))
+			const goroutines, usersPerGoroutine = 16, 100
+
+			var wg sync.WaitGroup
+			for g := range goroutines {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range usersPerGoroutine {
+						userID := fmt.Sprintf("user%d-%d", g, i)
+						SaveUserData(ctx, fakeDB, userID, "data for "+userID)
+						// everybody also reads and overwrites one shared key
+						GetUserData(ctx, fakeDB, "shared")
+						SaveUserData(ctx, fakeDB, "shared", userID)
+					}
+				}()
+			}
+			wg.Wait()
+
+			for g := range goroutines {
+				for i := range usersPerGoroutine {
+					userID := fmt.Sprintf("user%d-%d", g, i)
+					retrievedData, exists, _ := GetUserData(ctx, fakeDB, userID)
+					if !exists || retrievedData != "data for "+userID {
+						t.Errorf("expected user data: %s, but got: %s (exists: %v)", "data for "+userID, retrievedData, exists)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFakeDatabaseParallel compares a single-lock fake with the sharded one under parallel load:
+//
+//	go test -bench FakeDatabaseParallel -cpu 1,4,16
+
+func BenchmarkFakeDatabaseParallel(b *testing.B) {
+	ctx := context.Background()
+	for _, shards := range []int{1, defaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			fakeDB := NewFakeDatabase(WithShards(shards))
+			userIDs := make([]string, 1024)
+			for i := range userIDs {
+				userIDs[i] = fmt.Sprintf("user%d", i)
+			}
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(1)) * 7
+				for pb.Next() {
+					userID := userIDs[i%len(userIDs)]
+					SaveUserData(ctx, fakeDB, userID, "some user data")
+					GetUserData(ctx, fakeDB, userID)
+					i++
+				}
+			})
+		})
+	}
+}
+
+// TestDeleteUserData tests the CRUD helpers on top of the fake database: saving, listing and deleting users.
+
+func TestDeleteUserData(t *testing.T) {
+	ctx := context.Background()
+	fakeDB := NewFakeDatabase()
+	SaveUserData(ctx, fakeDB, "user2", "data 2")
+	SaveUserData(ctx, fakeDB, "user1", "data 1")
+	SaveUserData(ctx, fakeDB, "user3", "data 3")
+
+	if users, _ := ListUsers(ctx, fakeDB); !slices.Equal(users, []string{"user1", "user2", "user3"}) {
+		t.Errorf("expected users [user1 user2 user3], but got: %v", users)
+	}
+
+	if deleted, _ := DeleteUserData(ctx, fakeDB, "user2"); !deleted {
+		t.Errorf("expected user2 to be deleted")
+	}
+	if deleted, _ := DeleteUserData(ctx, fakeDB, "user2"); deleted {
+		t.Errorf("expected the second delete of user2 to report nothing was deleted")
+	}
+	if exists, _ := fakeDB.Exists(ctx, "user2"); exists {
+		t.Errorf("expected user2 to be gone")
+	}
+	if n, _ := fakeDB.Len(ctx); n != 2 {
+		t.Errorf("expected 2 users left, but got: %d", n)
+	}
+	if users, _ := ListUsers(ctx, fakeDB); !slices.Equal(users, []string{"user1", "user3"}) {
+		t.Errorf("expected users [user1 user3], but got: %v", users)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// ----------------------------------------------------------------------------
+// The real database: SQLite through database/sql.
+// ----------------------------------------------------------------------------
+
+// The RealDatabase stores the keys in a single SQLite table. The driver (modernc.org/sqlite) is written in pure Go,
+// so the real database runs in-process against a file, with no server to install and no cgo:
+//
+//	realDB, err := OpenRealDatabase(ctx, filepath.Join(t.TempDir(), "users.db"))
+//	if err != nil { ... }
+//	defer realDB.Close()
+//
+// That makes it cheap to run the same code, and the same tests, against the real implementation and the fake one.
+
+// The connection string turns on:
+//   - the WAL journal, so that readers don't block the writer and the writer doesn't block readers;
+//   - a busy timeout, so that a connection waits for the write lock instead of failing right away with SQLITE_BUSY;
+//   - immediate transactions, so that a transaction takes the write lock when it begins. SQLite has a single writer,
+//     and a transaction that only tried to take the lock at its first write could fail half-way instead of waiting.
+//
+// Because of that last point, transactions on the real database are serialised: they wait for each other,
+// where the fake lets them run side by side and fails the loser of a conflict with ErrTxConflict.
+
+const (
+	realBusyTimeout = 5 * time.Second
+	// SQLite has one writer at a time, so more connections only help readers
+	realMaxOpenConns    = 8
+	realConnMaxIdleTime = 5 * time.Minute
+)
+
+// realSchema is the table of the keys. A key that never expires has a NULL expires_at (unix nanoseconds otherwise);
+// an expired row is left alone until something overwrites it or PurgeExpired removes it, and every query ignores it.
+// version counts the writes to each key (see version.go). So that it never goes back, Delete doesn't remove the row:
+// it empties it and makes it expire at time 0, and the next save carries on counting. When PurgeExpired does remove rows,
+// kv_purged keeps the highest version they had, and a key saved afresh starts counting above it.
+const realSchema = `
+CREATE TABLE IF NOT EXISTS kv (
+	key        TEXT PRIMARY KEY,
+	value      BLOB NOT NULL,
+	version    INTEGER NOT NULL,
+	expires_at INTEGER
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS kv_purged (
+	id      INTEGER PRIMARY KEY CHECK (id = 0),
+	version INTEGER NOT NULL
+);
+INSERT OR IGNORE INTO kv_purged (id, version) VALUES (0, 0)`
+
+// realFirstVersion is the version of a key saved afresh
+const realFirstVersion = `(SELECT version + 1 FROM kv_purged)`
+
+// the queries that are prepared once, when the database is opened;
+// the reads take the current time as a parameter, to leave expired rows out
+const (
+	realSaveQuery = `
+INSERT INTO kv (key, value, version, expires_at) VALUES (?1, ?2, ` + realFirstVersion + `, ?3)
+ON CONFLICT (key) DO UPDATE SET value = excluded.value, version = kv.version + 1, expires_at = excluded.expires_at`
+	realGetQuery    = `SELECT value FROM kv WHERE key = ?1 AND (expires_at IS NULL OR expires_at > ?2)`
+	realExistsQuery = `SELECT EXISTS (SELECT 1 FROM kv WHERE key = ?1 AND (expires_at IS NULL OR expires_at > ?2))`
+	realDeleteQuery = `
+UPDATE kv SET value = x'', expires_at = 0
+WHERE key = ?1 AND (expires_at IS NULL OR expires_at > ?2) RETURNING 1`
+	realLenQuery        = `SELECT count(*) FROM kv WHERE expires_at IS NULL OR expires_at > ?1`
+	realGetVersionQuery = `SELECT value, version FROM kv WHERE key = ?1 AND (expires_at IS NULL OR expires_at > ?2)`
+	// creates the key if it is missing or expired; otherwise the conflict clause changes nothing and no version is returned
+	realCreateQuery = `
+INSERT INTO kv (key, value, version, expires_at) VALUES (?1, ?2, ` + realFirstVersion + `, NULL)
+ON CONFLICT (key) DO UPDATE SET value = excluded.value, version = kv.version + 1, expires_at = NULL
+WHERE kv.expires_at IS NOT NULL AND kv.expires_at <= ?3
+RETURNING version`
+	realSwapQuery = `
+UPDATE kv SET value = ?2, version = version + 1, expires_at = NULL
+WHERE key = ?1 AND version = ?3 AND (expires_at IS NULL OR expires_at > ?4)
+RETURNING version`
+	realCompareDeleteQuery = `
+UPDATE kv SET value = x'', expires_at = 0
+WHERE key = ?1 AND version = ?2 AND (expires_at IS NULL OR expires_at > ?3) RETURNING 1`
+	// keys >= ?1, > ?3 if ?2, < ?5 if ?4
+	realScanQuery = `
+SELECT key, value FROM kv
+WHERE key >= ?1 AND (NOT ?2 OR key > ?3) AND (NOT ?4 OR key < ?5) AND (expires_at IS NULL OR expires_at > ?6)
+ORDER BY key LIMIT ?7`
+	// run in one transaction, before and after each other
+	realPurgedVersionQuery = `
+UPDATE kv_purged SET version = max(version, (SELECT coalesce(max(version), 0) FROM kv WHERE expires_at <= ?1))`
+	realPurgeQuery = `DELETE FROM kv WHERE expires_at <= ?1`
+)
+
+type RealDatabase struct {
+	db *sql.DB
+	// clock tells the time for key expiry; tests can replace it (see ttl.go)
+	clock Clock
+
+	save, get, exists, delete, len, scan    *sql.Stmt
+	getVersion, create, swap, compareDelete *sql.Stmt
+	// saveMany and getMany handle realBatchSize keys (see batch.go)
+	saveMany, getMany *sql.Stmt
+}
+
+// OpenRealDatabase opens the SQLite database at path, creating the file and the table if needed.
+func OpenRealDatabase(ctx context.Context, path string) (*RealDatabase, error) {
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", realBusyTimeout.Milliseconds()))
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Add("_txlock", "immediate")
+	// SQLite decodes the path of a file: URI, so a ? or # in it is escaped rather than taken for the query or the fragment
+	dsn := url.URL{Scheme: "file", Opaque: (&url.URL{Path: path}).EscapedPath(), RawQuery: params.Encode()}
+	sqlDB, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("opening real database: %w", err)
+	}
+	sqlDB.SetMaxOpenConns(realMaxOpenConns)
+	sqlDB.SetMaxIdleConns(realMaxOpenConns)
+	sqlDB.SetConnMaxIdleTime(realConnMaxIdleTime)
+
+	db := &RealDatabase{db: sqlDB, clock: systemClock{}}
+	if err := db.init(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening real database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+func (db *RealDatabase) init(ctx context.Context) error {
+	if _, err := db.db.ExecContext(ctx, realSchema); err != nil {
+		return err
+	}
+	for _, stmt := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&db.save, realSaveQuery},
+		{&db.get, realGetQuery},
+		{&db.exists, realExistsQuery},
+		{&db.delete, realDeleteQuery},
+		{&db.len, realLenQuery},
+		{&db.scan, realScanQuery},
+		{&db.getVersion, realGetVersionQuery},
+		{&db.create, realCreateQuery},
+		{&db.swap, realSwapQuery},
+		{&db.compareDelete, realCompareDeleteQuery},
+		{&db.saveMany, realSaveManyQuery(realBatchSize)},
+		{&db.getMany, realGetManyQuery(realBatchSize)},
+	} {
+		prepared, err := db.db.PrepareContext(ctx, stmt.query)
+		if err != nil {
+			return err
+		}
+		*stmt.stmt = prepared
+	}
+	return nil
+}
+
+// Close removes the expired and deleted rows, then closes the prepared statements and the connections.
+func (db *RealDatabase) Close() error {
+	var errs []error
+	// the tables exist once init has prepared the statements, which a failed open may not have done
+	if db.save != nil {
+		_, err := db.PurgeExpired(context.Background())
+		errs = append(errs, err)
+	}
+	for _, stmt := range []*sql.Stmt{db.save, db.get, db.exists, db.delete, db.len, db.scan, db.getVersion, db.create, db.swap, db.compareDelete, db.saveMany, db.getMany} {
+		if stmt != nil {
+			errs = append(errs, stmt.Close())
+		}
+	}
+	errs = append(errs, db.db.Close())
+	return errors.Join(errs...)
+}
+
+// PurgeExpired removes the rows of the expired and deleted keys now and returns how many there were.
+// Queries already ignore them, so this only gives the space back; Close does it too.
+func (db *RealDatabase) PurgeExpired(ctx context.Context) (int, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("purging expired keys: %w", err)
+	}
+	defer tx.Rollback()
+	now := db.now()
+	if _, err := tx.ExecContext(ctx, realPurgedVersionQuery, now); err != nil {
+		return 0, fmt.Errorf("purging expired keys: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, realPurgeQuery, now)
+	if err != nil {
+		return 0, fmt.Errorf("purging expired keys: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("purging expired keys: %w", err)
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// now is the current time as stored in expires_at.
+func (db *RealDatabase) now() int64 {
+	return db.clock.Now().UnixNano()
+}
+
+// expiresAt is the expires_at of a key saved now with ttl, or NULL for a ttl of 0 (never).
+func (db *RealDatabase) expiresAt(ttl time.Duration) sql.NullInt64 {
+	if ttl == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: db.clock.Now().Add(ttl).UnixNano(), Valid: true}
+}
+
+// The statements run either on the database or inside a transaction (see realTx);
+// stmtFunc picks the one or the other, so that every operation is written once.
+
+type stmtFunc func(stmt *sql.Stmt) *sql.Stmt
+
+func direct(stmt *sql.Stmt) *sql.Stmt {
+	return stmt
+}
+
+func (db *RealDatabase) Save(ctx context.Context, key, value string) error {
+	return db.saveWith(ctx, direct, key, value, 0)
+}
+
+func (db *RealDatabase) SaveWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("saving %q: %w", key, ErrInvalidTTL)
+	}
+	return db.saveWith(ctx, direct, key, value, ttl)
+}
+
+func (db *RealDatabase) saveWith(ctx context.Context, stmt stmtFunc, key, value string, ttl time.Duration) error {
+	if _, err := stmt(db.save).ExecContext(ctx, key, []byte(value), db.expiresAt(ttl)); err != nil {
+		return fmt.Errorf("saving %q: %w", key, err)
+	}
+	return nil
+}
+
+func (db *RealDatabase) Get(ctx context.Context, key string) (string, bool, error) {
+	return db.getWith(ctx, direct, key)
+}
+
+func (db *RealDatabase) getWith(ctx context.Context, stmt stmtFunc, key string) (string, bool, error) {
+	var value []byte
+	err := stmt(db.get).QueryRowContext(ctx, key, db.now()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("getting %q: %w", key, err)
+	}
+	return string(value), true, nil
+}
+
+func (db *RealDatabase) Delete(ctx context.Context, key string) (bool, error) {
+	return db.deleteWith(ctx, direct, key)
+}
+
+func (db *RealDatabase) deleteWith(ctx context.Context, stmt stmtFunc, key string) (bool, error) {
+	var live bool
+	err := stmt(db.delete).QueryRowContext(ctx, key, db.now()).Scan(&live)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("deleting %q: %w", key, err)
+	}
+	return live, nil
+}
+
+func (db *RealDatabase) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	if err := db.exists.QueryRowContext(ctx, key, db.now()).Scan(&exists); err != nil {
+		return false, fmt.Errorf("checking %q: %w", key, err)
+	}
+	return exists, nil
+}
+
+func (db *RealDatabase) Len(ctx context.Context) (int, error) {
+	var n int
+	if err := db.len.QueryRowContext(ctx, db.now()).Scan(&n); err != nil {
+		return 0, fmt.Errorf("counting keys: %w", err)
+	}
+	return n, nil
+}
+
+// Scan turns the prefix, the range and the cursor into bounds on the primary key, so that SQLite reads just the page.
+// It asks for one entry more than the limit to know whether there is a next page.
+func (db *RealDatabase) Scan(ctx context.Context, opts ScanOptions) (ScanPage, error) {
+	after, hasAfter, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	lower := max(opts.Start, opts.Prefix)
+	upper, hasUpper := opts.End, opts.End != ""
+	if end, ok := prefixEnd(opts.Prefix); ok && (!hasUpper || end < upper) {
+		upper, hasUpper = end, true
+	}
+
+	rows, err := db.scan.QueryContext(ctx, lower, hasAfter, after, hasUpper, upper, db.now(), opts.limit()+1)
+	if err != nil {
+		return ScanPage{}, fmt.Errorf("scanning: %w", err)
+	}
+	defer rows.Close()
+	var page ScanPage
+	for rows.Next() {
+		var entry Entry
+		var value []byte
+		if err := rows.Scan(&entry.Key, &value); err != nil {
+			return ScanPage{}, fmt.Errorf("scanning: %w", err)
+		}
+		entry.Value = string(value)
+		page.Entries = append(page.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return ScanPage{}, fmt.Errorf("scanning: %w", err)
+	}
+	if len(page.Entries) > opts.limit() {
+		page.Entries = page.Entries[:opts.limit()]
+		page.Cursor = encodeCursor(page.Entries[len(page.Entries)-1].Key)
+	}
+	return page, nil
+}
+
+// prefixEnd returns the smallest key after all the keys starting with prefix,
+// and false if there is none: for the empty prefix, or a prefix made only of 0xff bytes.
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// All pages through the table with Scan, so that no connection is held while the loop body runs:
+// the body may write to the database, which would otherwise wait for the open query.
+func (db *RealDatabase) All(ctx context.Context) iter.Seq2[Entry, error] {
+	return Entries(ctx, db, ScanOptions{})
+}
+
+// realTx is a transaction of the real database. Its reads and writes run the same prepared statements, bound to the sql.Tx.
+type realTx struct {
+	ctx context.Context
+	db  *RealDatabase
+	tx  *sql.Tx
+}
+
+func (db *RealDatabase) Begin(ctx context.Context) (Tx, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	return &realTx{ctx: ctx, db: db, tx: tx}, nil
+}
+
+func (tx *realTx) stmt(stmt *sql.Stmt) *sql.Stmt {
+	return tx.tx.StmtContext(tx.ctx, stmt)
+}
+
+func (tx *realTx) Get(key string) (string, bool, error) {
+	value, exists, err := tx.db.getWith(tx.ctx, tx.stmt, key)
+	return value, exists, txErr(err)
+}
+
+func (tx *realTx) Save(key, value string) error {
+	return txErr(tx.db.saveWith(tx.ctx, tx.stmt, key, value, 0))
+}
+
+func (tx *realTx) Delete(key string) (bool, error) {
+	existed, err := tx.db.deleteWith(tx.ctx, tx.stmt, key)
+	return existed, txErr(err)
+}
+
+func (tx *realTx) Commit() error {
+	return txErr(tx.tx.Commit())
+}
+
+func (tx *realTx) Rollback() error {
+	return txErr(tx.tx.Rollback())
+}
+
+// txErr reports the sql package's error for a finished transaction as ErrTxDone, like the fake does.
+func txErr(err error) error {
+	if errors.Is(err, sql.ErrTxDone) {
+		return fmt.Errorf("%w: %w", ErrTxDone, err)
+	}
+	return err
+}
+
+func (db *RealDatabase) GetVersion(ctx context.Context, key string) (string, uint64, error) {
+	var value []byte
+	var version uint64
+	err := db.getVersion.QueryRowContext(ctx, key, db.now()).Scan(&value, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("getting %q: %w", key, err)
+	}
+	return string(value), version, nil
+}
+
+// CompareAndSwap runs a single conditional statement, so the check and the write are atomic without a transaction.
+// When no row comes back, the condition failed; the current version is read again only to explain the conflict.
+func (db *RealDatabase) CompareAndSwap(ctx context.Context, key string, version uint64, value string) (uint64, error) {
+	var row *sql.Row
+	if version == 0 {
+		row = db.create.QueryRowContext(ctx, key, []byte(value), db.now())
+	} else {
+		row = db.swap.QueryRowContext(ctx, key, []byte(value), version, db.now())
+	}
+	var newVersion uint64
+	err := row.Scan(&newVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, current, err := db.GetVersion(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		return 0, versionConflict(key, version, current)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("saving %q: %w", key, err)
+	}
+	return newVersion, nil
+}
+
+// CompareAndDelete empties the row in a single conditional statement, like Delete. Version 0 deletes nothing,
+// so it only needs the current version, which is also what explains a conflict.
+func (db *RealDatabase) CompareAndDelete(ctx context.Context, key string, version uint64) error {
+	if version != 0 {
+		var deleted bool
+		err := db.compareDelete.QueryRowContext(ctx, key, version, db.now()).Scan(&deleted)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("deleting %q: %w", key, err)
+		}
+	}
+	_, current, err := db.GetVersion(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current != version {
+		return versionConflict(key, version, current)
+	}
+	return nil
+}
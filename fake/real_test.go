@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// The SQLite-backed real database.
+// ----------------------------------------------------------------------------
+
+// openRealDatabase opens a real database in a temporary file that is removed with the test.
+func openRealDatabase(t testing.TB) *RealDatabase {
+	t.Helper()
+	realDB, err := OpenRealDatabase(context.Background(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { realDB.Close() })
+	return realDB
+}
+
+func TestRealDatabase(t *testing.T) {
+	ctx := context.Background()
+
+	// "crud":
+	// Save is an upsert, and Delete, Exists and Len see the rows.
+	t.Run("crud", func(t *testing.T) {
+		realDB := openRealDatabase(t)
+		SaveUserData(ctx, realDB, "user1", "data 1")
+		SaveUserData(ctx, realDB, "user1", "new data 1")
+		SaveUserData(ctx, realDB, "user2", "")
+		if data, _, _ := GetUserData(ctx, realDB, "user1"); data != "new data 1" {
+			t.Errorf("expected user data: new data 1, but got: %s", data)
+		}
+		if data, exists, _ := GetUserData(ctx, realDB, "user2"); !exists || data != "" {
+			t.Errorf("expected an empty value to exist, but got: %q (exists: %v)", data, exists)
+		}
+		if _, exists, _ := GetUserData(ctx, realDB, "user3"); exists {
+			t.Errorf("expected user3 not to exist")
+		}
+		var version int
+		realDB.db.QueryRowContext(ctx, "SELECT version FROM kv WHERE key = 'user1'").Scan(&version)
+		if version != 2 {
+			t.Errorf("expected version 2 after two saves, but got: %d", version)
+		}
+		if n, _ := realDB.Len(ctx); n != 2 {
+			t.Errorf("expected 2 users, but got: %d", n)
+		}
+		if deleted, _ := DeleteUserData(ctx, realDB, "user1"); !deleted {
+			t.Errorf("expected user1 to be deleted")
+		}
+		if deleted, _ := DeleteUserData(ctx, realDB, "user1"); deleted {
+			t.Errorf("expected the second delete of user1 to report nothing was deleted")
+		}
+		if exists, _ := realDB.Exists(ctx, "user1"); exists {
+			t.Errorf("expected user1 to be gone")
+		}
+	})
+
+	// "persistent":
+	// the data is in the file, so it is still there after reopening it.
+	t.Run("persistent", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		realDB, err := OpenRealDatabase(ctx, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		SaveUserData(ctx, realDB, "user1", "data 1")
+		realDB.Close()
+
+		realDB, err = OpenRealDatabase(ctx, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer realDB.Close()
+		if data, _, _ := GetUserData(ctx, realDB, "user1"); data != "data 1" {
+			t.Errorf("expected user data: data 1, but got: %s", data)
+		}
+	})
+
+	// "odd path":
+	// a ? or # in the path is part of the file name, not the start of the connection parameters.
+	t.Run("odd path", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users?mode=ro#1 %41.db")
+		realDB, err := OpenRealDatabase(ctx, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer realDB.Close()
+		if err := SaveUserData(ctx, realDB, "user1", "data 1"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected the database in %s, but got: %v", path, err)
+		}
+	})
+
+	// "purge":
+	// PurgeExpired and Close remove the rows of deleted and expired keys,
+	// and a key saved again after its row is gone still gets a version it never had.
+	t.Run("purge", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		realDB, err := OpenRealDatabase(ctx, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		clock := NewManualClock(time.Now())
+		realDB.clock = clock
+		rows := func() (n int) {
+			realDB.db.QueryRowContext(ctx, "SELECT count(*) FROM kv").Scan(&n)
+			return n
+		}
+		SaveUserData(ctx, realDB, "user1", "data 1")
+		SaveUserData(ctx, realDB, "user1", "data 1")
+		_, before, _ := realDB.GetVersion(ctx, "user1")
+		DeleteUserData(ctx, realDB, "user1")
+		SaveUserDataWithTTL(ctx, realDB, "session", "token", time.Minute)
+		SaveUserData(ctx, realDB, "user2", "data 2")
+		clock.Advance(time.Minute)
+		if n, err := realDB.PurgeExpired(ctx); n != 2 || err != nil {
+			t.Errorf("expected 2 keys purged, but got: %d, %v", n, err)
+		}
+		if n := rows(); n != 1 {
+			t.Errorf("expected 1 row left, but got: %d", n)
+		}
+		SaveUserData(ctx, realDB, "user1", "data 1")
+		if _, after, _ := realDB.GetVersion(ctx, "user1"); after <= before {
+			t.Errorf("expected a version above %d, but got: %d", before, after)
+		}
+
+		DeleteUserData(ctx, realDB, "user1")
+		realDB.Close()
+		realDB, err = OpenRealDatabase(ctx, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer realDB.Close()
+		if n := rows(); n != 1 {
+			t.Errorf("expected 1 row left after closing, but got: %d", n)
+		}
+	})
+
+	// "scan":
+	// prefixes, ranges and cursors select the same keys as on the fake, including keys with 0xff bytes.
+	t.Run("scan", func(t *testing.T) {
+		realDB := openRealDatabase(t)
+		fakeDB := NewFakeDatabase()
+		for _, key := range []string{"user:03", "user:01", "admin:01", "user:02", "user:10", "", "zebra", "user\xff", "user\xff\xff1", "usf"} {
+			realDB.Save(ctx, key, "value of "+key)
+			fakeDB.Save(ctx, key, "value of "+key)
+		}
+		for _, opts := range []ScanOptions{
+			{},
+			{Prefix: "user"},
+			{Prefix: "user\xff"},
+			{Prefix: "user:", Start: "user:02"},
+			{Start: "user:02", End: "user:10"},
+			{Prefix: "user", End: "user:03", Limit: 1},
+		} {
+			var realKeys, fakeKeys []string
+			for entry, err := range Entries(ctx, realDB, opts) {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				realKeys = append(realKeys, entry.Key)
+			}
+			for entry := range Entries(ctx, fakeDB, opts) {
+				fakeKeys = append(fakeKeys, entry.Key)
+			}
+			if !slices.Equal(realKeys, fakeKeys) {
+				t.Errorf("%+v: expected keys %q, but got: %q", opts, fakeKeys, realKeys)
+			}
+		}
+	})
+
+	// "ttl":
+	// expired rows are invisible to every query.
+	t.Run("ttl", func(t *testing.T) {
+		realDB := openRealDatabase(t)
+		clock := NewManualClock(time.Now())
+		realDB.clock = clock
+		SaveUserDataWithTTL(ctx, realDB, "session", "token", time.Minute)
+		if err := realDB.SaveWithTTL(ctx, "session", "token", 0); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("expected ErrInvalidTTL, but got: %v", err)
+		}
+		clock.Advance(time.Minute)
+		if exists, _ := realDB.Exists(ctx, "session"); exists {
+			t.Errorf("expected the session to have expired")
+		}
+		if n, _ := realDB.Len(ctx); n != 0 {
+			t.Errorf("expected no keys, but got: %d", n)
+		}
+		if deleted, _ := realDB.Delete(ctx, "session"); deleted {
+			t.Errorf("expected deleting an expired key to report nothing was deleted")
+		}
+	})
+
+	// "transactions":
+	// commits are all-or-nothing, and using a finished transaction is ErrTxDone.
+	t.Run("transactions", func(t *testing.T) {
+		realDB := openRealDatabase(t)
+		if err := SaveUserRecords(ctx, realDB, map[string]string{"user1": "data 1", "user2": "data 2"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		errInvalid := errors.New("invalid user")
+		err := WithTx(ctx, realDB, func(tx Tx) error {
+			tx.Delete("user1")
+			tx.Save("user3", "data 3")
+			if _, exists, _ := tx.Get("user1"); exists {
+				t.Errorf("expected the transaction to see its own delete")
+			}
+			return errInvalid
+		})
+		if !errors.Is(err, errInvalid) {
+			t.Errorf("expected the function's error, but got: %v", err)
+		}
+		if users, _ := ListUsers(ctx, realDB); !slices.Equal(users, []string{"user1", "user2"}) {
+			t.Errorf("expected users [user1 user2], but got: %v", users)
+		}
+
+		tx, _ := realDB.Begin(ctx)
+		tx.Commit()
+		if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+			t.Errorf("expected ErrTxDone for a second commit, but got: %v", err)
+		}
+	})
+
+	// "concurrent transactions":
+	// transactions wait for the write lock instead of failing, so concurrent increments are never lost.
+	t.Run("concurrent transactions", func(t *testing.T) {
+		realDB := openRealDatabase(t)
+		SaveUserData(ctx, realDB, "counter", "0")
+		const goroutines, increments = 4, 20
+		var wg sync.WaitGroup
+		for range goroutines {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range increments {
+					err := WithTx(ctx, realDB, func(tx Tx) error {
+						value, _, err := tx.Get("counter")
+						if err != nil {
+							return err
+						}
+						n, _ := strconv.Atoi(value)
+						return tx.Save("counter", strconv.Itoa(n+1))
+					})
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if data, _, _ := GetUserData(ctx, realDB, "counter"); data != strconv.Itoa(goroutines*increments) {
+			t.Errorf("expected counter %d, but got: %s", goroutines*increments, data)
+		}
+	})
+
+	// "context":
+	// a cancelled context stops the queries.
+	t.Run("context", func(t *testing.T) {
+		realDB := openRealDatabase(t)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := realDB.Save(cancelled, "user1", "data"); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, but got: %v", err)
+		}
+	})
+}
+
+// BenchmarkRealDatabase measures saves and reads on the real database, to compare with BenchmarkFakeDatabaseParallel.
+func BenchmarkRealDatabase(b *testing.B) {
+	ctx := context.Background()
+	realDB := openRealDatabase(b)
+	b.ResetTimer()
+	for i := range b.N {
+		userID := fmt.Sprintf("user%d", i%1024)
+		SaveUserData(ctx, realDB, userID, "some user data")
+		GetUserData(ctx, realDB, userID)
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// A Redis-protocol (RESP) front-end for the fake.
+// ----------------------------------------------------------------------------
+
+// Services written in other languages can't call the fake, but most of them can talk to Redis.
+// ServeRESP serves a fake over TCP with a subset of the Redis protocol, so that any Redis client can use it as a local stand-in:
+//
+//	server, err := ServeRESP(fakeDB, "127.0.0.1:0") // an ephemeral port, for a test
+//	...
+//	defer server.Close()
+//	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+//
+// Or as a standalone server, with the data kept in a directory if -data is given:
+//
+//	go run . resp -addr :6379 -data ./data
+//
+// The commands are GET, SET (with EX or PX), DEL, EXISTS, KEYS, EXPIRE, TTL and PING. Redis clients send them as RESP arrays;
+// the server also takes inline commands, one per line, so that it can be tried with telnet.
+// Errors of the fake, like the injected faults, are returned as Redis errors, and the connection goes on.
+
+// Like the fake, the server takes shortcuts: KEYS scans every key, and a client that breaks the protocol is simply disconnected.
+
+const (
+	// maxBulkSize is the largest argument the server reads, maxArgs the most arguments of one command
+	maxBulkSize = 64 << 20
+	maxArgs     = 1 << 20
+)
+
+// errProtocol ends a connection that doesn't speak RESP.
+var errProtocol = errors.New("protocol error")
+
+// RESPServer serves a fake over the Redis protocol until it is closed.
+type RESPServer struct {
+	db       *FakeDatabase
+	listener net.Listener
+	// ctx is canceled by Close, for the commands in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// ServeRESP listens on addr and serves db in the background. An addr like "127.0.0.1:0" picks a free port; Addr returns it.
+func ServeRESP(db *FakeDatabase, addr string) (*RESPServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("serving RESP: %w", err)
+	}
+	s := &RESPServer{db: db, listener: listener, conns: make(map[net.Conn]struct{})}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *RESPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server, disconnects the clients and waits for their commands to finish. It doesn't close the fake.
+func (s *RESPServer) Close() error {
+	err := s.listener.Close()
+	s.cancel()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *RESPServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return // closed
+		}
+		s.mu.Lock()
+		if s.conns == nil {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// serve runs the commands of one client, in order. The replies are flushed when no more commands are waiting, so pipelines are cheap.
+func (s *RESPServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	w := &respWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if errors.Is(err, errProtocol) {
+			w.writeError("ERR " + err.Error())
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) > 0 {
+			s.run(w, args)
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads a command sent as a RESP array of bulk strings, or as an inline line of words.
+// It returns no arguments for an empty line.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length %q", errProtocol, line[1:])
+	}
+	args := make([]string, 0, max(n, 0))
+	for range n {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', but got: %q", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, fmt.Errorf("%w: invalid bulk length %q", errProtocol, line[1:])
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line ending in CRLF, or in a bare LF as telnet may send, without the line ending.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxBulkSize {
+			return "", fmt.Errorf("%w: line too long", errProtocol)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+	}
+}
+
+// run runs one command and writes its reply.
+func (s *RESPServer) run(w *respWriter, args []string) {
+	ctx := s.ctx
+	name := strings.ToUpper(args[0])
+	arity, ok := respArity[name]
+	if !ok {
+		w.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if len(args) < arity.min || (arity.max > 0 && len(args) > arity.max) {
+		w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	var err error
+	switch name {
+	case "PING":
+		if len(args) == 2 {
+			w.writeBulk(args[1])
+		} else {
+			w.writeSimple("PONG")
+		}
+	case "GET":
+		var value string
+		var exists bool
+		if value, exists, err = s.db.Get(ctx, args[1]); err == nil {
+			if exists {
+				w.writeBulk(value)
+			} else {
+				w.writeNull()
+			}
+		}
+	case "SET":
+		err = s.set(ctx, w, args[1:])
+	case "DEL", "EXISTS":
+		n := 0
+		for _, key := range args[1:] {
+			var found bool
+			if name == "DEL" {
+				found, err = s.db.Delete(ctx, key)
+			} else {
+				found, err = s.db.Exists(ctx, key)
+			}
+			if err != nil {
+				break
+			}
+			if found {
+				n++
+			}
+		}
+		if err == nil {
+			w.writeInt(n)
+		}
+	case "KEYS":
+		var keys []string
+		for entry, e := range s.db.All(ctx) {
+			if err = e; err != nil {
+				break
+			}
+			if globMatch(args[1], entry.Key) {
+				keys = append(keys, entry.Key)
+			}
+		}
+		if err == nil {
+			w.writeArray(keys)
+		}
+	case "EXPIRE":
+		seconds, convErr := strconv.ParseInt(args[2], 10, 64)
+		if convErr != nil {
+			w.writeError("ERR value is not an integer or out of range")
+			return
+		}
+		ttl, ok := expireTTL(seconds, time.Second)
+		if !ok {
+			w.writeError("ERR invalid expire time in 'expire' command")
+			return
+		}
+		var found bool
+		// like Redis, a time in the past deletes the key
+		if seconds <= 0 {
+			found, err = s.db.Delete(ctx, args[1])
+		} else {
+			found, err = s.db.Expire(ctx, args[1], ttl)
+		}
+		if err == nil {
+			w.writeInt(boolInt(found))
+		}
+	case "TTL":
+		var ttl time.Duration
+		var ok, exists bool
+		if ttl, ok, err = s.db.TTL(ctx, args[1]); err == nil && ok {
+			w.writeInt(int((ttl + time.Second/2) / time.Second))
+		} else if err == nil {
+			// -1 for a key that never expires, -2 for a missing one
+			if exists, err = s.db.Exists(ctx, args[1]); err == nil {
+				w.writeInt(boolInt(exists) - 2)
+			}
+		}
+	}
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+	}
+}
+
+// expireTTL turns n seconds or milliseconds into a duration. Like Redis, it refuses times too far off to represent,
+// which would otherwise wrap around to a TTL in the past.
+func expireTTL(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// respArity is how many arguments each command takes, counting the command itself; a max of 0 means no limit.
+var respArity = map[string]struct{ min, max int }{
+	"PING":   {1, 2},
+	"GET":    {2, 2},
+	"SET":    {3, 5},
+	"DEL":    {2, 0},
+	"EXISTS": {2, 0},
+	"KEYS":   {2, 2},
+	"EXPIRE": {3, 3},
+	"TTL":    {2, 2},
+}
+
+// set runs SET key value [EX seconds | PX milliseconds].
+func (s *RESPServer) set(ctx context.Context, w *respWriter, args []string) error {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	switch opts := args[2:]; {
+	case len(opts) == 0:
+	case len(opts) == 2 && (strings.EqualFold(opts[0], "EX") || strings.EqualFold(opts[0], "PX")):
+		n, err := strconv.ParseInt(opts[1], 10, 64)
+		if err != nil {
+			w.writeError("ERR value is not an integer or out of range")
+			return nil
+		}
+		unit := time.Millisecond
+		if strings.EqualFold(opts[0], "EX") {
+			unit = time.Second
+		}
+		var ok bool
+		if ttl, ok = expireTTL(n, unit); !ok || n <= 0 {
+			w.writeError("ERR invalid expire time in 'set' command")
+			return nil
+		}
+	default:
+		w.writeError("ERR syntax error")
+		return nil
+	}
+	var err error
+	if ttl > 0 {
+		err = s.db.SaveWithTTL(ctx, key, value, ttl)
+	} else {
+		err = s.db.Save(ctx, key, value)
+	}
+	if err == nil {
+		w.writeSimple("OK")
+	}
+	return err
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// globMatch reports whether key matches a KEYS pattern: * matches any bytes, ? one byte,
+// [abc], [a-z] and [^abc] one byte of a class, and \ takes the next character literally.
+func globMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := range len(key) + 1 {
+				if globMatch(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if key == "" {
+				return false
+			}
+		case '[':
+			end := classEnd(pattern)
+			if end < 0 {
+				// an unclosed [ is an ordinary character
+				if key == "" || key[0] != '[' {
+					return false
+				}
+				break
+			}
+			if key == "" || !matchClass(pattern[1:end], key[0]) {
+				return false
+			}
+			pattern, key = pattern[end+1:], key[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if key == "" || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return key == ""
+}
+
+// classEnd returns the position of the ] that closes the class pattern starts with, or -1.
+func classEnd(pattern string) int {
+	for i := 1; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case ']':
+			if i > 1 && !(i == 2 && pattern[1] == '^') {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// matchClass reports whether c is in a class, given without its brackets.
+func matchClass(class string, c byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	for i := 0; i < len(class); i++ {
+		lo := class[i]
+		if lo == '\\' && i+1 < len(class) {
+			i++
+			lo = class[i]
+		}
+		hi := lo
+		if i+2 < len(class) && class[i+1] == '-' {
+			hi = class[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			return !negate
+		}
+	}
+	return negate
+}
+
+// respWriter writes the RESP replies.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w *respWriter) writeSimple(s string) { fmt.Fprintf(w, "+%s\r\n", s) }
+func (w *respWriter) writeError(s string) {
+	fmt.Fprintf(w, "-%s\r\n", strings.ReplaceAll(s, "\r\n", " "))
+}
+func (w *respWriter) writeInt(n int)     { fmt.Fprintf(w, ":%d\r\n", n) }
+func (w *respWriter) writeBulk(s string) { fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s) }
+func (w *respWriter) writeNull()         { w.WriteString("$-1\r\n") }
+
+func (w *respWriter) writeArray(items []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(items))
+	for _, item := range items {
+		w.writeBulk(item)
+	}
+}
+
+// runRESP is the resp command: it serves a fake until it is interrupted.
+func runRESP(args []string) error {
+	flags := flag.NewFlagSet("resp", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:6379", "the address to listen on")
+	dir := flags.String("data", "", "the directory to keep the data in; in memory if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fakeDB := NewFakeDatabase()
+	if *dir != "" {
+		var err error
+		if fakeDB, err = OpenFakeDatabase(*dir); err != nil {
+			return err
+		}
+	}
+	defer fakeDB.Close()
+	server, err := ServeRESP(fakeDB, *addr)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	fmt.Printf("Fake Database - serving RESP on %s\n", server.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// The Redis-protocol front-end, driven over a real connection.
+// ----------------------------------------------------------------------------
+
+// respClient sends commands as RESP arrays and reads the replies back as strings:
+// "+OK", "-ERR ...", ":1", the value of a bulk string, "(nil)", or the items of an array in brackets.
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRESP(t *testing.T, server *RESPServer) *respClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) {
+	c.t.Helper()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		c.t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func (c *respClient) reply() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("unexpected error: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatalf("unexpected error: %v", err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		var items []string
+		for range n {
+			items = append(items, c.reply())
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return line
+}
+
+// do sends a command and checks its reply.
+func (c *respClient) do(expected string, args ...string) {
+	c.t.Helper()
+	c.send(args...)
+	if got := c.reply(); got != expected {
+		c.t.Errorf("%s: expected %q, but got: %q", strings.Join(args, " "), expected, got)
+	}
+}
+
+func TestRESPServer(t *testing.T) {
+	ctx := context.Background()
+	serve := func(t *testing.T, fakeDB *FakeDatabase) *RESPServer {
+		server, err := ServeRESP(fakeDB, "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() { server.Close() })
+		return server
+	}
+
+	// "commands":
+	// the commands read and write the fake, with the replies of Redis.
+	t.Run("commands", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		c := dialRESP(t, serve(t, fakeDB))
+		c.do("+PONG", "PING")
+		c.do("hello", "ping", "hello")
+		c.do("+OK", "SET", "user1", "data 1")
+		c.do("+OK", "set", "user2", "line 1\r\nline 2")
+		c.do("data 1", "GET", "user1")
+		c.do("line 1\r\nline 2", "GET", "user2")
+		c.do("(nil)", "GET", "missing")
+		c.do(":2", "EXISTS", "user1", "user2", "missing")
+		c.do(":1", "DEL", "user1", "missing")
+		c.do(":0", "EXISTS", "user1")
+		if value, _, _ := GetUserData(ctx, fakeDB, "user2"); value != "line 1\r\nline 2" {
+			t.Errorf("expected the value in the fake, but got: %q", value)
+		}
+	})
+
+	// "expiry":
+	// SET EX and PX, EXPIRE and TTL follow the fake's clock; EXPIRE in the past deletes the key.
+	t.Run("expiry", func(t *testing.T) {
+		clock := NewManualClock(time.Now())
+		c := dialRESP(t, serve(t, NewFakeDatabase(WithClock(clock))))
+		c.do("+OK", "SET", "session", "token", "EX", "60")
+		c.do("+OK", "SET", "short", "token", "px", "1500")
+		c.do("+OK", "SET", "user1", "data 1")
+		c.do(":60", "TTL", "session")
+		c.do(":2", "TTL", "short")
+		c.do(":-1", "TTL", "user1")
+		c.do(":-2", "TTL", "missing")
+		c.do(":1", "EXPIRE", "user1", "10")
+		c.do(":0", "EXPIRE", "missing", "10")
+		c.do(":10", "TTL", "user1")
+
+		clock.Advance(30 * time.Second)
+		c.do("(nil)", "GET", "user1")
+		c.do(":30", "TTL", "session")
+		c.do(":1", "EXPIRE", "session", "0")
+		c.do(":0", "EXISTS", "session")
+	})
+
+	// "keys":
+	// KEYS returns the matching keys in order.
+	t.Run("keys", func(t *testing.T) {
+		c := dialRESP(t, serve(t, NewFakeDatabase()))
+		for _, key := range []string{"user:2", "user:1", "user:10", "session:1"} {
+			c.do("+OK", "SET", key, "x")
+		}
+		c.do("[session:1 user:1 user:10 user:2]", "KEYS", "*")
+		c.do("[user:1 user:10 user:2]", "KEYS", "user:*")
+		c.do("[user:1 user:2]", "KEYS", "user:?")
+		c.do("[]", "KEYS", "nothing*")
+	})
+
+	// "errors":
+	// bad commands and the errors of the fake are Redis errors, and the connection goes on.
+	t.Run("errors", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		c := dialRESP(t, serve(t, fakeDB))
+		c.do("-ERR unknown command 'FLUSHALL'", "FLUSHALL")
+		c.do("-ERR wrong number of arguments for 'get' command", "GET")
+		c.do("-ERR wrong number of arguments for 'ttl' command", "TTL", "a", "b")
+		c.do("-ERR syntax error", "SET", "k", "v", "NX")
+		c.do("-ERR invalid expire time in 'set' command", "SET", "k", "v", "EX", "0")
+		c.do("-ERR value is not an integer or out of range", "EXPIRE", "k", "soon")
+		// times whose duration overflows are refused instead of wrapping around into the past
+		c.do("-ERR invalid expire time in 'set' command", "SET", "k", "v", "EX", "9223372037")
+		c.do("-ERR invalid expire time in 'set' command", "SET", "k", "v", "PX", "9223372036855")
+		c.do("-ERR invalid expire time in 'expire' command", "EXPIRE", "k", "9223372037")
+		c.do("+OK", "SET", "k", "v", "EX", "9223372036")
+		c.do("+OK", "SET", "k", "v", "PX", "9223372036854")
+
+		fakeDB.InjectFaults(FailNthWrite(1))
+		c.send("SET", "k", "v")
+		if got := c.reply(); !strings.HasPrefix(got, "-ERR ") {
+			t.Errorf("expected an error, but got: %q", got)
+		}
+		c.do("+OK", "SET", "k", "v")
+	})
+
+	// "inline commands and pipelining":
+	// a line of words is a command too, and several commands sent at once get their replies in order.
+	t.Run("inline commands and pipelining", func(t *testing.T) {
+		c := dialRESP(t, serve(t, NewFakeDatabase()))
+		c.conn.Write([]byte("PING\r\n\r\nSET a 1\nGET a\r\n"))
+		for _, expected := range []string{"+PONG", "+OK", "1"} {
+			if got := c.reply(); got != expected {
+				t.Errorf("expected %q, but got: %q", expected, got)
+			}
+		}
+		for i := range 100 {
+			c.send("SET", fmt.Sprint("key", i), fmt.Sprint(i))
+		}
+		for range 100 {
+			if got := c.reply(); got != "+OK" {
+				t.Fatalf("expected +OK, but got: %q", got)
+			}
+		}
+		c.do(":1", "EXISTS", "key99")
+	})
+
+	// "protocol error":
+	// a client that breaks the protocol gets an error and is disconnected.
+	t.Run("protocol error", func(t *testing.T) {
+		c := dialRESP(t, serve(t, NewFakeDatabase()))
+		c.conn.Write([]byte("*1\r\n+PING\r\n"))
+		if got := c.reply(); !strings.HasPrefix(got, "-ERR protocol error") {
+			t.Errorf("expected a protocol error, but got: %q", got)
+		}
+		if _, err := c.r.ReadByte(); err == nil {
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+
+	// "close":
+	// Close disconnects the clients and stops listening.
+	t.Run("close", func(t *testing.T) {
+		server := serve(t, NewFakeDatabase())
+		c := dialRESP(t, server)
+		c.do("+PONG", "PING")
+		if err := server.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := c.r.ReadByte(); err == nil {
+			t.Errorf("expected the connection to be closed")
+		}
+		if conn, err := net.Dial("tcp", server.Addr()); err == nil {
+			conn.Close()
+			t.Errorf("expected the server to stop listening")
+		}
+	})
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"*:1", "user:1", true},
+		{"u*r*1", "user:1", true},
+		{"user:?", "user:1", true},
+		{"user:?", "user:10", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"h[llo", "h[llo", true},
+		{"a/b*", "a/b/c", true},
+	} {
+		if got := globMatch(test.pattern, test.key); got != test.match {
+			t.Errorf("globMatch(%q, %q): expected %v, but got: %v", test.pattern, test.key, test.match, got)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Ordered scans and iteration over a Database.
+// ----------------------------------------------------------------------------
+
+// Scan reads a Database one page at a time, in key order.
+// A scan selects the keys with a given prefix and/or the keys in the range [Start, End).
+// Every page comes with a cursor; passing it back in the next ScanOptions continues the scan where the page ended.
+// An empty cursor means there is nothing left to read.
+
+// All iterates over the whole Database in key order, using a Go 1.23 range-over-func iterator.
+// The iterator yields an error instead of an entry if something goes wrong, and stops after it:
+//
+//	for entry, err := range db.All(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+
+// defaultScanLimit is the page size used when ScanOptions.Limit is zero.
+const defaultScanLimit = 100
+
+type ScanOptions struct {
+	Prefix string // only keys starting with Prefix
+	Start  string // only keys >= Start
+	End    string // only keys < End; "" means no upper bound
+	Cursor string // continue after the page that returned this cursor
+	Limit  int    // maximum number of entries in the page; 0 means defaultScanLimit
+}
+
+type Entry struct {
+	Key   string
+	Value string
+}
+
+type ScanPage struct {
+	Entries []Entry
+	Cursor  string // pass to the next Scan to get the next page; "" when the scan is complete
+}
+
+// matches reports whether key is selected by the prefix and range of opts (the cursor is handled separately).
+func (opts ScanOptions) matches(key string) bool {
+	return strings.HasPrefix(key, opts.Prefix) && key >= opts.Start && (opts.End == "" || key < opts.End)
+}
+
+func (opts ScanOptions) limit() int {
+	if opts.Limit <= 0 {
+		return defaultScanLimit
+	}
+	return opts.Limit
+}
+
+// Cursors are opaque to callers; inside they carry the last key of the previous page.
+// The prefix keeps the cursor of a page ending at the empty key from looking like "no more pages".
+const cursorPrefix = "c1."
+
+func encodeCursor(lastKey string) string {
+	return cursorPrefix + base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+}
+
+// decodeCursor returns the key to continue after, and false for the empty cursor (start from the beginning).
+func decodeCursor(cursor string) (string, bool, error) {
+	if cursor == "" {
+		return "", false, nil
+	}
+	encoded, ok := strings.CutPrefix(cursor, cursorPrefix)
+	if !ok {
+		return "", false, fmt.Errorf("invalid scan cursor %q", cursor)
+	}
+	lastKey, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid scan cursor %q: %w", cursor, err)
+	}
+	return string(lastKey), true, nil
+}
+
+// The FakeDatabase keeps its keys in unordered maps, so it takes a shortcut:
+// every scan collects the matching keys from all shards and sorts them.
+// That is O(n log n) per page, which is fine for the data sets a fake holds.
+
+func (db *FakeDatabase) Scan(ctx context.Context, opts ScanOptions) (page ScanPage, err error) {
+	defer func() { db.record(Op{Kind: OpScan}, "", fmt.Sprint(len(page.Entries), " entries"), err) }()
+	if err := db.check(ctx, Op{Kind: OpScan}); err != nil {
+		return ScanPage{}, err
+	}
+	after, hasAfter, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	entries := db.entries(func(key string) bool {
+		return opts.matches(key) && (!hasAfter || key > after)
+	})
+
+	if len(entries) > opts.limit() {
+		entries = entries[:opts.limit()]
+		page.Cursor = encodeCursor(entries[len(entries)-1].Key)
+	}
+	page.Entries = entries
+	return page, nil
+}
+
+func (db *FakeDatabase) All(ctx context.Context) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		// the journal gets the scan once the loop is over, with the number of entries the loop saw
+		n := 0
+		var err error
+		defer func() { db.record(Op{Kind: OpScan}, "", fmt.Sprint(n, " entries"), err) }()
+		if err = db.check(ctx, Op{Kind: OpScan}); err != nil {
+			yield(Entry{}, err)
+			return
+		}
+		// the entries are copied before the first yield, so the loop body is free to modify the database
+		for _, entry := range db.entries(func(string) bool { return true }) {
+			if err = ctx.Err(); err != nil {
+				yield(Entry{}, err)
+				return
+			}
+			n++
+			if !yield(entry, nil) {
+				return
+			}
+		}
+	}
+}
+
+// entries returns the live entries whose keys satisfy keep, sorted by key.
+func (db *FakeDatabase) entries(keep func(key string) bool) []Entry {
+	now := db.clock.Now()
+	var entries []Entry
+	for _, s := range db.shards {
+		s.mu.RLock()
+		for key, it := range s.data {
+			if keep(key) && !it.expired(now) {
+				entries = append(entries, Entry{Key: key, Value: it.value})
+			}
+		}
+		s.mu.RUnlock()
+	}
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries
+}
+
+// Entries iterates over all the entries selected by opts on any Database, fetching them page by page with Scan.
+// opts.Limit sets the page size, not the total number of entries.
+func Entries(ctx context.Context, db Database, opts ScanOptions) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		for {
+			page, err := db.Scan(ctx, opts)
+			if err != nil {
+				yield(Entry{}, err)
+				return
+			}
+			for _, entry := range page.Entries {
+				if !yield(entry, nil) {
+					return
+				}
+			}
+			if page.Cursor == "" {
+				return
+			}
+			opts.Cursor = page.Cursor
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------
+// Ordered scans and iteration over the fake database.
+// ----------------------------------------------------------------------------
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	fakeDB := NewFakeDatabase()
+	for _, key := range []string{"user:03", "user:01", "admin:01", "user:02", "user:10", "", "zebra"} {
+		fakeDB.Save(ctx, key, "value of "+key)
+	}
+
+	keys := func(entries []Entry) []string {
+		var result []string
+		for _, entry := range entries {
+			result = append(result, entry.Key)
+		}
+		return result
+	}
+
+	// "prefix":
+	// only the keys with the prefix are returned, in order.
+	t.Run("prefix", func(t *testing.T) {
+		page, err := fakeDB.Scan(ctx, ScanOptions{Prefix: "user:"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := keys(page.Entries); !slices.Equal(got, []string{"user:01", "user:02", "user:03", "user:10"}) {
+			t.Errorf("unexpected keys: %v", got)
+		}
+		if page.Cursor != "" {
+			t.Errorf("expected no cursor after the last page, but got: %q", page.Cursor)
+		}
+	})
+
+	// "range":
+	// Start is inclusive and End is exclusive.
+	t.Run("range", func(t *testing.T) {
+		page, _ := fakeDB.Scan(ctx, ScanOptions{Start: "user:02", End: "user:10"})
+		if got := keys(page.Entries); !slices.Equal(got, []string{"user:02", "user:03"}) {
+			t.Errorf("unexpected keys: %v", got)
+		}
+	})
+
+	// "cursor":
+	// paging with a limit of 2 visits every key exactly once, including the empty key.
+	t.Run("cursor", func(t *testing.T) {
+		var got []string
+		opts := ScanOptions{Limit: 2}
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("the scan doesn't end")
+			}
+			page, err := fakeDB.Scan(ctx, opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got = append(got, keys(page.Entries)...)
+			if page.Cursor == "" {
+				break
+			}
+			opts.Cursor = page.Cursor
+		}
+		expected := []string{"", "admin:01", "user:01", "user:02", "user:03", "user:10", "zebra"}
+		if !slices.Equal(got, expected) {
+			t.Errorf("expected keys %q, but got: %q", expected, got)
+		}
+	})
+
+	// "invalid cursor":
+	// a cursor that didn't come from Scan is an error.
+	t.Run("invalid cursor", func(t *testing.T) {
+		if _, err := fakeDB.Scan(ctx, ScanOptions{Cursor: "user:01"}); err == nil {
+			t.Errorf("expected an error for an invalid cursor")
+		}
+	})
+}
+
+func TestAll(t *testing.T) {
+	ctx := context.Background()
+	fakeDB := NewFakeDatabase()
+	for i := range 250 {
+		SaveUserData(ctx, fakeDB, fmt.Sprintf("user%03d", i), fmt.Sprintf("data %d", i))
+	}
+
+	// "in key order":
+	// All and the paging Entries helper both see every user, in order.
+	t.Run("in key order", func(t *testing.T) {
+		var all []string
+		for entry, err := range fakeDB.All(ctx) {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// the keys are zero-padded, so the i-th key in order is user i
+			if entry.Value != fmt.Sprintf("data %d", len(all)) {
+				t.Errorf("unexpected value for %s: %s", entry.Key, entry.Value)
+			}
+			all = append(all, entry.Key)
+		}
+		if len(all) != 250 || !slices.IsSorted(all) {
+			t.Errorf("expected 250 sorted keys, but got %d: %v...", len(all), all[:min(5, len(all))])
+		}
+		var paged []string
+		for entry, err := range Entries(ctx, fakeDB, ScanOptions{Prefix: "user", Limit: 7}) {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			paged = append(paged, entry.Key)
+		}
+		if !slices.Equal(all, paged) {
+			t.Errorf("expected Entries to return the same keys as All")
+		}
+	})
+
+	// "break and modify":
+	// stopping early works, and the loop body may write to the database while iterating.
+	t.Run("break and modify", func(t *testing.T) {
+		seen := 0
+		for entry := range fakeDB.All(ctx) {
+			DeleteUserData(ctx, fakeDB, entry.Key)
+			seen++
+			if seen == 10 {
+				break
+			}
+		}
+		if n, _ := fakeDB.Len(ctx); n != 240 {
+			t.Errorf("expected 240 users left, but got: %d", n)
+		}
+	})
+
+	// "cancelled context":
+	// iterating with a cancelled context yields the context's error and stops.
+	t.Run("cancelled context", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		n := 0
+		for _, err := range fakeDB.All(cancelled) {
+			n++
+			if err != context.Canceled {
+				t.Errorf("expected context.Canceled, but got: %v", err)
+			}
+		}
+		if n != 1 {
+			t.Errorf("expected a single error, but the iterator yielded %d times", n)
+		}
+	})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Snapshots: consistent reads of the fake while the writes go on.
+// ----------------------------------------------------------------------------
+
+// A report that reads many keys one by one sees some of them before a write and some after it.
+// Snapshot returns a read-only view of the fake as it was at one moment, the seq of the last write it sees,
+// and the view keeps that state while the fake moves on:
+//
+//	snap := fakeDB.Snapshot()
+//	defer snap.Close()
+//	for entry, err := range snap.All(ctx) {
+//		...
+//	}
+//
+// A snapshot sees the keys that were live when it was taken: a key that expires later is still there in the snapshot,
+// and the writes, deletes, commits, evictions and purges made after it are not.
+// Its reads go through the fault plan and the journal like the reads of the fake, with the same operations.
+// A closed snapshot fails with ErrSnapshotClosed.
+//
+// Unlike Begin (see tx.go), a snapshot copies nothing: it costs the same to take on a fake of any size.
+
+// The fake keeps the old versions of its keys for the snapshots (multi-version storage). While a snapshot is open,
+// every write first moves the state it replaces into the history of its shard, stamped with the seq of the write:
+// a snapshot at seq S reads the first state of a key replaced after S, or the current one if there is none.
+// A purge of an expired key has no seq of its own, and is stamped with the next one; the snapshots it could hide the key from
+// were taken when the key had expired already, and see it expired anyway.
+//
+// The history only holds what the open snapshots need. A write drops the states of its key that the oldest open snapshot
+// doesn't see, and closing a snapshot sweeps every shard the same way, or clears the history when it was the last one.
+// Without snapshots, the writes don't keep anything.
+
+// ErrSnapshotClosed is returned by the reads of a snapshot after Close.
+var ErrSnapshotClosed = errors.New("snapshot closed")
+
+// snapshots tracks the open snapshots of a fake. The writers only read the atomics, under the locks of their shards;
+// Snapshot and Close take mu first and the shard locks after it.
+type snapshots struct {
+	mu   sync.Mutex
+	open map[*Snapshot]struct{}
+	// count is the number of snapshots open or being taken; with none, the writes keep no history
+	count atomic.Int64
+	// oldest is the seq of the oldest open snapshot: the history replaced at or before it is garbage
+	oldest atomic.Uint64
+}
+
+// pastItem is a state of a key replaced by the write with seq until; exists is false for a key that was missing.
+type pastItem struct {
+	item
+	exists bool
+	until  uint64
+}
+
+// Snapshot is a read-only view of a FakeDatabase at one moment.
+type Snapshot struct {
+	db  *FakeDatabase
+	seq uint64
+	// now is the time of the snapshot, which decides which keys had expired
+	now    time.Time
+	closed atomic.Bool
+}
+
+// Snapshot takes a snapshot of the fake; it has to be closed to let the fake drop the history it holds.
+func (db *FakeDatabase) Snapshot() *Snapshot {
+	db.snapshots.mu.Lock()
+	defer db.snapshots.mu.Unlock()
+	// the writers start keeping the history before the snapshot takes its seq
+	db.snapshots.count.Add(1)
+	for _, s := range db.shards {
+		s.mu.RLock()
+	}
+	snap := &Snapshot{db: db, seq: db.seq.Load(), now: db.clock.Now()}
+	for _, s := range db.shards {
+		s.mu.RUnlock()
+	}
+	if db.snapshots.open == nil {
+		db.snapshots.open = make(map[*Snapshot]struct{})
+	}
+	db.snapshots.open[snap] = struct{}{}
+	db.snapshots.oldest.Store(db.oldestSnapshot())
+	return snap
+}
+
+// oldestSnapshot returns the seq of the oldest open snapshot. The caller holds snapshots.mu.
+func (db *FakeDatabase) oldestSnapshot() uint64 {
+	oldest := db.seq.Load()
+	for snap := range db.snapshots.open {
+		oldest = min(oldest, snap.seq)
+	}
+	return oldest
+}
+
+// retain moves the current state of key into the history before the write with seq until replaces it, if a snapshot may need it.
+// The caller holds the lock of the key's shard.
+func (db *FakeDatabase) retain(s *shard, key string, until uint64) {
+	if db.snapshots.count.Load() == 0 {
+		return
+	}
+	if s.history == nil {
+		s.history = make(map[string][]pastItem)
+	}
+	it, exists := s.data[key]
+	s.history[key] = prune(append(s.history[key], pastItem{item: it, exists: exists, until: until}), db.snapshots.oldest.Load())
+}
+
+// prune drops the states that no snapshot at oldest or later reads: the ones replaced at or before it.
+// The states are in the order of their writes, so those come first.
+func prune(past []pastItem, oldest uint64) []pastItem {
+	i := 0
+	for i < len(past) && past[i].until <= oldest {
+		i++
+	}
+	return past[i:]
+}
+
+// Seq returns the seq of the last write the snapshot sees.
+func (snap *Snapshot) Seq() uint64 {
+	return snap.seq
+}
+
+// Close releases the snapshot, and the history that only it needed. Closing it again does nothing.
+func (snap *Snapshot) Close() error {
+	if snap.closed.Swap(true) {
+		return nil
+	}
+	db := snap.db
+	db.snapshots.mu.Lock()
+	defer db.snapshots.mu.Unlock()
+	delete(db.snapshots.open, snap)
+	db.snapshots.count.Add(-1)
+	oldest := db.oldestSnapshot()
+	db.snapshots.oldest.Store(oldest)
+	for _, s := range db.shards {
+		s.mu.Lock()
+		if len(db.snapshots.open) == 0 {
+			s.history = nil
+		}
+		for key, past := range s.history {
+			if past = prune(past, oldest); len(past) == 0 {
+				delete(s.history, key)
+			} else {
+				s.history[key] = past
+			}
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// check is the check of the fake (see faults.go), for a snapshot that is still open.
+func (snap *Snapshot) check(ctx context.Context, op Op) error {
+	if snap.closed.Load() {
+		return ErrSnapshotClosed
+	}
+	return snap.db.check(ctx, op)
+}
+
+// lookup returns the item of key as the snapshot sees it, unless it was missing or expired. The caller holds the read lock of s.
+func (snap *Snapshot) lookup(s *shard, key string) (item, bool) {
+	it, exists := s.data[key]
+	for _, past := range s.history[key] {
+		if past.until > snap.seq {
+			it, exists = past.item, past.exists
+			break
+		}
+	}
+	if !exists || it.expired(snap.now) {
+		return item{}, false
+	}
+	return it, true
+}
+
+func (snap *Snapshot) Get(ctx context.Context, key string) (value string, exists bool, err error) {
+	defer func() { snap.db.record(Op{Kind: OpGet, Key: key}, value, found(exists), err) }()
+	if err := snap.check(ctx, Op{Kind: OpGet, Key: key}); err != nil {
+		return "", false, err
+	}
+	s := snap.db.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	it, exists := snap.lookup(s, key)
+	return it.value, exists, nil
+}
+
+func (snap *Snapshot) Exists(ctx context.Context, key string) (exists bool, err error) {
+	defer func() { snap.db.record(Op{Kind: OpExists, Key: key}, "", found(exists), err) }()
+	if err := snap.check(ctx, Op{Kind: OpExists, Key: key}); err != nil {
+		return false, err
+	}
+	s := snap.db.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists = snap.lookup(s, key)
+	return exists, nil
+}
+
+// GetMany returns the keys that exist in the snapshot, like GetMany on the fake (see batch.go).
+func (snap *Snapshot) GetMany(ctx context.Context, keys []string) (values map[string]string, err error) {
+	defer func() {
+		for _, key := range keys {
+			value, exists := values[key]
+			snap.db.record(Op{Kind: OpGet, Key: key}, value, found(exists), err)
+		}
+	}()
+	for _, key := range keys {
+		if err := snap.check(ctx, Op{Kind: OpGet, Key: key}); err != nil {
+			return nil, err
+		}
+	}
+	// the snapshot doesn't change, so one shard at a time is as consistent as all of them at once
+	values = make(map[string]string, len(keys))
+	for _, key := range keys {
+		s := snap.db.shardFor(key)
+		s.mu.RLock()
+		if it, exists := snap.lookup(s, key); exists {
+			values[key] = it.value
+		}
+		s.mu.RUnlock()
+	}
+	return values, nil
+}
+
+func (snap *Snapshot) Len(ctx context.Context) (n int, err error) {
+	defer func() { snap.db.record(Op{Kind: OpLen}, "", fmt.Sprint(n), err) }()
+	if err := snap.check(ctx, Op{Kind: OpLen}); err != nil {
+		return 0, err
+	}
+	return len(snap.entries(func(string) bool { return true })), nil
+}
+
+// Scan reads a page of the snapshot, like Scan on the fake (see scan.go); the cursors of the two are interchangeable.
+func (snap *Snapshot) Scan(ctx context.Context, opts ScanOptions) (page ScanPage, err error) {
+	defer func() { snap.db.record(Op{Kind: OpScan}, "", fmt.Sprint(len(page.Entries), " entries"), err) }()
+	if err := snap.check(ctx, Op{Kind: OpScan}); err != nil {
+		return ScanPage{}, err
+	}
+	after, hasAfter, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	entries := snap.entries(func(key string) bool {
+		return opts.matches(key) && (!hasAfter || key > after)
+	})
+	if len(entries) > opts.limit() {
+		entries = entries[:opts.limit()]
+		page.Cursor = encodeCursor(entries[len(entries)-1].Key)
+	}
+	page.Entries = entries
+	return page, nil
+}
+
+// All iterates over the whole snapshot in key order, like All on the fake (see scan.go).
+func (snap *Snapshot) All(ctx context.Context) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		n := 0
+		var err error
+		defer func() { snap.db.record(Op{Kind: OpScan}, "", fmt.Sprint(n, " entries"), err) }()
+		if err = snap.check(ctx, Op{Kind: OpScan}); err != nil {
+			yield(Entry{}, err)
+			return
+		}
+		for _, entry := range snap.entries(func(string) bool { return true }) {
+			if err = ctx.Err(); err != nil {
+				yield(Entry{}, err)
+				return
+			}
+			n++
+			if !yield(entry, nil) {
+				return
+			}
+		}
+	}
+}
+
+// entries returns the entries of the snapshot whose keys satisfy keep, sorted by key.
+// A key of the snapshot is in the data of its shard, in its history, or in both.
+func (snap *Snapshot) entries(keep func(key string) bool) []Entry {
+	var entries []Entry
+	add := func(s *shard, key string) {
+		if !keep(key) {
+			return
+		}
+		if it, exists := snap.lookup(s, key); exists {
+			entries = append(entries, Entry{Key: key, Value: it.value})
+		}
+	}
+	for _, s := range snap.db.shards {
+		s.mu.RLock()
+		for key := range s.data {
+			add(s, key)
+		}
+		for key := range s.history {
+			if _, current := s.data[key]; !current {
+				add(s, key)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries
+}
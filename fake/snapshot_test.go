@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Snapshots of the fake, while the writes go on.
+// ----------------------------------------------------------------------------
+
+// snapshotState reads the whole snapshot.
+func snapshotState(t *testing.T, snap *Snapshot) State {
+	t.Helper()
+	state := State{}
+	for entry, err := range snap.All(context.Background()) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		state[entry.Key] = entry.Value
+	}
+	return state
+}
+
+// historyLen counts the old versions the fake holds for its snapshots.
+func historyLen(db *FakeDatabase) int {
+	n := 0
+	for _, s := range db.shards {
+		s.mu.RLock()
+		for _, past := range s.history {
+			n += len(past)
+		}
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	before := State{"user1": "data 1", "user2": "data 2", "user3": "data 3"}
+
+	// "writes after the snapshot":
+	// saves, deletes, batches and commits made after a snapshot are not in it, and the fake sees them all.
+	t.Run("writes after the snapshot", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		Seed(ctx, fakeDB, before)
+		snap := fakeDB.Snapshot()
+		defer snap.Close()
+
+		SaveUserData(ctx, fakeDB, "user1", "new data 1")
+		DeleteUserData(ctx, fakeDB, "user2")
+		SaveUserData(ctx, fakeDB, "user4", "data 4")
+		SaveUserDataBatch(ctx, fakeDB, map[string]string{"user1": "newer data 1", "user5": "data 5"})
+		WithTx(ctx, fakeDB, func(tx Tx) error {
+			tx.Delete("user3")
+			return tx.Save("user2", "new data 2")
+		})
+
+		if state := snapshotState(t, snap); !maps.Equal(state, before) {
+			t.Errorf("expected the snapshot to keep %v, but got: %v", before, state)
+		}
+		if data, exists, _ := snap.Get(ctx, "user2"); !exists || data != "data 2" {
+			t.Errorf("expected data 2, but got: %q (exists: %v)", data, exists)
+		}
+		if exists, _ := snap.Exists(ctx, "user4"); exists {
+			t.Errorf("expected user4 not to be in the snapshot")
+		}
+		values, _ := snap.GetMany(ctx, []string{"user1", "user3", "user5"})
+		if !maps.Equal(values, map[string]string{"user1": "data 1", "user3": "data 3"}) {
+			t.Errorf("unexpected values: %v", values)
+		}
+		if n, _ := snap.Len(ctx); n != 3 {
+			t.Errorf("expected 3 keys, but got: %d", n)
+		}
+		AssertState(t, fakeDB, State{"user1": "newer data 1", "user2": "new data 2", "user4": "data 4", "user5": "data 5"})
+	})
+
+	// "several snapshots":
+	// every snapshot sees the fake as it was when it was taken.
+	t.Run("several snapshots", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		var snaps []*Snapshot
+		for i := range 5 {
+			snaps = append(snaps, fakeDB.Snapshot())
+			SaveUserData(ctx, fakeDB, "user1", fmt.Sprint("data ", i))
+		}
+		for i, snap := range snaps {
+			data, exists, _ := snap.Get(ctx, "user1")
+			if expected := fmt.Sprint("data ", i-1); exists != (i > 0) || (i > 0 && data != expected) {
+				t.Errorf("snapshot %d: expected %q, but got: %q (exists: %v)", i, expected, data, exists)
+			}
+			if i > 0 && snap.Seq() <= snaps[i-1].Seq() {
+				t.Errorf("expected the seqs of the snapshots to grow, but got: %d after %d", snap.Seq(), snaps[i-1].Seq())
+			}
+			snap.Close()
+		}
+	})
+
+	// "scan":
+	// the pages of a snapshot don't shift when keys are added or deleted in between.
+	t.Run("scan", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		Seed(ctx, fakeDB, before)
+		snap := fakeDB.Snapshot()
+		defer snap.Close()
+		page, err := snap.Scan(ctx, ScanOptions{Limit: 2})
+		if err != nil || len(page.Entries) != 2 {
+			t.Fatalf("unexpected page: %+v (error: %v)", page, err)
+		}
+		SaveUserData(ctx, fakeDB, "user0", "data 0")
+		SaveUserData(ctx, fakeDB, "user2a", "data 2a")
+		DeleteUserData(ctx, fakeDB, "user3")
+		page, err = snap.Scan(ctx, ScanOptions{Limit: 2, Cursor: page.Cursor})
+		if err != nil || len(page.Entries) != 1 || page.Entries[0] != (Entry{Key: "user3", Value: "data 3"}) || page.Cursor != "" {
+			t.Errorf("unexpected page: %+v (error: %v)", page, err)
+		}
+	})
+
+	// "expiry":
+	// a key that was live when the snapshot was taken stays in it after it expires and is purged; one already expired doesn't.
+	t.Run("expiry", func(t *testing.T) {
+		clock := NewManualClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+		fakeDB := NewFakeDatabase(WithClock(clock))
+		fakeDB.SaveWithTTL(ctx, "session1", "token 1", time.Minute)
+		fakeDB.SaveWithTTL(ctx, "session2", "token 2", time.Hour)
+		clock.Advance(time.Minute)
+		snap := fakeDB.Snapshot()
+		defer snap.Close()
+		clock.Advance(time.Hour)
+		if n := fakeDB.PurgeExpired(); n != 2 {
+			t.Errorf("expected 2 keys purged, but got: %d", n)
+		}
+		if state := snapshotState(t, snap); !maps.Equal(state, State{"session2": "token 2"}) {
+			t.Errorf("expected session2 only, but got: %v", state)
+		}
+	})
+
+	// "evictions":
+	// a key evicted after the snapshot is still in it.
+	t.Run("evictions", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithMaxEntries(1), WithEvictionPolicy(EvictLRU))
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		snap := fakeDB.Snapshot()
+		defer snap.Close()
+		SaveUserData(ctx, fakeDB, "user2", "data 2")
+		AssertState(t, fakeDB, State{"user2": "data 2"})
+		if state := snapshotState(t, snap); !maps.Equal(state, State{"user1": "data 1"}) {
+			t.Errorf("expected user1 only, but got: %v", state)
+		}
+	})
+
+	// "garbage collection":
+	// the history only holds what the open snapshots read, and nothing once they are closed.
+	t.Run("garbage collection", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, fakeDB, "user1", "data")
+		for range 10 {
+			SaveUserData(ctx, fakeDB, "user1", "data")
+		}
+		if n := historyLen(fakeDB); n != 0 {
+			t.Errorf("expected no history without snapshots, but got: %d versions", n)
+		}
+
+		old := fakeDB.Snapshot()
+		for range 10 {
+			SaveUserData(ctx, fakeDB, "user1", "data")
+		}
+		recent := fakeDB.Snapshot()
+		for range 10 {
+			SaveUserData(ctx, fakeDB, "user1", "data")
+			SaveUserData(ctx, fakeDB, "user2", "data")
+		}
+		// the old snapshot reads the first version it didn't see; it needs every version after it until it is closed
+		if n := historyLen(fakeDB); n != 30 {
+			t.Errorf("expected 30 versions, but got: %d", n)
+		}
+		old.Close()
+		// the recent one reads the first version of each key written after it
+		if n := historyLen(fakeDB); n != 20 {
+			t.Errorf("expected 20 versions, but got: %d", n)
+		}
+		SaveUserData(ctx, fakeDB, "user1", "data")
+		if n := historyLen(fakeDB); n != 21 {
+			t.Errorf("expected 21 versions, but got: %d", n)
+		}
+		recent.Close()
+		if n := historyLen(fakeDB); n != 0 {
+			t.Errorf("expected no history once the snapshots are closed, but got: %d versions", n)
+		}
+		if err := recent.Close(); err != nil {
+			t.Errorf("expected closing again to do nothing, but got: %v", err)
+		}
+	})
+
+	// "closed":
+	// the reads of a closed snapshot fail.
+	t.Run("closed", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		snap := fakeDB.Snapshot()
+		snap.Close()
+		if _, _, err := snap.Get(ctx, "user1"); !errors.Is(err, ErrSnapshotClosed) {
+			t.Errorf("expected ErrSnapshotClosed, but got: %v", err)
+		}
+		for _, err := range snap.All(ctx) {
+			if !errors.Is(err, ErrSnapshotClosed) {
+				t.Errorf("expected ErrSnapshotClosed, but got: %v", err)
+			}
+		}
+	})
+
+	// "faults and journal":
+	// the reads of a snapshot are operations of the fake.
+	t.Run("faults and journal", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithJournal(), WithFaults(FailKeysMatching(regexp.MustCompile(`^broken$`))))
+		snap := fakeDB.Snapshot()
+		defer snap.Close()
+		if _, _, err := snap.Get(ctx, "broken"); !errors.Is(err, ErrInjectedFault) {
+			t.Errorf("expected an injected fault, but got: %v", err)
+		}
+		snap.Get(ctx, "user1")
+		if n := fakeDB.Journal().Count(OpGet, "user1"); n != 1 {
+			t.Errorf("expected 1 get of user1 in the journal, but got: %d", n)
+		}
+	})
+
+	// "concurrent writers":
+	// a snapshot taken while transfers run between two keys always sees their sum unchanged.
+	t.Run("concurrent writers", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		Seed(ctx, fakeDB, State{"a": "100", "b": "0"})
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					WithTx(ctx, fakeDB, func(tx Tx) error {
+						a, _, _ := tx.Get("a")
+						b, _, _ := tx.Get("b")
+						var x, y int
+						fmt.Sscan(a, &x)
+						fmt.Sscan(b, &y)
+						tx.Save("a", fmt.Sprint(x-1))
+						return tx.Save("b", fmt.Sprint(y+1))
+					})
+				}
+			}()
+		}
+		for range 200 {
+			snap := fakeDB.Snapshot()
+			values, err := snap.GetMany(ctx, []string{"a", "b"})
+			snap.Close()
+			var x, y int
+			fmt.Sscan(values["a"], &x)
+			fmt.Sscan(values["b"], &y)
+			if err != nil || x+y != 100 {
+				t.Fatalf("expected a sum of 100, but got: %v (error: %v)", values, err)
+			}
+		}
+		close(stop)
+		wg.Wait()
+		if n := historyLen(fakeDB); n != 0 {
+			t.Errorf("expected no history, but got: %d versions", n)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ----------------------------------------------------------------------------
+// Asserting on the whole state of a database in tests.
+// ----------------------------------------------------------------------------
+
+// A test that saves some user data and then reads one key back by hand doesn't see what else the code wrote or deleted.
+// These helpers look at everything at once: Dump copies every key and value of a database into a State,
+// and Diff compares two states key by key. The tests wrap them (see state_test.go): AssertState compares a database
+// to an expected State and reports the differences, and AssertOnlyChanged checks that the code under test touched
+// nothing but the keys it should have.
+//
+//	fakeDB := NewFakeDatabase()
+//	SeedFromFile(t, fakeDB, "testdata/users.yaml")
+//	before := DumpState(t, fakeDB)
+//	RenameUser(ctx, fakeDB, "user1", "Alice")
+//	AssertOnlyChanged(t, before, DumpState(t, fakeDB), "user1")
+//
+// A fixture is a YAML or JSON object from keys to values. A value that is a string is stored as it is,
+// a number or a boolean as its text, and an object or a list as JSON, which is how the user records are stored:
+//
+//	user1: some user data
+//	u1: {id: u1, name: Alice, email: alice@example.com}
+//
+// The helpers work with any Database, so the same assertions run against the fake and the real database.
+
+// State is every key of a database with its value.
+type State map[string]string
+
+// Dump reads the whole state of db.
+func Dump(ctx context.Context, db Database) (State, error) {
+	state := make(State)
+	for entry, err := range db.All(ctx) {
+		if err != nil {
+			return nil, fmt.Errorf("dumping the database: %w", err)
+		}
+		state[entry.Key] = entry.Value
+	}
+	return state, nil
+}
+
+// ChangeKind says how a key differs between two states.
+type ChangeKind string
+
+const (
+	KeyAdded    ChangeKind = "+"
+	KeyRemoved  ChangeKind = "-"
+	KeyModified ChangeKind = "~"
+)
+
+// KeyChange is the difference of one key between two states: Before is empty for an added key, After for a removed one.
+type KeyChange struct {
+	Kind          ChangeKind
+	Key           string
+	Before, After string
+}
+
+func (c KeyChange) String() string {
+	switch c.Kind {
+	case KeyAdded:
+		return fmt.Sprintf("+ %q: %q", c.Key, c.After)
+	case KeyRemoved:
+		return fmt.Sprintf("- %q: %q", c.Key, c.Before)
+	default:
+		return fmt.Sprintf("~ %q: %q -> %q", c.Key, c.Before, c.After)
+	}
+}
+
+// StateDiff is the list of the keys that differ between two states, in key order.
+type StateDiff []KeyChange
+
+// String lists the changes one per line, indented to sit under a test failure.
+func (d StateDiff) String() string {
+	var b strings.Builder
+	for _, c := range d {
+		fmt.Fprintf(&b, "\t%s\n", c)
+	}
+	return b.String()
+}
+
+// Keys returns the keys that differ.
+func (d StateDiff) Keys() []string {
+	keys := make([]string, len(d))
+	for i, c := range d {
+		keys[i] = c.Key
+	}
+	return keys
+}
+
+// Diff compares two states: a key only in after is added, a key only in before is removed.
+func Diff(before, after State) StateDiff {
+	keys := slices.Sorted(maps.Keys(before))
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var diff StateDiff
+	for _, key := range keys {
+		old, inBefore := before[key]
+		value, inAfter := after[key]
+		switch {
+		case !inBefore:
+			diff = append(diff, KeyChange{Kind: KeyAdded, Key: key, After: value})
+		case !inAfter:
+			diff = append(diff, KeyChange{Kind: KeyRemoved, Key: key, Before: old})
+		case old != value:
+			diff = append(diff, KeyChange{Kind: KeyModified, Key: key, Before: old, After: value})
+		}
+	}
+	return diff
+}
+
+// ParseFixture reads a fixture in the given format, "yaml" or "json".
+func ParseFixture(data []byte, format string) (State, error) {
+	var raw map[string]any
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(data, &raw)
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	default:
+		return nil, fmt.Errorf("unknown fixture format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s fixture: %w", format, err)
+	}
+
+	state := make(State, len(raw))
+	for key, value := range raw {
+		switch value := value.(type) {
+		case string:
+			state[key] = value
+		case map[string]any, []any:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("fixture key %q: %w", key, err)
+			}
+			state[key] = string(encoded)
+		case nil:
+			return nil, fmt.Errorf("fixture key %q has no value", key)
+		default:
+			state[key] = fmt.Sprint(value)
+		}
+	}
+	return state, nil
+}
+
+// Seed saves every key of state in one transaction.
+func Seed(ctx context.Context, db Database, state State) error {
+	return SaveUserRecords(ctx, db, state)
+}
+
+// LoadFixture reads a fixture file, in YAML or JSON according to its extension, or an export in JSON lines or CSV (see export.go).
+func LoadFixture(path string) (State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if exportFormat, formatErr := FormatOf(path); formatErr == nil {
+		return ReadExport(bytes.NewReader(data), exportFormat)
+	}
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	if format == "yml" {
+		format = "yaml"
+	}
+	return ParseFixture(data, format)
+}
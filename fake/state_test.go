@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------
+// Assertions on the whole state of a database.
+// ----------------------------------------------------------------------------
+
+// DumpState is Dump for tests: it fails the test if the database can't be read.
+func DumpState(t testing.TB, db Database) State {
+	t.Helper()
+	state, err := Dump(context.Background(), db)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return state
+}
+
+// AssertState fails the test unless db holds exactly the expected keys and values.
+// The differences are listed from the expected state to the actual one: + for a key that shouldn't be there, - for a missing key.
+func AssertState(t testing.TB, db Database, expected State) {
+	t.Helper()
+	if diff := Diff(expected, DumpState(t, db)); len(diff) > 0 {
+		t.Errorf("expected the database to hold %d keys, but it differs in %d:\n%s", len(expected), len(diff), diff)
+	}
+}
+
+// AssertOnlyChanged fails the test if a key other than keys differs between before and after.
+// The keys are allowed to change, not required to.
+func AssertOnlyChanged(t testing.TB, before, after State, keys ...string) {
+	t.Helper()
+	var unexpected StateDiff
+	for _, c := range Diff(before, after) {
+		if !slices.Contains(keys, c.Key) {
+			unexpected = append(unexpected, c)
+		}
+	}
+	if len(unexpected) > 0 {
+		t.Errorf("expected only %q to change, but so did:\n%s", keys, unexpected)
+	}
+}
+
+// SeedFromFile seeds db from a fixture file (see LoadFixture) and returns what it saved.
+// It fails the test if the file can't be read or saved.
+func SeedFromFile(t testing.TB, db Database, path string) State {
+	t.Helper()
+	state, err := LoadFixture(path)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	if err := Seed(context.Background(), db, state); err != nil {
+		t.Fatalf("seeding from %s: %v", path, err)
+	}
+	return state
+}
+
+// recordingT records the failures of an assertion, so that a test can check that it fails.
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestState(t *testing.T) {
+	ctx := context.Background()
+
+	// "seed from fixtures":
+	// YAML and JSON fixtures, and exports, seed the same state; objects are stored as JSON, numbers as their text.
+	for _, path := range []string{"testdata/users.yaml", "testdata/users.json", "testdata/users.jsonl", "testdata/users.csv"} {
+		t.Run("seed from "+path, func(t *testing.T) {
+			fakeDB := NewFakeDatabase()
+			SeedFromFile(t, fakeDB, path)
+			AssertState(t, fakeDB, State{
+				"user1":  "some user data",
+				"user2":  "more user data",
+				"visits": "3",
+				"u1":     `{"email":"alice@example.com","id":"u1","name":"Alice"}`,
+			})
+			user, found, err := GetUser(ctx, fakeDB, "u1")
+			if err != nil || !found || user.Name != "Alice" {
+				t.Errorf("expected to read Alice back, but got: %+v, %v, %v", user, found, err)
+			}
+		})
+	}
+
+	// "bad fixtures":
+	t.Run("bad fixtures", func(t *testing.T) {
+		for _, test := range []struct{ data, format string }{
+			{"user1: [unclosed", "yaml"},
+			{`{"user1": }`, "json"},
+			{"user1:", "yaml"},
+			{"user1: data", "toml"},
+		} {
+			if _, err := ParseFixture([]byte(test.data), test.format); err == nil {
+				t.Errorf("expected an error for %s fixture %q", test.format, test.data)
+			}
+		}
+	})
+
+	// "diff":
+	// added, removed and modified keys are listed in key order.
+	t.Run("diff", func(t *testing.T) {
+		diff := Diff(State{"a": "1", "b": "2", "c": "3"}, State{"a": "1", "b": "two", "d": "4"})
+		expected := "\t~ \"b\": \"2\" -> \"two\"\n\t- \"c\": \"3\"\n\t+ \"d\": \"4\"\n"
+		if diff.String() != expected {
+			t.Errorf("expected:\n%s\nbut got:\n%s", expected, diff)
+		}
+		if len(Diff(State{"a": "1"}, State{"a": "1"})) != 0 {
+			t.Errorf("expected no difference between equal states")
+		}
+	})
+
+	// "assert state fails with a diff":
+	t.Run("assert state fails with a diff", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		SaveUserData(ctx, fakeDB, "extra", "data")
+		r := &recordingT{TB: t}
+		AssertState(r, fakeDB, State{"user1": "data 1", "user2": "data 2"})
+		if len(r.errors) != 1 || !strings.Contains(r.errors[0], `+ "extra": "data"`) || !strings.Contains(r.errors[0], `- "user2": "data 2"`) {
+			t.Errorf("expected one failure listing extra and user2, but got: %q", r.errors)
+		}
+	})
+
+	// "only keys changed":
+	// a change to a key that isn't listed fails the test; the listed keys don't have to change.
+	t.Run("only keys changed", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserRecords(ctx, fakeDB, map[string]string{"user1": "data 1", "user2": "data 2"})
+		before := DumpState(t, fakeDB)
+		SaveUserData(ctx, fakeDB, "user1", "new data")
+		AssertOnlyChanged(t, before, DumpState(t, fakeDB), "user1", "user3")
+
+		DeleteUserData(ctx, fakeDB, "user2")
+		r := &recordingT{TB: t}
+		AssertOnlyChanged(r, before, DumpState(t, fakeDB), "user1")
+		if len(r.errors) != 1 || !strings.Contains(r.errors[0], `- "user2"`) {
+			t.Errorf("expected one failure listing user2, but got: %q", r.errors)
+		}
+	})
+
+	// "with real database":
+	// the helpers work on any Database.
+	t.Run("with real database", func(t *testing.T) {
+		realDB := openRealDatabase(t)
+		seeded := SeedFromFile(t, realDB, "testdata/users.yaml")
+		before := DumpState(t, realDB)
+		AssertState(t, realDB, seeded)
+		DeleteUserData(ctx, realDB, "user2")
+		AssertOnlyChanged(t, before, DumpState(t, realDB), "user2")
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// A typed store on top of the string-to-string Database.
+// ----------------------------------------------------------------------------
+
+// A Database maps strings to strings, which pushes every caller to marshal its own values by hand.
+// Store[K, V] does that once: a KeyEncoder turns keys into strings and back, and a Codec does the same for values.
+// It works on any Database, so a Store over the fake behaves like a Store over the real database:
+//
+//	products := NewStore(db, "product:", IntKey{}, JSONCodec[Product]{})
+//	err := products.Save(ctx, 42, Product{Name: "Teapot"})
+//	product, exists, err := products.Get(ctx, 42)
+//
+// Three codecs come with it: JSON (readable), gob (Go-only, handles more types) and BinaryCodec,
+// which uses the value's own MarshalBinary and UnmarshalBinary methods (User has a compact format of its own, see below).
+// A value that can't be decoded is reported as a *DecodeError, which says which key it was.
+
+// A Codec turns values into the strings stored in the Database, and back.
+type Codec[V any] interface {
+	Encode(value V) (string, error)
+	Decode(data string) (V, error)
+}
+
+// A KeyEncoder turns keys into Database keys, and back. Keys that sort in order should encode to strings that do too,
+// because scans go in the order of the encoded keys.
+type KeyEncoder[K any] interface {
+	EncodeKey(key K) string
+	DecodeKey(key string) (K, error)
+}
+
+// DecodeError is returned when a stored key or value can't be decoded.
+type DecodeError struct {
+	Key string // the key in the Database
+	Err error  // the error of the codec or the key encoder
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding %q: %v", e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Encode(value V) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+func (JSONCodec[V]) Decode(data string) (V, error) {
+	var value V
+	err := json.Unmarshal([]byte(data), &value)
+	return value, err
+}
+
+// GobCodec encodes every value in a stream of its own, so every stored value carries its type description: simple, not compact.
+type GobCodec[V any] struct{}
+
+func (GobCodec[V]) Encode(value V) (string, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	return buf.String(), err
+}
+
+func (GobCodec[V]) Decode(data string) (V, error) {
+	var value V
+	err := gob.NewDecoder(bytes.NewReader([]byte(data))).Decode(&value)
+	return value, err
+}
+
+// BinaryCodec stores values in their own binary format. P is the pointer type of V, which has the methods:
+//
+//	codec := BinaryCodec[User, *User]{}
+type BinaryCodec[V any, P interface {
+	*V
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+func (BinaryCodec[V, P]) Encode(value V) (string, error) {
+	data, err := P(&value).MarshalBinary()
+	return string(data), err
+}
+
+func (BinaryCodec[V, P]) Decode(data string) (V, error) {
+	var value V
+	err := P(&value).UnmarshalBinary([]byte(data))
+	return value, err
+}
+
+// StringKey stores string keys as they are.
+type StringKey struct{}
+
+func (StringKey) EncodeKey(key string) string {
+	return key
+}
+
+func (StringKey) DecodeKey(key string) (string, error) {
+	return key, nil
+}
+
+// IntKey stores int64 keys as 20 digits, with the sign bit flipped so that negative keys sort before positive ones.
+type IntKey struct{}
+
+func (IntKey) EncodeKey(key int64) string {
+	return fmt.Sprintf("%020d", uint64(key)^(1<<63))
+}
+
+func (IntKey) DecodeKey(key string) (int64, error) {
+	if len(key) != 20 {
+		return 0, fmt.Errorf("invalid int key %q: expected 20 digits", key)
+	}
+	n, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid int key %q: %w", key, err)
+	}
+	return int64(n ^ (1 << 63)), nil
+}
+
+// Store is a typed view of the keys under a prefix of a Database.
+type Store[K, V any] struct {
+	db     Database
+	prefix string
+	keys   KeyEncoder[K]
+	codec  Codec[V]
+}
+
+// NewStore returns a store for the keys of db starting with prefix. An empty prefix makes the whole database the store's.
+func NewStore[K, V any](db Database, prefix string, keys KeyEncoder[K], codec Codec[V]) *Store[K, V] {
+	return &Store[K, V]{db: db, prefix: prefix, keys: keys, codec: codec}
+}
+
+// Record is a key and its value, as yielded by Store.All.
+type Record[K, V any] struct {
+	Key   K
+	Value V
+}
+
+func (s *Store[K, V]) key(key K) string {
+	return s.prefix + s.keys.EncodeKey(key)
+}
+
+func (s *Store[K, V]) Save(ctx context.Context, key K, value V) error {
+	data, err := s.codec.Encode(value)
+	if err != nil {
+		return fmt.Errorf("encoding %q: %w", s.key(key), err)
+	}
+	return s.db.Save(ctx, s.key(key), data)
+}
+
+func (s *Store[K, V]) SaveWithTTL(ctx context.Context, key K, value V, ttl time.Duration) error {
+	data, err := s.codec.Encode(value)
+	if err != nil {
+		return fmt.Errorf("encoding %q: %w", s.key(key), err)
+	}
+	return s.db.SaveWithTTL(ctx, s.key(key), data, ttl)
+}
+
+func (s *Store[K, V]) Get(ctx context.Context, key K) (V, bool, error) {
+	var zero V
+	data, exists, err := s.db.Get(ctx, s.key(key))
+	if err != nil || !exists {
+		return zero, false, err
+	}
+	value, err := s.codec.Decode(data)
+	if err != nil {
+		return zero, false, &DecodeError{Key: s.key(key), Err: err}
+	}
+	return value, true, nil
+}
+
+func (s *Store[K, V]) Delete(ctx context.Context, key K) (bool, error) {
+	return s.db.Delete(ctx, s.key(key))
+}
+
+// All iterates over the records of the store in the order of their encoded keys.
+// A key or value that can't be decoded yields a *DecodeError and ends the iteration.
+func (s *Store[K, V]) All(ctx context.Context) iter.Seq2[Record[K, V], error] {
+	return func(yield func(Record[K, V], error) bool) {
+		for entry, err := range Entries(ctx, s.db, ScanOptions{Prefix: s.prefix}) {
+			if err != nil {
+				yield(Record[K, V]{}, err)
+				return
+			}
+			key, err := s.keys.DecodeKey(entry.Key[len(s.prefix):])
+			if err != nil {
+				yield(Record[K, V]{}, &DecodeError{Key: entry.Key, Err: err})
+				return
+			}
+			value, err := s.codec.Decode(entry.Value)
+			if err != nil {
+				yield(Record[K, V]{}, &DecodeError{Key: entry.Key, Err: err})
+				return
+			}
+			if !yield(Record[K, V]{Key: key, Value: value}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// User is the typed record of a user, stored in place of the raw userData string.
+type User struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Email      string    `json:"email"`
+	SignupDate time.Time `json:"signupDate"`
+}
+
+// ErrMissingUserID is returned when saving a User without an ID.
+var ErrMissingUserID = errors.New("user has no ID")
+
+// The binary format of a User is a version byte followed by the ID, the name, the email and the signup date
+// (in the format of time.Time.MarshalBinary), each as a uvarint length and the bytes.
+
+const userFormatVersion = 1
+
+var errBadUserEncoding = errors.New("invalid binary user")
+
+func (u User) MarshalBinary() ([]byte, error) {
+	signupDate, err := u.SignupDate.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{userFormatVersion}
+	for _, field := range []string{u.ID, u.Name, u.Email, string(signupDate)} {
+		buf = appendString(buf, field)
+	}
+	return buf, nil
+}
+
+func (u *User) UnmarshalBinary(data []byte) error {
+	d := decoder{data: data, fail: errBadUserEncoding}
+	if version := d.byte(); d.err == nil && version != userFormatVersion {
+		return fmt.Errorf("%w: unknown version %d", errBadUserEncoding, version)
+	}
+	user := User{ID: d.string(), Name: d.string(), Email: d.string()}
+	signupDate := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("%w: %d bytes too many", errBadUserEncoding, len(d.data))
+	}
+	if err := user.SignupDate.UnmarshalBinary([]byte(signupDate)); err != nil {
+		return fmt.Errorf("%w: %w", errBadUserEncoding, err)
+	}
+	*u = user
+	return nil
+}
+
+// NewUserStore returns the store of the users of db. The keys are the user IDs, like the keys of SaveUserData,
+// and the values are JSON.
+func NewUserStore(db Database) *Store[string, User] {
+	return NewStore(db, "", StringKey{}, JSONCodec[User]{})
+}
+
+// SaveUser saves user under its ID.
+func SaveUser(ctx context.Context, db Database, user User) error {
+	if user.ID == "" {
+		return ErrMissingUserID
+	}
+	return NewUserStore(db).Save(ctx, user.ID, user)
+}
+
+// GetUser returns the user with the given ID, and whether it exists.
+func GetUser(ctx context.Context, db Database, userID string) (User, bool, error) {
+	return NewUserStore(db).Get(ctx, userID)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// The typed store and its codecs.
+// ----------------------------------------------------------------------------
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	alice := User{ID: "alice", Name: "Alice Ångström", Email: "alice@example.com", SignupDate: time.Date(2024, 2, 29, 12, 30, 0, 0, time.UTC)}
+
+	// "codecs":
+	// a user goes through every codec and comes back the same.
+	codecs := map[string]Codec[User]{
+		"json":   JSONCodec[User]{},
+		"gob":    GobCodec[User]{},
+		"binary": BinaryCodec[User, *User]{},
+	}
+	for name, codec := range codecs {
+		t.Run("codec "+name, func(t *testing.T) {
+			users := NewStore(NewFakeDatabase(), "user:", StringKey{}, codec)
+			if err := users.Save(ctx, alice.ID, alice); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			user, exists, err := users.Get(ctx, alice.ID)
+			if err != nil || !exists {
+				t.Fatalf("expected alice to exist, but got: %v (error: %v)", exists, err)
+			}
+			if user.ID != alice.ID || user.Name != alice.Name || user.Email != alice.Email || !user.SignupDate.Equal(alice.SignupDate) {
+				t.Errorf("expected user %+v, but got: %+v", alice, user)
+			}
+			if _, exists, err := users.Get(ctx, "bob"); exists || err != nil {
+				t.Errorf("expected bob not to exist, but got: %v (error: %v)", exists, err)
+			}
+		})
+	}
+
+	// "int keys":
+	// int keys are scanned in numeric order, negative ones first, and the store only sees its own prefix.
+	t.Run("int keys", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		fakeDB.Save(ctx, "other", "not a score")
+		scores := NewStore(fakeDB, "score:", IntKey{}, JSONCodec[float64]{})
+		keys := []int64{10, -3, 2, math.MinInt64, 0, math.MaxInt64, -1000}
+		for _, key := range keys {
+			scores.Save(ctx, key, float64(key)/2)
+		}
+		var got []int64
+		for record, err := range scores.All(ctx) {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if record.Value != float64(record.Key)/2 {
+				t.Errorf("unexpected value for %d: %v", record.Key, record.Value)
+			}
+			got = append(got, record.Key)
+		}
+		slices.Sort(keys)
+		if !slices.Equal(got, keys) {
+			t.Errorf("expected keys %v, but got: %v", keys, got)
+		}
+	})
+
+	// "decode errors":
+	// a value or key that doesn't decode is a *DecodeError naming the stored key, wrapping the codec's error.
+	t.Run("decode errors", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		fakeDB.Save(ctx, "user:broken", "{not json")
+		fakeDB.Save(ctx, "binary:broken", "\x01\x05ab")
+		fakeDB.Save(ctx, "score:twelve", "12")
+
+		var decodeErr *DecodeError
+		_, _, err := NewStore(fakeDB, "user:", StringKey{}, JSONCodec[User]{}).Get(ctx, "broken")
+		if !errors.As(err, &decodeErr) || decodeErr.Key != "user:broken" {
+			t.Errorf("expected a DecodeError for user:broken, but got: %v", err)
+		}
+		_, _, err = NewStore(fakeDB, "binary:", StringKey{}, BinaryCodec[User, *User]{}).Get(ctx, "broken")
+		if !errors.As(err, &decodeErr) || !errors.Is(err, errBadUserEncoding) {
+			t.Errorf("expected a DecodeError wrapping errBadUserEncoding, but got: %v", err)
+		}
+		for _, err := range NewStore(fakeDB, "score:", IntKey{}, JSONCodec[int]{}).All(ctx) {
+			if !errors.As(err, &decodeErr) || decodeErr.Key != "score:twelve" {
+				t.Errorf("expected a DecodeError for the key score:twelve, but got: %v", err)
+			}
+		}
+	})
+
+	// "encode errors":
+	// a value the codec can't encode is never saved.
+	t.Run("encode errors", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		store := NewStore(fakeDB, "", StringKey{}, JSONCodec[float64]{})
+		if err := store.Save(ctx, "nan", math.NaN()); err == nil {
+			t.Errorf("expected an error for a value JSON can't encode")
+		}
+		if n, _ := fakeDB.Len(ctx); n != 0 {
+			t.Errorf("expected nothing to be saved, but got %d keys", n)
+		}
+	})
+}
+
+func TestSaveUser(t *testing.T) {
+	ctx := context.Background()
+	fakeDB := NewFakeDatabase()
+	alice := User{ID: "alice", Name: "Alice", Email: "alice@example.com", SignupDate: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}
+
+	if err := SaveUser(ctx, fakeDB, alice); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := SaveUser(ctx, fakeDB, User{Name: "Nobody"}); !errors.Is(err, ErrMissingUserID) {
+		t.Errorf("expected ErrMissingUserID, but got: %v", err)
+	}
+	user, exists, err := GetUser(ctx, fakeDB, "alice")
+	if err != nil || !exists || user != alice {
+		t.Errorf("expected user %+v, but got: %+v (exists: %v, error: %v)", alice, user, exists, err)
+	}
+	// the user is stored under its ID, so the string helpers see it too
+	if users, _ := ListUsers(ctx, fakeDB); !slices.Equal(users, []string{"alice"}) {
+		t.Errorf("expected users [alice], but got: %v", users)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Tenants: one Database shared by several tenants, whose keys never collide.
+// ----------------------------------------------------------------------------
+
+// We host several tenants on one Database. ForTenant returns a Database scoped to one of them:
+// every key it is given is stored under the prefix of the tenant, "tenant/<name>/", and every key it returns has that prefix removed.
+// Two tenants can use the same keys, and neither can read, list or overwrite the keys of the other:
+//
+//	acme, err := ForTenant(db, "acme", WithTenantQuota(10000))
+//	err = SaveUserData(ctx, acme, "user1", "data") // saves "tenant/acme/user1"
+//	n, err := acme.DeleteAll(ctx)                  // deletes every key of acme, and nothing else
+//
+// A tenant name can't be empty or contain a "/", so that no tenant's prefix is the beginning of another's.
+// Scans and iteration (Scan, All, Len) only ever see the keys of the tenant, in the same order as they would on a Database of their own.
+//
+// WithTenantQuota limits the number of keys of a tenant: a write that would add keys over the quota fails with ErrQuotaExceeded,
+// and changes nothing. Overwrites and deletes are always allowed.
+//
+// TenantLeaks goes with it: it scans the whole fake underneath the tenants for the keys that aren't under the prefix
+// of a tenant the test allows, and AssertTenantIsolation (see tenant_test.go) fails the test for each of them.
+
+// The quota is checked before the write, against a count of the keys of the tenant that all the TenantDatabases of the tenant
+// on the same Database share, however many ForTenant returned, with a lock: their writes that add or remove keys run one at a time,
+// and can't go over the quota together. The first write that adds a key counts the keys with a scan, and the writes keep the count
+// up to date after that. Keys that expire, or that are deleted around the TenantDatabases, leave the count too high,
+// so a write that doesn't fit counts again before it fails; keys saved around them leave it too low.
+// A transaction holds the lock from Begin to its Commit or Rollback, so the writes of the tenant wait for it: a goroutine
+// with a transaction open must write through the transaction, not through the TenantDatabase.
+// The count lives in the process: two processes on the same real database count on their own, and can go over the quota together.
+// Without a quota, the writes go straight to the Database.
+
+// ErrInvalidTenant is returned by ForTenant for a tenant name that is empty or contains a "/".
+var ErrInvalidTenant = errors.New("invalid tenant name")
+
+// ErrQuotaExceeded is returned by a write that would take a tenant over its quota.
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// TenantPrefix returns the prefix of the keys of tenant in the underlying Database.
+func TenantPrefix(tenant string) string {
+	return "tenant/" + tenant + "/"
+}
+
+type TenantOption func(*tenantConfig)
+
+type tenantConfig struct {
+	maxKeys int
+}
+
+// WithTenantQuota limits the tenant to maxKeys keys; 0 means no limit.
+func WithTenantQuota(maxKeys int) TenantOption {
+	return func(c *tenantConfig) {
+		c.maxKeys = maxKeys
+	}
+}
+
+// TenantDatabase is a Database scoped to one tenant. It is safe for concurrent use, like the Database it wraps.
+type TenantDatabase struct {
+	db      Database
+	tenant  string
+	prefix  string
+	maxKeys int
+	// shared is the count of the keys of the tenant, with a quota
+	shared *tenantQuota
+}
+
+// tenantQuota is the count of the keys of a tenant, shared by the TenantDatabases of the tenant on one Database.
+type tenantQuota struct {
+	// mu makes the writes of the tenant that add or remove keys run one at a time
+	mu sync.Mutex
+	// count is the number of keys of the tenant, once counted
+	count   int
+	counted bool
+	// handles is the number of TenantDatabases sharing the count; the last one to be garbage collected removes it from quotas
+	handles int
+}
+
+// add accounts for n keys added, or removed if n is negative. The caller holds q.mu.
+func (q *tenantQuota) add(n int) {
+	if q.counted {
+		q.count += n
+	}
+}
+
+type quotaKey struct {
+	db     Database
+	tenant string
+}
+
+// quotas holds the counts of the tenants with a quota, by Database and tenant.
+var quotas = struct {
+	sync.Mutex
+	byTenant map[quotaKey]*tenantQuota
+}{byTenant: make(map[quotaKey]*tenantQuota)}
+
+// shareQuota gives tdb the count of its tenant, and lets the count go with the last TenantDatabase that shares it.
+func shareQuota(tdb *TenantDatabase) {
+	key := quotaKey{db: tdb.db, tenant: tdb.tenant}
+	quotas.Lock()
+	defer quotas.Unlock()
+	q, ok := quotas.byTenant[key]
+	if !ok {
+		q = &tenantQuota{}
+		quotas.byTenant[key] = q
+	}
+	q.handles++
+	tdb.shared = q
+	runtime.SetFinalizer(tdb, func(*TenantDatabase) {
+		quotas.Lock()
+		defer quotas.Unlock()
+		if q.handles--; q.handles == 0 {
+			delete(quotas.byTenant, key)
+		}
+	})
+}
+
+// ForTenant returns the Database of tenant inside db.
+func ForTenant(db Database, tenant string, opts ...TenantOption) (*TenantDatabase, error) {
+	if tenant == "" || strings.Contains(tenant, "/") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTenant, tenant)
+	}
+	var config tenantConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	tdb := &TenantDatabase{db: db, tenant: tenant, prefix: TenantPrefix(tenant), maxKeys: config.maxKeys}
+	if tdb.maxKeys > 0 {
+		shareQuota(tdb)
+	}
+	return tdb, nil
+}
+
+// Tenant returns the name of the tenant.
+func (tdb *TenantDatabase) Tenant() string {
+	return tdb.tenant
+}
+
+func (tdb *TenantDatabase) key(key string) string {
+	return tdb.prefix + key
+}
+
+// lock takes the lock of the count of the tenant, if it has a quota, and returns the function that releases it.
+func (tdb *TenantDatabase) lock() func() {
+	if tdb.maxKeys <= 0 {
+		return func() {}
+	}
+	tdb.shared.mu.Lock()
+	return tdb.shared.mu.Unlock
+}
+
+// quota runs write if saving keys keeps the tenant within its quota; the keys that don't exist yet count against it.
+func (tdb *TenantDatabase) quota(ctx context.Context, keys []string, write func() error) error {
+	if tdb.maxKeys <= 0 {
+		return write()
+	}
+	defer tdb.lock()()
+	existing, err := tdb.GetMany(ctx, keys)
+	if err != nil {
+		return err
+	}
+	added := make(map[string]bool)
+	for _, key := range keys {
+		if _, exists := existing[key]; !exists {
+			added[key] = true
+		}
+	}
+	if err := tdb.admit(ctx, len(added)); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	tdb.shared.add(len(added))
+	return nil
+}
+
+// admit checks that n more keys fit in the quota, counting the keys of the tenant if the count is unknown or says they don't.
+// The caller holds the lock of the count.
+func (tdb *TenantDatabase) admit(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	q := tdb.shared
+	if !q.counted || q.count+n > tdb.maxKeys {
+		count, err := tdb.Len(ctx)
+		if err != nil {
+			return err
+		}
+		q.count, q.counted = count, true
+	}
+	if q.count+n > tdb.maxKeys {
+		return fmt.Errorf("%w: tenant %q has %d keys, the write adds %d, but the quota is %d",
+			ErrQuotaExceeded, tdb.tenant, q.count, n, tdb.maxKeys)
+	}
+	return nil
+}
+
+func (tdb *TenantDatabase) Save(ctx context.Context, key, value string) error {
+	return tdb.quota(ctx, []string{key}, func() error {
+		return tdb.db.Save(ctx, tdb.key(key), value)
+	})
+}
+
+func (tdb *TenantDatabase) Get(ctx context.Context, key string) (string, bool, error) {
+	return tdb.db.Get(ctx, tdb.key(key))
+}
+
+func (tdb *TenantDatabase) Delete(ctx context.Context, key string) (bool, error) {
+	defer tdb.lock()()
+	deleted, err := tdb.db.Delete(ctx, tdb.key(key))
+	if deleted && tdb.maxKeys > 0 {
+		tdb.shared.add(-1)
+	}
+	return deleted, err
+}
+
+func (tdb *TenantDatabase) Exists(ctx context.Context, key string) (bool, error) {
+	return tdb.db.Exists(ctx, tdb.key(key))
+}
+
+// Len counts the keys of the tenant, with a scan of them.
+func (tdb *TenantDatabase) Len(ctx context.Context) (int, error) {
+	n := 0
+	for _, err := range Entries(ctx, tdb.db, ScanOptions{Prefix: tdb.prefix}) {
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Scan reads a page of the keys of the tenant. Its cursors carry the keys of the tenant, not the keys underneath.
+func (tdb *TenantDatabase) Scan(ctx context.Context, opts ScanOptions) (ScanPage, error) {
+	inner := ScanOptions{Prefix: tdb.prefix + opts.Prefix, Limit: opts.Limit}
+	if opts.Start != "" {
+		inner.Start = tdb.key(opts.Start)
+	}
+	if opts.End != "" {
+		inner.End = tdb.key(opts.End)
+	}
+	after, hasAfter, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	if hasAfter {
+		inner.Cursor = encodeCursor(tdb.key(after))
+	}
+	page, err := tdb.db.Scan(ctx, inner)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	for i := range page.Entries {
+		page.Entries[i].Key = page.Entries[i].Key[len(tdb.prefix):]
+	}
+	if page.Cursor != "" {
+		page.Cursor = encodeCursor(page.Entries[len(page.Entries)-1].Key)
+	}
+	return page, nil
+}
+
+func (tdb *TenantDatabase) All(ctx context.Context) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		for entry, err := range Entries(ctx, tdb.db, ScanOptions{Prefix: tdb.prefix}) {
+			if err != nil {
+				yield(Entry{}, err)
+				return
+			}
+			if !yield(Entry{Key: entry.Key[len(tdb.prefix):], Value: entry.Value}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (tdb *TenantDatabase) SaveWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	return tdb.quota(ctx, []string{key}, func() error {
+		return tdb.db.SaveWithTTL(ctx, tdb.key(key), value, ttl)
+	})
+}
+
+func (tdb *TenantDatabase) GetVersion(ctx context.Context, key string) (string, uint64, error) {
+	return tdb.db.GetVersion(ctx, tdb.key(key))
+}
+
+func (tdb *TenantDatabase) CompareAndSwap(ctx context.Context, key string, version uint64, value string) (newVersion uint64, err error) {
+	err = tdb.quota(ctx, []string{key}, func() error {
+		newVersion, err = tdb.db.CompareAndSwap(ctx, tdb.key(key), version, value)
+		return err
+	})
+	return newVersion, err
+}
+
+func (tdb *TenantDatabase) CompareAndDelete(ctx context.Context, key string, version uint64) error {
+	defer tdb.lock()()
+	err := tdb.db.CompareAndDelete(ctx, tdb.key(key), version)
+	if err == nil && version != 0 && tdb.maxKeys > 0 {
+		tdb.shared.add(-1)
+	}
+	return err
+}
+
+func (tdb *TenantDatabase) SaveMany(ctx context.Context, entries []Entry) error {
+	keys := make([]string, len(entries))
+	inner := make([]Entry, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+		inner[i] = Entry{Key: tdb.key(entry.Key), Value: entry.Value}
+	}
+	return tdb.quota(ctx, keys, func() error {
+		return tdb.db.SaveMany(ctx, inner)
+	})
+}
+
+func (tdb *TenantDatabase) GetMany(ctx context.Context, keys []string) (map[string]string, error) {
+	inner := make([]string, len(keys))
+	for i, key := range keys {
+		inner[i] = tdb.key(key)
+	}
+	values, err := tdb.db.GetMany(ctx, inner)
+	if err != nil {
+		return nil, err
+	}
+	scoped := make(map[string]string, len(values))
+	for key, value := range values {
+		scoped[key[len(tdb.prefix):]] = value
+	}
+	return scoped, nil
+}
+
+// DeleteAll deletes every key of the tenant in one transaction, and returns how many there were.
+func (tdb *TenantDatabase) DeleteAll(ctx context.Context) (int, error) {
+	defer tdb.lock()()
+	var keys []string
+	for entry, err := range Entries(ctx, tdb.db, ScanOptions{Prefix: tdb.prefix}) {
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, entry.Key)
+	}
+	err := WithTx(ctx, tdb.db, func(tx Tx) error {
+		for _, key := range keys {
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("deleting tenant %q: %w", tdb.tenant, err)
+	}
+	if tdb.maxKeys > 0 {
+		tdb.shared.count, tdb.shared.counted = 0, true
+	}
+	return len(keys), nil
+}
+
+// Begin takes the lock of the count of the tenant, with a quota, before the transaction underneath begins:
+// the transaction of a real database holds its write lock from Begin, and the writes of the tenant take the two locks in that order too.
+func (tdb *TenantDatabase) Begin(ctx context.Context) (Tx, error) {
+	unlock := tdb.lock()
+	tx, err := tdb.db.Begin(ctx)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return &tenantTx{ctx: ctx, tx: tx, tdb: tdb, unlock: sync.OnceFunc(unlock), existed: make(map[string]bool), saved: make(map[string]bool)}, nil
+}
+
+// tenantTx scopes a transaction to the tenant. With a quota, it holds the lock of the count until it ends,
+// keeps track of the keys it adds and removes, and its Commit checks the quota like a write of the TenantDatabase does.
+type tenantTx struct {
+	ctx    context.Context
+	tx     Tx
+	tdb    *TenantDatabase
+	unlock func()
+	// existed says whether every key the transaction writes existed when it was first written; saved, whether it exists now
+	existed, saved map[string]bool
+}
+
+func (tx *tenantTx) Get(key string) (string, bool, error) {
+	return tx.tx.Get(tx.tdb.key(key))
+}
+
+// written records a write of key, for the quota.
+func (tx *tenantTx) written(key string, saved bool) error {
+	if tx.tdb.maxKeys <= 0 {
+		return nil
+	}
+	if _, seen := tx.existed[key]; !seen {
+		_, exists, err := tx.tx.Get(tx.tdb.key(key))
+		if err != nil {
+			return err
+		}
+		tx.existed[key] = exists
+	}
+	tx.saved[key] = saved
+	return nil
+}
+
+func (tx *tenantTx) Save(key, value string) error {
+	if err := tx.written(key, true); err != nil {
+		return err
+	}
+	return tx.tx.Save(tx.tdb.key(key), value)
+}
+
+func (tx *tenantTx) Delete(key string) (bool, error) {
+	if err := tx.written(key, false); err != nil {
+		return false, err
+	}
+	return tx.tx.Delete(tx.tdb.key(key))
+}
+
+func (tx *tenantTx) Commit() error {
+	defer tx.unlock()
+	if tx.tdb.maxKeys <= 0 {
+		return tx.tx.Commit()
+	}
+	added := 0
+	for key, saved := range tx.saved {
+		switch {
+		case saved && !tx.existed[key]:
+			added++
+		case !saved && tx.existed[key]:
+			added--
+		}
+	}
+	if err := tx.tdb.admit(tx.ctx, added); err != nil {
+		tx.tx.Rollback()
+		return err
+	}
+	if err := tx.tx.Commit(); err != nil {
+		return err
+	}
+	tx.tdb.shared.add(added)
+	return nil
+}
+
+func (tx *tenantTx) Rollback() error {
+	defer tx.unlock()
+	return tx.tx.Rollback()
+}
+
+// TenantLeaks returns every key of db that isn't under the prefix of one of the tenants, in key order:
+// the keys the code under test wrote outside of the tenants it was allowed to write to.
+func TenantLeaks(db *FakeDatabase, tenants ...string) []Entry {
+	return db.entries(func(key string) bool {
+		for _, tenant := range tenants {
+			if strings.HasPrefix(key, TenantPrefix(tenant)) {
+				return false
+			}
+		}
+		return true
+	})
+}
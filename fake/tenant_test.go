@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Tenants: one Database shared by several tenants.
+// ----------------------------------------------------------------------------
+
+func newTenant(t *testing.T, db Database, tenant string, opts ...TenantOption) *TenantDatabase {
+	t.Helper()
+	tenantDB, err := ForTenant(db, tenant, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return tenantDB
+}
+
+// AssertTenantIsolation fails the test for every key of db that isn't under the prefix of one of the tenants (see TenantLeaks).
+func AssertTenantIsolation(t testing.TB, db *FakeDatabase, tenants ...string) {
+	t.Helper()
+	for _, entry := range TenantLeaks(db, tenants...) {
+		t.Errorf("key %q is outside of the tenants %q: %.40q", entry.Key, tenants, entry.Value)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	ctx := context.Background()
+
+	// "isolation":
+	// two tenants use the same keys without seeing each other's values.
+	t.Run("isolation", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		acme, globex := newTenant(t, fakeDB, "acme"), newTenant(t, fakeDB, "globex")
+		SaveUserData(ctx, acme, "user1", "acme data")
+		SaveUserData(ctx, globex, "user1", "globex data")
+		SaveUserData(ctx, globex, "user2", "globex data 2")
+
+		if data, _, _ := GetUserData(ctx, acme, "user1"); data != "acme data" {
+			t.Errorf("expected acme data, but got: %q", data)
+		}
+		if exists, _ := acme.Exists(ctx, "user2"); exists {
+			t.Errorf("expected acme not to see user2 of globex")
+		}
+		if users, _ := ListUsers(ctx, globex); !slices.Equal(users, []string{"user1", "user2"}) {
+			t.Errorf("expected the users of globex, but got: %v", users)
+		}
+		AssertState(t, fakeDB, State{
+			"tenant/acme/user1":   "acme data",
+			"tenant/globex/user1": "globex data",
+			"tenant/globex/user2": "globex data 2",
+		})
+		AssertTenantIsolation(t, fakeDB, "acme", "globex")
+	})
+
+	// "invalid names":
+	// a name with a "/" could make one tenant's prefix the start of another's.
+	t.Run("invalid names", func(t *testing.T) {
+		for _, name := range []string{"", "acme/eu", "/"} {
+			if _, err := ForTenant(NewFakeDatabase(), name); !errors.Is(err, ErrInvalidTenant) {
+				t.Errorf("%q: expected ErrInvalidTenant, but got: %v", name, err)
+			}
+		}
+	})
+
+	// "prefixes that look alike":
+	// the keys of tenant "a" are not under the prefix of tenant "ab", nor the other way round.
+	t.Run("prefixes that look alike", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		a, ab := newTenant(t, fakeDB, "a"), newTenant(t, fakeDB, "ab")
+		SaveUserData(ctx, a, "b/user1", "data")
+		SaveUserData(ctx, ab, "user1", "data")
+		if n, _ := a.Len(ctx); n != 1 {
+			t.Errorf("expected 1 key in a, but got: %d", n)
+		}
+		if n, _ := ab.Len(ctx); n != 1 {
+			t.Errorf("expected 1 key in ab, but got: %d", n)
+		}
+	})
+
+	// "scan pages":
+	// the pages and cursors of a tenant are the ones a database of its own would give.
+	t.Run("scan pages", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		acme := newTenant(t, fakeDB, "acme")
+		for i := range 5 {
+			SaveUserData(ctx, acme, fmt.Sprint("user", i), "data")
+			SaveUserData(ctx, fakeDB, fmt.Sprint("user", i), "no tenant")
+		}
+		page, err := acme.Scan(ctx, ScanOptions{Start: "user1", Limit: 2})
+		if err != nil || len(page.Entries) != 2 || page.Entries[0].Key != "user1" || page.Cursor != encodeCursor("user2") {
+			t.Fatalf("unexpected page: %+v (error: %v)", page, err)
+		}
+		page, err = acme.Scan(ctx, ScanOptions{Start: "user1", End: "user4", Limit: 2, Cursor: page.Cursor})
+		if err != nil || len(page.Entries) != 1 || page.Entries[0].Key != "user3" || page.Cursor != "" {
+			t.Errorf("unexpected page: %+v (error: %v)", page, err)
+		}
+	})
+
+	// "quota":
+	// a write that would add keys over the quota fails and changes nothing; overwrites and deletes go through.
+	t.Run("quota", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		acme := newTenant(t, fakeDB, "acme", WithTenantQuota(2))
+		SaveUserData(ctx, acme, "user1", "data 1")
+		SaveUserData(ctx, acme, "user2", "data 2")
+		if err := SaveUserData(ctx, acme, "user3", "data 3"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded, but got: %v", err)
+		}
+		if _, err := acme.CompareAndSwap(ctx, "user3", 0, "data 3"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded, but got: %v", err)
+		}
+		err := SaveUserDataBatch(ctx, acme, map[string]string{"user1": "new data", "user3": "data 3"})
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded, but got: %v", err)
+		}
+		if err := SaveUserData(ctx, acme, "user1", "new data"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// the keys of other tenants don't count
+		SaveUserData(ctx, newTenant(t, fakeDB, "globex"), "user3", "data")
+		DeleteUserData(ctx, acme, "user2")
+		if err := SaveUserData(ctx, acme, "user3", "data 3"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		AssertState(t, acme, State{"user1": "new data", "user3": "data 3"})
+	})
+
+	// "quota in transactions":
+	// a commit counts the keys it adds and the keys it deletes.
+	t.Run("quota in transactions", func(t *testing.T) {
+		acme := newTenant(t, NewFakeDatabase(), "acme", WithTenantQuota(2))
+		SaveUserData(ctx, acme, "user1", "data 1")
+		err := SaveUserRecords(ctx, acme, map[string]string{"user2": "data 2", "user3": "data 3"})
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded, but got: %v", err)
+		}
+		AssertState(t, acme, State{"user1": "data 1"})
+		err = WithTx(ctx, acme, func(tx Tx) error {
+			tx.Delete("user1")
+			tx.Save("user2", "data 2")
+			return tx.Save("user3", "data 3")
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		AssertState(t, acme, State{"user2": "data 2", "user3": "data 3"})
+	})
+
+	// "concurrent writers":
+	// the writers of a TenantDatabase can't go over the quota together.
+	t.Run("concurrent writers", func(t *testing.T) {
+		acme := newTenant(t, NewFakeDatabase(), "acme", WithTenantQuota(10))
+		var wg sync.WaitGroup
+		for g := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 5 {
+					SaveUserData(ctx, acme, fmt.Sprintf("user%d-%d", g, i), "data")
+				}
+			}()
+		}
+		wg.Wait()
+		if n, _ := acme.Len(ctx); n != 10 {
+			t.Errorf("expected 10 keys, but got: %d", n)
+		}
+	})
+
+	// "handles of the same tenant":
+	// two TenantDatabases of the same tenant share its quota: their writers can't go over it together,
+	// and a key deleted through one makes room for the other.
+	t.Run("handles of the same tenant", func(t *testing.T) {
+		// the latency leaves the time for the writes through the two handles to interleave
+		slowDB := newLatencyDatabase(t, NewFakeDatabase(), 1, WithDefaultLatency(FixedLatency(time.Millisecond)))
+		handles := []*TenantDatabase{newTenant(t, slowDB, "acme", WithTenantQuota(9)), newTenant(t, slowDB, "acme", WithTenantQuota(9))}
+		var wg sync.WaitGroup
+		for g := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 5 {
+					SaveUserData(ctx, handles[g%2], fmt.Sprintf("user%d-%d", g, i), "data")
+				}
+			}()
+		}
+		wg.Wait()
+		if n, _ := handles[0].Len(ctx); n != 9 {
+			t.Fatalf("expected 9 keys, but got: %d", n)
+		}
+		page, _ := handles[0].Scan(ctx, ScanOptions{Limit: 1})
+		DeleteUserData(ctx, handles[0], page.Entries[0].Key)
+		if err := SaveUserData(ctx, handles[1], "user9", "data"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := SaveUserData(ctx, handles[1], "user10", "data"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded, but got: %v", err)
+		}
+	})
+
+	// "saves and commits over the real database":
+	// the saves and the transactions of a tenant with a quota don't wait for each other's locks, on a database that locks on Begin.
+	t.Run("saves and commits over the real database", func(t *testing.T) {
+		acme := newTenant(t, openRealDatabase(t), "acme", WithTenantQuota(1000))
+		errs := make(chan error, 40)
+		var wg sync.WaitGroup
+		for g := range 4 {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := range 5 {
+					errs <- SaveUserData(ctx, acme, fmt.Sprintf("saved%d-%d", g, i), "data")
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := range 5 {
+					errs <- WithTx(ctx, acme, func(tx Tx) error {
+						return tx.Save(fmt.Sprintf("committed%d-%d", g, i), "data")
+					})
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if n, _ := acme.Len(ctx); n != 40 {
+			t.Errorf("expected 40 keys, but got: %d", n)
+		}
+	})
+
+	// "quota after expiry":
+	// the keys that expired don't count against the quota any more.
+	t.Run("quota after expiry", func(t *testing.T) {
+		clock := NewManualClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+		acme := newTenant(t, NewFakeDatabase(WithClock(clock)), "acme", WithTenantQuota(2))
+		acme.SaveWithTTL(ctx, "session1", "token 1", time.Minute)
+		acme.SaveWithTTL(ctx, "session2", "token 2", time.Minute)
+		if err := SaveUserData(ctx, acme, "user1", "data 1"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded, but got: %v", err)
+		}
+		clock.Advance(time.Minute)
+		if err := SaveUserData(ctx, acme, "user1", "data 1"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	// "delete all":
+	// DeleteAll deletes the keys of the tenant, and only those.
+	t.Run("delete all", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		acme, globex := newTenant(t, fakeDB, "acme"), newTenant(t, fakeDB, "globex")
+		SaveUserData(ctx, acme, "user1", "data 1")
+		SaveUserData(ctx, acme, "user2", "data 2")
+		SaveUserData(ctx, globex, "user1", "data")
+		if n, err := acme.DeleteAll(ctx); err != nil || n != 2 {
+			t.Errorf("expected 2 keys deleted, but got: %d (error: %v)", n, err)
+		}
+		AssertState(t, fakeDB, State{"tenant/globex/user1": "data"})
+	})
+
+	// "leaks":
+	// AssertTenantIsolation reports the keys written outside of the allowed tenants.
+	t.Run("leaks", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, newTenant(t, fakeDB, "acme"), "user1", "data")
+		SaveUserData(ctx, newTenant(t, fakeDB, "globex"), "user1", "data")
+		SaveUserData(ctx, fakeDB, "user1", "leaked")
+		r := &recordingT{TB: t}
+		AssertTenantIsolation(r, fakeDB, "acme")
+		if len(r.errors) != 2 || !slices.ContainsFunc(r.errors, func(e string) bool { return strings.HasPrefix(e, `key "user1" is`) }) {
+			t.Errorf("expected the keys of globex and of no tenant to be reported, but got: %q", r.errors)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Key expiry (TTL) and a clock that tests can control.
+// ----------------------------------------------------------------------------
+
+// SaveWithTTL saves a key that expires once its time-to-live has passed: from then on it reads as missing.
+// Saving the key again (with Save, SaveWithTTL or in a transaction) replaces the old expiry time.
+
+// The fake expires keys in two ways, like Redis does:
+//   - lazily: a read that finds an expired key treats it as missing and removes it on the spot;
+//   - actively: with WithActiveExpiry, a background janitor purges all expired keys at a fixed interval.
+// PurgeExpired runs the same purge on demand, which is what deterministic tests want.
+
+// The fake never calls time.Now directly; it asks its Clock. Tests pass a ManualClock with WithClock
+// and move time forward with Advance, instead of sleeping until a TTL runs out:
+//
+//	clock := NewManualClock(time.Now())
+//	fakeDB := NewFakeDatabase(WithClock(clock))
+//	fakeDB.SaveWithTTL(ctx, "session", "...", time.Minute)
+//	clock.Advance(time.Minute)
+//	// "session" is gone
+
+// ErrInvalidTTL is returned for a TTL that is not positive.
+var ErrInvalidTTL = errors.New("invalid TTL: must be positive")
+
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the wall clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock that only moves when told to. It is safe for concurrent use.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// WithClock makes the fake tell time with clock instead of the wall clock.
+func WithClock(clock Clock) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.clock = clock
+	}
+}
+
+// WithActiveExpiry starts a janitor that purges expired keys every interval (of real time). Close stops it.
+func WithActiveExpiry(interval time.Duration) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.expiryInterval = interval
+	}
+}
+
+func (it item) expired(now time.Time) bool {
+	return !it.expiresAt.IsZero() && !now.Before(it.expiresAt)
+}
+
+// liveVersion is the version of the item, or 0 if it has expired (the version of a missing key).
+func (it item) liveVersion(now time.Time) uint64 {
+	if it.expired(now) {
+		return 0
+	}
+	return it.version
+}
+
+func (db *FakeDatabase) SaveWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("saving %q: %w", key, ErrInvalidTTL)
+	}
+	return db.save(ctx, key, value, db.clock.Now().Add(ttl))
+}
+
+// TTL returns how long key has left to live. ok is false if the key doesn't exist or never expires.
+func (db *FakeDatabase) TTL(ctx context.Context, key string) (ttl time.Duration, ok bool, err error) {
+	defer func() { db.record(Op{Kind: OpGet, Key: key}, "", fmt.Sprint("ttl ", ttl), err) }()
+	if err := db.check(ctx, Op{Kind: OpGet, Key: key}); err != nil {
+		return 0, false, err
+	}
+	it, exists := db.live(key)
+	if !exists || it.expiresAt.IsZero() {
+		return 0, false, nil
+	}
+	return it.expiresAt.Sub(db.clock.Now()), true, nil
+}
+
+// Expire gives an existing key ttl left to live, and reports whether the key exists.
+func (db *FakeDatabase) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("expiring %q: %w", key, ErrInvalidTTL)
+	}
+	for {
+		value, version, err := db.GetVersion(ctx, key)
+		if err != nil || version == 0 {
+			return false, err
+		}
+		// a write in between is retried at once: unlike Update, nothing is computed from the value
+		if _, err = db.saveIf(ctx, key, value, db.clock.Now().Add(ttl), version); !errors.Is(err, ErrVersionConflict) {
+			return err == nil, err
+		}
+	}
+}
+
+// live returns the item stored under key, unless it is missing or expired.
+// An expired item is removed right away (lazy expiry).
+func (db *FakeDatabase) live(key string) (item, bool) {
+	s := db.shardFor(key)
+	s.mu.RLock()
+	it, exists := s.data[key]
+	s.mu.RUnlock()
+	if !exists {
+		return item{}, false
+	}
+	now := db.clock.Now()
+	if !it.expired(now) {
+		if db.evictor != nil {
+			db.evictor.touch(key)
+		}
+		return it, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// somebody may have saved the key again between the two locks
+	if current, exists := s.data[key]; exists && current.expired(now) {
+		// a purge has no seq of its own (see snapshot.go)
+		db.retain(s, key, db.seq.Load()+1)
+		delete(s.data, key)
+		db.forget(key)
+	}
+	return item{}, false
+}
+
+// PurgeExpired removes every expired key now and returns how many there were.
+func (db *FakeDatabase) PurgeExpired() int {
+	now := db.clock.Now()
+	purged := 0
+	for _, s := range db.shards {
+		s.mu.Lock()
+		for key, it := range s.data {
+			if it.expired(now) {
+				db.retain(s, key, db.seq.Load()+1)
+				delete(s.data, key)
+				db.forget(key)
+				purged++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return purged
+}
+
+// janitor calls PurgeExpired on a timer until it is stopped.
+type janitor struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func startJanitor(db *FakeDatabase, interval time.Duration) *janitor {
+	j := &janitor{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.PurgeExpired()
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+	return j
+}
+
+func (j *janitor) Stop() {
+	j.once.Do(func() { close(j.stop) })
+	<-j.done
+}
+
+// Close stops the background work of the fake, ends its watches (see watch.go), and syncs and closes its log if it has one (see wal.go).
+// The fake must not be used afterwards.
+func (db *FakeDatabase) Close() error {
+	if db.janitor != nil {
+		db.janitor.Stop()
+	}
+	if db.feed != nil {
+		db.feed.close()
+	}
+	if db.wal != nil {
+		return db.wal.close()
+	}
+	return nil
+}
+
+// SaveUserDataWithTTL saves the data of a user that expires after ttl, like a session or a token.
+func SaveUserDataWithTTL(ctx context.Context, db Database, userID, userData string, ttl time.Duration) error {
+	return db.SaveWithTTL(ctx, userID, userData, ttl)
+}
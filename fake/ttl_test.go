@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Key expiry in the fake database, driven by a manual clock.
+// ----------------------------------------------------------------------------
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// "user data expires":
+	// GetUserData returns the record until its TTL has passed, and nothing afterwards.
+	t.Run("user data expires", func(t *testing.T) {
+		clock := NewManualClock(start)
+		fakeDB := NewFakeDatabase(WithClock(clock))
+		if err := SaveUserDataWithTTL(ctx, fakeDB, "session1", "token", 30*time.Minute); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		clock.Advance(30*time.Minute - time.Second)
+		if data, exists, _ := GetUserData(ctx, fakeDB, "session1"); !exists || data != "token" {
+			t.Errorf("expected the session just before its TTL, but got: %q (exists: %v)", data, exists)
+		}
+		if ttl, ok, _ := fakeDB.TTL(ctx, "session1"); !ok || ttl != time.Second {
+			t.Errorf("expected 1s left to live, but got: %v (ok: %v)", ttl, ok)
+		}
+
+		clock.Advance(time.Second)
+		if _, exists, _ := GetUserData(ctx, fakeDB, "session1"); exists {
+			t.Errorf("expected the session to be gone once its TTL has passed")
+		}
+		if users, _ := ListUsers(ctx, fakeDB); len(users) != 0 {
+			t.Errorf("expected no users, but got: %v", users)
+		}
+	})
+
+	// "save replaces the ttl":
+	// saving an expiring key again without a TTL makes it permanent.
+	t.Run("save replaces the ttl", func(t *testing.T) {
+		clock := NewManualClock(start)
+		fakeDB := NewFakeDatabase(WithClock(clock))
+		SaveUserDataWithTTL(ctx, fakeDB, "user1", "data", time.Minute)
+		SaveUserData(ctx, fakeDB, "user1", "data")
+		clock.Advance(time.Hour)
+		if exists, _ := fakeDB.Exists(ctx, "user1"); !exists {
+			t.Errorf("expected user1 to be permanent")
+		}
+		if _, ok, _ := fakeDB.TTL(ctx, "user1"); ok {
+			t.Errorf("expected no TTL on user1")
+		}
+	})
+
+	// "expire":
+	// Expire sets the TTL of an existing key and keeps its value; a missing key is not created.
+	t.Run("expire", func(t *testing.T) {
+		clock := NewManualClock(start)
+		fakeDB := NewFakeDatabase(WithClock(clock))
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		if found, err := fakeDB.Expire(ctx, "user1", time.Minute); err != nil || !found {
+			t.Errorf("expected user1 to be found, but got: %v, %v", found, err)
+		}
+		if found, err := fakeDB.Expire(ctx, "missing", time.Minute); err != nil || found {
+			t.Errorf("expected no missing key, but got: %v, %v", found, err)
+		}
+		if ttl, ok, _ := fakeDB.TTL(ctx, "user1"); !ok || ttl != time.Minute {
+			t.Errorf("expected a TTL of 1m, but got: %v", ttl)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "data 1" {
+			t.Errorf("expected the value to be kept, but got: %q", data)
+		}
+		if _, err := fakeDB.Expire(ctx, "user1", 0); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("expected ErrInvalidTTL, but got: %v", err)
+		}
+		clock.Advance(time.Minute)
+		if exists, _ := fakeDB.Exists(ctx, "user1"); exists {
+			t.Errorf("expected user1 to expire")
+		}
+	})
+
+	// "lazy and active expiry":
+	// expired keys stay in the maps until they are read or purged.
+	t.Run("lazy and active expiry", func(t *testing.T) {
+		clock := NewManualClock(start)
+		fakeDB := NewFakeDatabase(WithClock(clock))
+		for _, key := range []string{"a", "b", "c"} {
+			SaveUserDataWithTTL(ctx, fakeDB, key, "data", time.Minute)
+		}
+		SaveUserData(ctx, fakeDB, "permanent", "data")
+		clock.Advance(time.Minute)
+
+		// lazy: reading "a" removes it, so only "b" and "c" are left to purge
+		GetUserData(ctx, fakeDB, "a")
+		if purged := fakeDB.PurgeExpired(); purged != 2 {
+			t.Errorf("expected 2 keys to be purged, but got: %d", purged)
+		}
+		if n, _ := fakeDB.Len(ctx); n != 1 {
+			t.Errorf("expected 1 key left, but got: %d", n)
+		}
+	})
+
+	// "background janitor":
+	// with WithActiveExpiry the expired keys disappear without anybody reading them.
+	t.Run("background janitor", func(t *testing.T) {
+		clock := NewManualClock(start)
+		fakeDB := NewFakeDatabase(WithClock(clock), WithActiveExpiry(time.Millisecond))
+		defer fakeDB.Close()
+		SaveUserDataWithTTL(ctx, fakeDB, "session1", "token", time.Minute)
+		clock.Advance(time.Minute)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for fakeDB.shardFor("session1").len() > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the janitor to purge the expired key")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	// "deleting an expired key":
+	// a key that expired but wasn't purged yet is already missing: deleting it writes nothing, and the change feed doesn't see it.
+	t.Run("deleting an expired key", func(t *testing.T) {
+		clock := NewManualClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+		fakeDB := NewFakeDatabase(WithClock(clock), WithChangeFeed(100, 0), WithJournal())
+		SaveUserDataWithTTL(ctx, fakeDB, "session", "token", time.Minute)
+		clock.Advance(time.Minute)
+		seq := fakeDB.Seq()
+		if deleted, err := fakeDB.Delete(ctx, "session"); deleted || err != nil {
+			t.Errorf("expected the delete to find nothing, but got: %v (error: %v)", deleted, err)
+		}
+		if fakeDB.Seq() != seq {
+			t.Errorf("expected no new version, but the seq went from %d to %d", seq, fakeDB.Seq())
+		}
+		entries := fakeDB.Journal().Entries()
+		if last := entries[len(entries)-1]; last.Op != OpDelete || last.Result != "missing" {
+			t.Errorf("expected a delete of a missing key in the journal, but got: %+v", last)
+		}
+		if n := fakeDB.shardFor("session").len(); n != 0 {
+			t.Errorf("expected the expired key to be purged, but the shard holds %d keys", n)
+		}
+	})
+
+	// "invalid ttl":
+	// a TTL must be positive.
+	t.Run("invalid ttl", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		if err := SaveUserDataWithTTL(ctx, fakeDB, "user1", "data", 0); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("expected ErrInvalidTTL, but got: %v", err)
+		}
+	})
+}
+
+// len returns the number of items in the shard, expired or not.
+func (s *shard) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.data)
+}
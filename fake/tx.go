@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Transactions: all-or-nothing writes over several keys.
+// ----------------------------------------------------------------------------
+
+// Begin starts a transaction. Reads inside the transaction see the database as it was when the transaction began,
+// plus the transaction's own writes (read-your-own-writes). Writes are buffered and only become visible to others on Commit.
+// Rollback throws them away.
+
+// Concurrent transactions are isolated from each other by snapshot isolation:
+// a transaction never sees writes committed after it began, and if two transactions write the same key,
+// the first one to commit wins and the second one's Commit fails with ErrTxConflict (first-committer-wins).
+
+// WithTx wraps the Begin/Commit/Rollback dance for the common case:
+//
+//	err := WithTx(ctx, db, func(tx Tx) error {
+//		if err := tx.Save("user1", "..."); err != nil {
+//			return err
+//		}
+//		return tx.Save("user2", "...")
+//	})
+
+type Tx interface {
+	Get(key string) (string, bool, error)
+	Save(key, value string) error
+	// Delete removes key and reports whether it was there, as seen by the transaction.
+	Delete(key string) (bool, error)
+	// Commit applies all the writes of the transaction at once, or none of them if it returns an error.
+	Commit() error
+	// Rollback discards the writes of the transaction. After Commit it does nothing and returns ErrTxDone.
+	Rollback() error
+}
+
+// A Tx belongs to the context passed to Begin: once that is done, the transaction can't commit any more.
+// A Tx is meant to be used by one goroutine, and not at all after Commit or Rollback.
+
+// ErrTxConflict is returned by Commit when another transaction committed a write to one of the same keys first.
+var ErrTxConflict = errors.New("transaction conflict")
+
+// ErrTxDone is returned when a transaction is used after it was committed or rolled back.
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+
+// WithTx runs fn in a transaction. The transaction is committed if fn returns nil,
+// and rolled back if fn returns an error or panics.
+func WithTx(ctx context.Context, db Database, fn func(tx Tx) error) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// The fake's transactions take a shortcut: Begin copies the whole database into the transaction.
+// That makes the snapshot trivially consistent, at the cost of O(n) per transaction.
+
+// Conflicts are detected with the versions stored next to every value: on Commit, every key the transaction writes
+// must still have the version it had in the snapshot (0 for a key that didn't exist). Otherwise somebody else wrote it in the meantime.
+// Writes in a transaction don't carry a TTL: like Save, they make the key permanent.
+
+type fakeTx struct {
+	ctx      context.Context
+	db       *FakeDatabase
+	snapshot map[string]item
+	// writes holds the buffered writes; a nil value is a delete
+	writes map[string]*string
+	done   bool
+}
+
+func (db *FakeDatabase) Begin(ctx context.Context) (_ Tx, err error) {
+	defer func() { db.record(Op{Kind: OpBegin}, "", "ok", err) }()
+	if err := db.check(ctx, Op{Kind: OpBegin}); err != nil {
+		return nil, err
+	}
+	tx := &fakeTx{
+		ctx:      ctx,
+		db:       db,
+		snapshot: make(map[string]item),
+		writes:   make(map[string]*string),
+	}
+	// holding every shard's read lock at once means no commit is half-way through while we copy
+	for _, s := range db.shards {
+		s.mu.RLock()
+	}
+	for _, s := range db.shards {
+		for key, it := range s.data {
+			tx.snapshot[key] = it
+		}
+	}
+	for _, s := range db.shards {
+		s.mu.RUnlock()
+	}
+	return tx, nil
+}
+
+// usable returns the error for using the transaction now: ErrTxDone, the context's error, or nil.
+func (tx *fakeTx) usable() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.ctx.Err()
+}
+
+func (tx *fakeTx) Get(key string) (value string, exists bool, err error) {
+	if err := tx.usable(); err != nil {
+		return "", false, err
+	}
+	defer func() { tx.db.record(Op{Kind: OpGet, Key: key}, value, found(exists), err) }()
+	if err := tx.db.injectedFault(Op{Kind: OpGet, Key: key}); err != nil {
+		return "", false, err
+	}
+	value, exists = tx.get(key)
+	return value, exists, nil
+}
+
+// get reads key as the transaction sees it: its own writes first, then the snapshot.
+func (tx *fakeTx) get(key string) (string, bool) {
+	if value, written := tx.writes[key]; written {
+		if value == nil {
+			return "", false
+		}
+		return *value, true
+	}
+	it, exists := tx.snapshot[key]
+	if !exists || it.expired(tx.db.clock.Now()) {
+		return "", false
+	}
+	return it.value, true
+}
+
+func (tx *fakeTx) Save(key, value string) error {
+	if err := tx.usable(); err != nil {
+		return err
+	}
+	tx.writes[key] = &value
+	return nil
+}
+
+func (tx *fakeTx) Delete(key string) (bool, error) {
+	if err := tx.usable(); err != nil {
+		return false, err
+	}
+	_, exists := tx.get(key)
+	tx.writes[key] = nil
+	return exists, nil
+}
+
+func (tx *fakeTx) Commit() error {
+	if err := tx.usable(); err != nil {
+		return err
+	}
+	tx.done = true
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	// an expired key counts as missing on both sides, so that purging it in the meantime is not a conflict
+	_, err := tx.db.writeBatch(tx.writes, func(now time.Time) error {
+		for key := range tx.writes {
+			current := tx.db.shardFor(key).data[key]
+			if current.liveVersion(now) != tx.snapshot[key].liveVersion(now) {
+				return fmt.Errorf("%w on key %q", ErrTxConflict, key)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// writeBatch applies writes (nil for a delete) at once, or none of them: the writes of a commit, or of SaveMany (see batch.go).
+// check runs once the shards of the writes are locked, and can still refuse them.
+func (db *FakeDatabase) writeBatch(writes map[string]*string, check func(now time.Time) error) (version uint64, err error) {
+	// the journal sees the batch like the fault plan does, as its writes in key order
+	defer func() {
+		if db.journal == nil {
+			return
+		}
+		for _, key := range slices.Sorted(maps.Keys(writes)) {
+			if value := writes[key]; value == nil {
+				db.record(Op{Kind: OpDelete, Key: key}, "", fmt.Sprint("version ", version), err)
+			} else {
+				db.record(Op{Kind: OpSave, Key: key}, *value, fmt.Sprint("version ", version), err)
+			}
+		}
+	}()
+
+	// the fault plan sees one write per key, and a single failing write fails the whole batch
+	for key, value := range writes {
+		op := Op{Kind: OpSave, Key: key}
+		if value == nil {
+			op.Kind = OpDelete
+		}
+		if err := db.injectedFault(op); err != nil {
+			return 0, err
+		}
+	}
+
+	// lock the shards we write to, always in index order, so that two batches can't deadlock
+	indexes := db.shardIndexes(maps.Keys(writes))
+	if db.evictor != nil {
+		defer db.evict(slices.Collect(maps.Keys(writes))...)
+	}
+	for _, i := range indexes {
+		db.shards[i].mu.Lock()
+	}
+	defer func() {
+		for _, i := range indexes {
+			db.shards[i].mu.Unlock()
+		}
+	}()
+
+	if check != nil {
+		if err := check(db.clock.Now()); err != nil {
+			return 0, err
+		}
+	}
+	// the whole batch is one record of the log, so recovery replays all of it or none of it,
+	// and its events reach the watchers together, in key order
+	version, err = db.stamp(func() []walOp {
+		var ops []walOp
+		for _, key := range slices.Sorted(maps.Keys(writes)) {
+			value := writes[key]
+			if value == nil {
+				ops = append(ops, walOp{deleted: true, key: key})
+			} else {
+				ops = append(ops, walOp{key: key, value: *value})
+			}
+		}
+		return ops
+	})
+	if err != nil {
+		return 0, err
+	}
+	for key, value := range writes {
+		s := db.shardFor(key)
+		db.retain(s, key, version)
+		if value == nil {
+			delete(s.data, key)
+		} else {
+			s.data[key] = item{value: *value, version: version}
+		}
+	}
+	return version, nil
+}
+
+// shardIndexes returns the positions of the shards that own keys, sorted and without duplicates.
+func (db *FakeDatabase) shardIndexes(keys iter.Seq[string]) []int {
+	var indexes []int
+	for key := range keys {
+		indexes = append(indexes, db.shardIndex(key))
+	}
+	slices.Sort(indexes)
+	return slices.Compact(indexes)
+}
+
+func (tx *fakeTx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return nil
+}
+
+// SaveUserRecords saves the data of several users at once: either all of them are saved, or none are.
+func SaveUserRecords(ctx context.Context, db Database, records map[string]string) error {
+	return WithTx(ctx, db, func(tx Tx) error {
+		for userID, userData := range records {
+			if err := tx.Save(userID, userData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
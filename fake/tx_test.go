@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------
+// Transactions on the fake database.
+// ----------------------------------------------------------------------------
+
+func TestTransactions(t *testing.T) {
+	ctx := context.Background()
+
+	// "commit and rollback":
+	// committed writes become visible together, rolled back writes never do.
+	t.Run("commit and rollback", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, fakeDB, "user1", "old data")
+
+		tx, err := fakeDB.Begin(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tx.Save("user1", "new data")
+		tx.Save("user2", "more data")
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "old data" {
+			t.Errorf("expected uncommitted writes to be invisible, but got: %s", data)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "new data" {
+			t.Errorf("expected committed data, but got: %s", data)
+		}
+		if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+			t.Errorf("expected ErrTxDone for a second commit, but got: %v", err)
+		}
+
+		tx, _ = fakeDB.Begin(ctx)
+		tx.Delete("user1")
+		tx.Save("user3", "even more data")
+		tx.Rollback()
+		if err := tx.Save("user4", "too late"); !errors.Is(err, ErrTxDone) {
+			t.Errorf("expected ErrTxDone for a save after rollback, but got: %v", err)
+		}
+		user1Exists, _ := fakeDB.Exists(ctx, "user1")
+		user3Exists, _ := fakeDB.Exists(ctx, "user3")
+		if !user1Exists || user3Exists {
+			t.Errorf("expected rolled back writes to be discarded")
+		}
+	})
+
+	// "read your own writes":
+	// inside the transaction, reads see the transaction's own saves and deletes.
+	t.Run("read your own writes", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+
+		tx, _ := fakeDB.Begin(ctx)
+		defer tx.Rollback()
+		tx.Save("user2", "data 2")
+		if data, exists, _ := tx.Get("user2"); !exists || data != "data 2" {
+			t.Errorf("expected the transaction to see its own save, but got: %s (exists: %v)", data, exists)
+		}
+		if existed, _ := tx.Delete("user1"); !existed {
+			t.Errorf("expected user1 to exist before the delete")
+		}
+		if _, exists, _ := tx.Get("user1"); exists {
+			t.Errorf("expected the transaction to see its own delete")
+		}
+	})
+
+	// "snapshot isolation":
+	// a transaction keeps seeing the data as it was when it began,
+	// and of two transactions writing the same key only the first to commit succeeds.
+	t.Run("snapshot isolation", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, fakeDB, "user1", "v1")
+
+		tx1, _ := fakeDB.Begin(ctx)
+		tx2, _ := fakeDB.Begin(ctx)
+		tx2.Save("user1", "v2 from tx2")
+		if err := tx2.Commit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		SaveUserData(ctx, fakeDB, "user9", "written outside any transaction")
+
+		if data, _, _ := tx1.Get("user1"); data != "v1" {
+			t.Errorf("expected tx1 to still see v1, but got: %s", data)
+		}
+		if _, exists, _ := tx1.Get("user9"); exists {
+			t.Errorf("expected tx1 not to see user9")
+		}
+		tx1.Save("user1", "v2 from tx1")
+		if err := tx1.Commit(); !errors.Is(err, ErrTxConflict) {
+			t.Errorf("expected ErrTxConflict, but got: %v", err)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "v2 from tx2" {
+			t.Errorf("expected the first committer to win, but got: %s", data)
+		}
+	})
+
+	// "no lost updates":
+	// concurrent read-modify-write transactions that retry on conflict never lose an increment.
+	t.Run("no lost updates", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, fakeDB, "counter", "0")
+
+		const goroutines, increments = 8, 50
+		var wg sync.WaitGroup
+		for range goroutines {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range increments {
+					for {
+						err := WithTx(ctx, fakeDB, func(tx Tx) error {
+							value, _, err := tx.Get("counter")
+							if err != nil {
+								return err
+							}
+							n, err := strconv.Atoi(value)
+							if err != nil {
+								return err
+							}
+							return tx.Save("counter", strconv.Itoa(n+1))
+						})
+						if err == nil {
+							break
+						}
+						if !errors.Is(err, ErrTxConflict) {
+							t.Errorf("unexpected error: %v", err)
+							return
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if data, _, _ := GetUserData(ctx, fakeDB, "counter"); data != strconv.Itoa(goroutines*increments) {
+			t.Errorf("expected counter %d, but got: %s", goroutines*increments, data)
+		}
+	})
+
+	// "context":
+	// a transaction can't commit once its context is done.
+	t.Run("context", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		txCtx, cancel := context.WithCancel(ctx)
+		tx, _ := fakeDB.Begin(txCtx)
+		tx.Save("user1", "data")
+		cancel()
+		if err := tx.Commit(); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, but got: %v", err)
+		}
+		if exists, _ := fakeDB.Exists(ctx, "user1"); exists {
+			t.Errorf("expected nothing to be committed")
+		}
+	})
+}
+
+func TestSaveUserRecords(t *testing.T) {
+	ctx := context.Background()
+
+	// "all saved":
+	// every record of the batch is saved.
+	t.Run("all saved", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		records := map[string]string{"user1": "data 1", "user2": "data 2", "user3": "data 3"}
+		if err := SaveUserRecords(ctx, fakeDB, records); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for userID, userData := range records {
+			if data, _, _ := GetUserData(ctx, fakeDB, userID); data != userData {
+				t.Errorf("expected user data: %s, but got: %s", userData, data)
+			}
+		}
+	})
+
+	// "none saved":
+	// when WithTx's function fails half-way, nothing it wrote is saved.
+	t.Run("none saved", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		errInvalid := errors.New("invalid user")
+		err := WithTx(ctx, fakeDB, func(tx Tx) error {
+			for i := range 5 {
+				if i == 3 {
+					return errInvalid
+				}
+				tx.Save(fmt.Sprintf("user%d", i), "data")
+			}
+			return nil
+		})
+		if !errors.Is(err, errInvalid) {
+			t.Errorf("expected the function's error, but got: %v", err)
+		}
+		if n, _ := fakeDB.Len(ctx); n != 0 {
+			users, _ := ListUsers(ctx, fakeDB)
+			t.Errorf("expected no users to be saved, but got: %v", users)
+		}
+	})
+}
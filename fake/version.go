@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Optimistic concurrency: versions and compare-and-swap.
+// ----------------------------------------------------------------------------
+
+// Two writers that both read a user, change it and save it back silently overwrite each other: the last save wins.
+// Every stored value has a version instead, which changes on every write to its key and never goes back,
+// not even when the key is deleted and saved again. A missing (or expired) key has version 0.
+//
+// CompareAndSwap saves a value only if the key still has the version the writer read;
+// otherwise somebody else wrote in between, and it fails with ErrVersionConflict:
+//
+//	value, version, err := db.GetVersion(ctx, "user1")
+//	...
+//	_, err = db.CompareAndSwap(ctx, "user1", version, changed(value))
+//	if errors.Is(err, ErrVersionConflict) {
+//		// read again and retry
+//	}
+//
+// A version of 0 creates the key only if it doesn't exist. Update does the read-change-retry loop for you.
+//
+// CompareAndDelete is the same check for a delete: it deletes the key only if it still has the version the caller read,
+// and fails with ErrVersionConflict otherwise. A version of 0 deletes nothing, and only checks that the key is missing.
+
+// Versions are opaque: they can only be compared for equality, and a version of one key means nothing for another.
+// The fake uses the seq of the write (see tx.go), the real database counts the writes to each key.
+
+// ErrVersionConflict is returned by CompareAndSwap and CompareAndDelete when the key doesn't have the expected version any more.
+var ErrVersionConflict = errors.New("version conflict")
+
+// anyVersion is passed to saveIf to save whatever the version of the key; no key ever gets that many writes.
+const anyVersion uint64 = math.MaxUint64
+
+const (
+	// defaultUpdateBackoff is the longest Update waits after its first conflict; it waits up to twice as long after the second, and so on.
+	defaultUpdateBackoff = 100 * time.Microsecond
+	// defaultMaxUpdateBackoff caps the wait, however many conflicts there were.
+	defaultMaxUpdateBackoff = 100 * time.Millisecond
+)
+
+type UpdateOption func(*updateConfig)
+
+type updateConfig struct {
+	maxAttempts         int
+	backoff, maxBackoff time.Duration
+}
+
+// WithMaxAttempts makes Update give up after n attempts; 0, the default, means it tries until its context is done.
+func WithMaxAttempts(n int) UpdateOption {
+	return func(c *updateConfig) {
+		c.maxAttempts = n
+	}
+}
+
+// WithBackoff sets the longest wait after the first conflict, and the longest wait after any conflict.
+func WithBackoff(backoff, maxBackoff time.Duration) UpdateOption {
+	return func(c *updateConfig) {
+		c.backoff, c.maxBackoff = backoff, maxBackoff
+	}
+}
+
+func newUpdateConfig(opts []UpdateOption) updateConfig {
+	config := updateConfig{backoff: defaultUpdateBackoff, maxBackoff: defaultMaxUpdateBackoff}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// retry calls attempt until it returns anything but ErrVersionConflict, waiting between the attempts as config says.
+// what names the operation in the errors of giving up, e.g. `updating "user1"`.
+func (config updateConfig) retry(ctx context.Context, what string, attempt func() error) error {
+	var err error
+	backoff := config.backoff
+	for n := 0; config.maxAttempts <= 0 || n < config.maxAttempts; n++ {
+		if n > 0 && backoff > 0 {
+			if waitErr := sleep(ctx, rand.N(backoff)); waitErr != nil {
+				return fmt.Errorf("%s: %w after %d attempts, the last one: %w", what, waitErr, n, err)
+			}
+			backoff = min(2*backoff, config.maxBackoff)
+		}
+		if err = attempt(); !errors.Is(err, ErrVersionConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("%s: giving up after %d attempts: %w", what, config.maxAttempts, err)
+}
+
+func versionConflict(key string, expected, current uint64) error {
+	return fmt.Errorf("%w on key %q: expected version %d, but it is %d", ErrVersionConflict, key, expected, current)
+}
+
+func (db *FakeDatabase) GetVersion(ctx context.Context, key string) (value string, version uint64, err error) {
+	defer func() { db.record(Op{Kind: OpGet, Key: key}, value, fmt.Sprint("version ", version), err) }()
+	if err := db.check(ctx, Op{Kind: OpGet, Key: key}); err != nil {
+		return "", 0, err
+	}
+	it, _ := db.live(key)
+	return it.value, it.version, nil
+}
+
+// CompareAndSwap saves key without an expiry time, like Save.
+func (db *FakeDatabase) CompareAndSwap(ctx context.Context, key string, version uint64, value string) (uint64, error) {
+	return db.saveIf(ctx, key, value, time.Time{}, version)
+}
+
+// CompareAndDelete deletes key like Delete, if its version is still version.
+func (db *FakeDatabase) CompareAndDelete(ctx context.Context, key string, version uint64) error {
+	_, err := db.deleteIf(ctx, key, version)
+	return err
+}
+
+// Update runs a read-modify-write loop on key: it reads the value, lets fn compute the new one, and saves it with
+// CompareAndSwap. If another writer got there first, it waits a little, reads the new value and calls fn again,
+// until it succeeds or ctx is done; WithMaxAttempts bounds the number of attempts as well.
+// fn may be called several times, so it must not have side effects. Update returns the value it saved.
+//
+// The wait doubles after every conflict, up to the max backoff, and is random ("full jitter"),
+// so that writers that collided once don't collide again. Over a slow database, the round trips leave room for
+// more conflicts: the default backoff starts small, and the cap lets it grow to the latencies of a real network.
+func Update(ctx context.Context, db Database, key string, fn func(value string, exists bool) (string, error), opts ...UpdateOption) (string, error) {
+	var saved string
+	err := newUpdateConfig(opts).retry(ctx, fmt.Sprintf("updating %q", key), func() error {
+		value, version, err := db.GetVersion(ctx, key)
+		if err != nil {
+			return err
+		}
+		if value, err = fn(value, version != 0); err != nil {
+			return err
+		}
+		if _, err = db.CompareAndSwap(ctx, key, version, value); err != nil {
+			return err
+		}
+		saved = value
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return saved, nil
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UpdateUserData changes the data of a user with fn, without losing the changes of concurrent writers.
+func UpdateUserData(ctx context.Context, db Database, userID string, fn func(userData string, exists bool) (string, error)) error {
+	_, err := Update(ctx, db, userID, fn)
+	return err
+}
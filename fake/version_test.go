@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Read-modify-write loops with Update.
+// ----------------------------------------------------------------------------
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+
+	// "gives up":
+	// when every attempt loses the race, Update stops after WithMaxAttempts attempts and reports the conflict.
+	t.Run("gives up", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		calls := 0
+		_, err := Update(ctx, fakeDB, "user1", func(value string, exists bool) (string, error) {
+			calls++
+			// another writer sneaks in between the read and the swap, every time
+			fakeDB.Save(ctx, "user1", "concurrent write")
+			return "my write", nil
+		}, WithMaxAttempts(10))
+		if !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected ErrVersionConflict, but got: %v", err)
+		}
+		if calls != 10 {
+			t.Errorf("expected 10 attempts, but got: %d", calls)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "concurrent write" {
+			t.Errorf("expected the concurrent write to stay, but got: %s", data)
+		}
+	})
+
+	// "errors":
+	// an error of fn, or of the database, ends the loop at once and nothing is saved.
+	t.Run("errors", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		errInvalid := errors.New("invalid user")
+		err := UpdateUserData(ctx, fakeDB, "user1", func(string, bool) (string, error) {
+			return "", errInvalid
+		})
+		if !errors.Is(err, errInvalid) {
+			t.Errorf("expected the function's error, but got: %v", err)
+		}
+
+		fakeDB.InjectFaults(OnlyWrites(FailKeysMatching(regexp.MustCompile(`^user1$`))))
+		err = UpdateUserData(ctx, fakeDB, "user1", func(userData string, exists bool) (string, error) {
+			return userData + " and more", nil
+		})
+		if !errors.Is(err, ErrInjectedFault) {
+			t.Errorf("expected ErrInjectedFault, but got: %v", err)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "data 1" {
+			t.Errorf("expected user data: data 1, but got: %s", data)
+		}
+	})
+
+	// "gives up at the deadline":
+	// without WithMaxAttempts, Update tries until its context is done.
+	t.Run("gives up at the deadline", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		calls := 0
+		_, err := Update(timeout, fakeDB, "user1", func(value string, exists bool) (string, error) {
+			calls++
+			fakeDB.Save(ctx, "user1", "concurrent write")
+			return "my write", nil
+		}, WithBackoff(time.Millisecond, 2*time.Millisecond))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, but got: %v", err)
+		}
+		if calls < 10 {
+			t.Errorf("expected more than 10 attempts in 50ms, but got: %d", calls)
+		}
+	})
+
+	// "concurrent updates over a slow database":
+	// writers that keep colliding over round trips of milliseconds lose no update, and none of them fails.
+	t.Run("concurrent updates over a slow database", func(t *testing.T) {
+		roundTrip := LatencyFunc(func(rng *rand.Rand) time.Duration {
+			return time.Millisecond + time.Duration(rng.Int64N(int64(9*time.Millisecond)))
+		})
+		slowDB := newLatencyDatabase(t, NewFakeDatabase(), 1, WithDefaultLatency(roundTrip))
+		const writers, increments = 16, 5
+		var wg sync.WaitGroup
+		for range writers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range increments {
+					_, err := Update(ctx, slowDB, "counter", func(value string, exists bool) (string, error) {
+						n, _ := strconv.Atoi(value)
+						return strconv.Itoa(n + 1), nil
+					})
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if data, _, _ := GetUserData(ctx, slowDB, "counter"); data != strconv.Itoa(writers*increments) {
+			t.Errorf("expected %d, but got: %s", writers*increments, data)
+		}
+	})
+
+	// "cancelled while backing off":
+	// the wait between attempts ends with the context.
+	t.Run("cancelled while backing off", func(t *testing.T) {
+		fakeDB := NewFakeDatabase()
+		cancelled, cancel := context.WithCancel(ctx)
+		_, err := Update(cancelled, fakeDB, "user1", func(string, bool) (string, error) {
+			fakeDB.Save(ctx, "user1", "concurrent write")
+			cancel()
+			return "my write", nil
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, but got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Durability: a write-ahead log and snapshots on local disk.
+// ----------------------------------------------------------------------------
+
+// NewFakeDatabase keeps everything in memory, so the data is gone when the process exits.
+// OpenFakeDatabase gives the same fake a directory on disk, which is what a local dev server wants: its data survives restarts.
+//
+//	fakeDB, err := OpenFakeDatabase("./data", WithFsync(FsyncPeriodically), WithSnapshotInterval(time.Minute))
+//	if err != nil { ... }
+//	defer fakeDB.Close()
+//
+// The directory holds two files:
+//   - wal, the write-ahead log: every write is appended to it before it changes the maps, and a committed transaction is a single record;
+//   - snapshot: every key as of some write, written to a temporary file and renamed into place, so it is never half-written.
+//
+// Compact writes a new snapshot and drops the log records it covers; WithSnapshotInterval runs it in the background.
+// On startup the snapshot is loaded and the log is replayed on top of it.
+// A crash can leave a torn record at the end of the log: recovery stops at the first record that is incomplete or fails its checksum,
+// and cuts the log there. The writes in and after that record are lost, and nothing else is.
+// Expired keys are not logged when they are purged; they are simply still expired when they are replayed.
+
+// Both files are a sequence of records:
+//
+//	length uint32 | crc32c(payload) uint32 | payload
+//
+// A payload is the seq of the write, the number of keys it writes, and for each key:
+// the kind (put or delete), the key, the value and the expiry time in unix nanoseconds (0 for never).
+// Numbers are varints, and strings are a uvarint length followed by the bytes.
+// The first record of a snapshot writes no keys; its seq is the last write the snapshot includes.
+
+const (
+	walFile      = "wal"
+	snapshotFile = "snapshot"
+	// recordHeaderSize is the size of the length and the checksum in front of every payload
+	recordHeaderSize = 8
+	// maxRecordSize protects recovery from allocating whatever a corrupt length says
+	maxRecordSize = 1 << 30
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// errTornRecord is what recovery finds at the end of the log after a crash
+	errTornRecord = errors.New("torn or corrupt record")
+)
+
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs the log after every write: a write that returned is on disk. It is the slowest policy, and the default.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncPeriodically syncs the log in the background (see WithFsyncInterval): a machine crash loses at most the last interval of writes.
+	FsyncPeriodically
+	// FsyncNever leaves syncing to the operating system: a crash of the process loses nothing, a crash of the machine may.
+	FsyncNever
+)
+
+// defaultFsyncInterval is how often FsyncPeriodically syncs unless WithFsyncInterval says otherwise.
+const defaultFsyncInterval = time.Second
+
+// WithFsync sets when the log of a fake opened with OpenFakeDatabase is synced to disk. NewFakeDatabase ignores it.
+func WithFsync(policy FsyncPolicy) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.fsync = policy
+	}
+}
+
+// WithFsyncInterval sets how often FsyncPeriodically syncs the log.
+func WithFsyncInterval(interval time.Duration) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.fsyncInterval = interval
+	}
+}
+
+// WithSnapshotInterval makes a fake opened with OpenFakeDatabase compact its log every interval. NewFakeDatabase ignores it.
+func WithSnapshotInterval(interval time.Duration) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.snapshotInterval = interval
+	}
+}
+
+// walOp is the write of a single key; a record holds the writes of one Save, Delete or commit.
+type walOp struct {
+	deleted   bool
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+type walRecord struct {
+	seq uint64
+	ops []walOp
+}
+
+const (
+	walPut    byte = 1
+	walDelete byte = 2
+)
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// encode appends the framed record to buf.
+func (r walRecord) encode(buf []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize)...)
+	buf = binary.AppendUvarint(buf, r.seq)
+	buf = binary.AppendUvarint(buf, uint64(len(r.ops)))
+	for _, op := range r.ops {
+		kind, expiresAt := walPut, int64(0)
+		if op.deleted {
+			kind = walDelete
+		}
+		if !op.expiresAt.IsZero() {
+			expiresAt = op.expiresAt.UnixNano()
+		}
+		buf = append(buf, kind)
+		buf = appendString(buf, op.key)
+		buf = appendString(buf, op.value)
+		buf = binary.AppendVarint(buf, expiresAt)
+	}
+	payload := buf[start+recordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, crcTable))
+	return buf
+}
+
+// decodeRecord reads the record at the start of data and returns it with its size in bytes.
+// Anything that is not a complete record with a valid checksum is errTornRecord.
+func decodeRecord(data []byte) (walRecord, int, error) {
+	if len(data) < recordHeaderSize {
+		return walRecord{}, 0, errTornRecord
+	}
+	length := binary.LittleEndian.Uint32(data)
+	if length > maxRecordSize || int(length) > len(data)-recordHeaderSize {
+		return walRecord{}, 0, errTornRecord
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+int(length)]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[4:]) {
+		return walRecord{}, 0, errTornRecord
+	}
+
+	// past the checksum, a payload that doesn't parse was written by a buggy encoder, but it is still reported the same way
+	d := decoder{data: payload, fail: errTornRecord}
+	r := walRecord{seq: d.uvarint()}
+	n := d.uvarint()
+	if n > uint64(len(payload)) {
+		return walRecord{}, 0, errTornRecord
+	}
+	for range n {
+		op := walOp{deleted: d.byte() == walDelete, key: d.string(), value: d.string()}
+		if expiresAt := d.varint(); expiresAt != 0 {
+			op.expiresAt = time.Unix(0, expiresAt)
+		}
+		r.ops = append(r.ops, op)
+	}
+	if d.err != nil || len(d.data) != 0 {
+		return walRecord{}, 0, errTornRecord
+	}
+	return r, recordHeaderSize + int(length), nil
+}
+
+// decoder reads varint-encoded fields, remembering the first error so that the caller checks only once.
+// fail is the error for data that ends too early or doesn't parse.
+type decoder struct {
+	data []byte
+	fail error
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err, d.data = d.fail, nil
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err, d.data = d.fail, nil
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) == 0 {
+		d.err = d.fail
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err, d.data = d.fail, nil
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+// wal is the open log of a persistent fake.
+type wal struct {
+	dir    string
+	policy FsyncPolicy
+
+	mu   sync.Mutex
+	file logFile
+	// size is the length of the log up to the last complete record
+	size  int64
+	dirty bool
+	// broken is set when a failed append couldn't be undone
+	broken error
+
+	// compactMu lets one compaction run at a time
+	compactMu sync.Mutex
+
+	// the background loop syncs and compacts; its first error is returned by Close
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	errOnce sync.Once
+	err     error
+}
+
+// logFile is the part of *os.File the log writes through, so that tests can make it fail.
+type logFile interface {
+	Write(b []byte) (int, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// OpenFakeDatabase opens the fake stored in dir, creating the directory if needed, and recovers the data of the last run.
+// It accepts the options of NewFakeDatabase, plus WithFsync, WithFsyncInterval and WithSnapshotInterval.
+func OpenFakeDatabase(dir string, opts ...FakeDatabaseOption) (*FakeDatabase, error) {
+	config := newFakeConfig(opts)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("opening fake database: %w", err)
+	}
+	db := newFakeDatabase(config)
+	w, err := db.recover(dir)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening fake database in %s: %w", dir, err)
+	}
+	w.policy = config.fsync
+	db.wal = w
+	if err := db.rebuildIndexes(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening fake database in %s: %w", dir, err)
+	}
+	db.rebuildEvictor()
+
+	fsyncInterval := config.fsyncInterval
+	if fsyncInterval <= 0 {
+		fsyncInterval = defaultFsyncInterval
+	}
+	if config.fsync != FsyncPeriodically {
+		fsyncInterval = 0
+	}
+	if fsyncInterval > 0 || config.snapshotInterval > 0 {
+		w.start(db, fsyncInterval, config.snapshotInterval)
+	}
+	return db, nil
+}
+
+// recover loads the snapshot and replays the log of dir into the fake, which nobody else is using yet,
+// and returns the log opened for appending.
+func (db *FakeDatabase) recover(dir string) (*wal, error) {
+	// leftovers of a compaction that crashed half-way
+	os.Remove(filepath.Join(dir, snapshotFile+".tmp"))
+	os.Remove(filepath.Join(dir, walFile+".tmp"))
+
+	var snapshotSeq uint64
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		// the snapshot was renamed into place complete, so unlike the log it can't be torn: any damage is an error
+		for offset := 0; offset < len(data); {
+			r, n, err := decodeRecord(data[offset:])
+			if err != nil {
+				return nil, fmt.Errorf("reading snapshot at offset %d: %w", offset, err)
+			}
+			if offset == 0 {
+				snapshotSeq = r.seq
+			} else {
+				db.apply(r)
+			}
+			offset += n
+		}
+	}
+
+	path := filepath.Join(dir, walFile)
+	data, err = os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	lastSeq := snapshotSeq
+	offset := 0
+	for offset < len(data) {
+		r, n, err := decodeRecord(data[offset:])
+		if err != nil {
+			break
+		}
+		// the snapshot already has the writes up to its seq, if a compaction crashed before it could trim the log
+		if r.seq > snapshotSeq {
+			db.apply(r)
+		}
+		lastSeq = max(lastSeq, r.seq)
+		offset += n
+	}
+	db.seq.Store(lastSeq)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// cut the torn tail off, or the records appended from now on would come after it and never be replayed
+	if offset < len(data) {
+		if err := file.Truncate(int64(offset)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &wal{dir: dir, file: file, size: int64(offset)}, nil
+}
+
+// apply makes the writes of a replayed record.
+func (db *FakeDatabase) apply(r walRecord) {
+	for _, op := range r.ops {
+		s := db.shardFor(op.key)
+		s.mu.Lock()
+		if op.deleted {
+			delete(s.data, op.key)
+		} else {
+			s.data[op.key] = item{value: op.value, version: r.seq, expiresAt: op.expiresAt}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// logWrite appends a write to the log, if the fake has one. It is called with the locks of the written shards held,
+// so that the log has the writes of each key in the order they were made.
+func (db *FakeDatabase) logWrite(r walRecord) error {
+	if db.wal == nil {
+		return nil
+	}
+	return db.wal.append(r)
+}
+
+func (w *wal) append(r walRecord) error {
+	buf := r.encode(nil)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.broken != nil {
+		return fmt.Errorf("log unusable: %w", w.broken)
+	}
+	if _, err := w.file.Write(buf); err != nil {
+		// don't leave a partial record behind: the records after it would be lost on recovery
+		w.discard()
+		return fmt.Errorf("writing log: %w", err)
+	}
+	if w.policy == FsyncAlways {
+		if err := w.file.Sync(); err != nil {
+			// the caller is told the write failed, so it mustn't come back on recovery either
+			w.discard()
+			return fmt.Errorf("syncing log: %w", err)
+		}
+		w.size += int64(len(buf))
+		return nil
+	}
+	w.size += int64(len(buf))
+	w.dirty = true
+	return nil
+}
+
+// discard cuts the log back to its last complete record after a failed append. If it can't, the log may hold a write
+// its caller saw fail, so it takes no more writes.
+func (w *wal) discard() {
+	if err := w.file.Truncate(w.size); err != nil {
+		w.broken = err
+	}
+}
+
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// Compact writes a snapshot of the fake and drops the part of the log it covers. It does nothing for an in-memory fake.
+// Writes carry on while the snapshot is written; they wait only while the keys are copied.
+func (db *FakeDatabase) Compact() error {
+	w := db.wal
+	if w == nil {
+		return nil
+	}
+	w.compactMu.Lock()
+	defer w.compactMu.Unlock()
+
+	// with every shard locked no write is half-way, so the copy has exactly the writes up to seq, and the log has all of them
+	for _, s := range db.shards {
+		s.mu.RLock()
+	}
+	seq := db.seq.Load()
+	now := db.clock.Now()
+	buf := walRecord{seq: seq}.encode(nil)
+	for _, s := range db.shards {
+		for key, it := range s.data {
+			if !it.expired(now) {
+				buf = walRecord{seq: it.version, ops: []walOp{{key: key, value: it.value, expiresAt: it.expiresAt}}}.encode(buf)
+			}
+		}
+	}
+	for _, s := range db.shards {
+		s.mu.RUnlock()
+	}
+
+	if err := writeFileAtomically(filepath.Join(w.dir, snapshotFile), buf); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := w.trim(seq); err != nil {
+		return fmt.Errorf("trimming log: %w", err)
+	}
+	return nil
+}
+
+// trim rewrites the log without the records up to seq. Writes wait for it, but it only copies the records made during the compaction.
+func (w *wal) trim(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	path := filepath.Join(w.dir, walFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data = data[:w.size]
+	var kept []byte
+	for offset := 0; offset < len(data); {
+		r, n, err := decodeRecord(data[offset:])
+		if err != nil {
+			return err
+		}
+		if r.seq > seq {
+			kept = append(kept, data[offset:offset+n]...)
+		}
+		offset += n
+	}
+	if err := writeFileAtomically(path, kept); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	// the rewritten log has no tail of a failed append left, so it can take writes again
+	w.file, w.size, w.dirty, w.broken = file, int64(len(kept)), false, nil
+	return nil
+}
+
+// writeFileAtomically replaces the file at path with data, so that a crash leaves either the old file or the new one.
+func writeFileAtomically(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// the rename itself is durable only once the directory is synced
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// start runs the background loop that syncs the log and compacts it; an interval of 0 turns that part off.
+func (w *wal) start(db *FakeDatabase, fsyncInterval, snapshotInterval time.Duration) {
+	w.stop, w.done = make(chan struct{}), make(chan struct{})
+	tick := func(interval time.Duration) (<-chan time.Time, func()) {
+		if interval <= 0 {
+			return nil, func() {}
+		}
+		ticker := time.NewTicker(interval)
+		return ticker.C, ticker.Stop
+	}
+	go func() {
+		defer close(w.done)
+		fsyncC, stopFsync := tick(fsyncInterval)
+		defer stopFsync()
+		snapshotC, stopSnapshot := tick(snapshotInterval)
+		defer stopSnapshot()
+		for {
+			select {
+			case <-fsyncC:
+				w.fail(w.sync())
+			case <-snapshotC:
+				w.fail(db.Compact())
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// fail remembers the first error of the background loop.
+func (w *wal) fail(err error) {
+	if err != nil {
+		w.errOnce.Do(func() { w.err = err })
+	}
+}
+
+// close stops the background loop, syncs the log whatever the policy, and closes it.
+func (w *wal) close() error {
+	if w.stop != nil {
+		w.once.Do(func() { close(w.stop) })
+		<-w.done
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.err
+	if syncErr := w.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Durability of a fake opened with OpenFakeDatabase.
+// ----------------------------------------------------------------------------
+
+func TestOpenFakeDatabase(t *testing.T) {
+	ctx := context.Background()
+
+	// "survives a restart":
+	// with every fsync policy, saves, deletes, expiry times and commits are all there after reopening,
+	// and new writes carry on from the old versions.
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncPeriodically, FsyncNever} {
+		t.Run(fmt.Sprintf("survives a restart with policy %d", policy), func(t *testing.T) {
+			dir := t.TempDir()
+			clock := NewManualClock(time.Now())
+			opts := []FakeDatabaseOption{WithClock(clock), WithFsync(policy), WithFsyncInterval(time.Millisecond)}
+
+			fakeDB, err := OpenFakeDatabase(dir, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			SaveUserData(ctx, fakeDB, "user1", "data 1")
+			SaveUserData(ctx, fakeDB, "user2", "data 2")
+			DeleteUserData(ctx, fakeDB, "user2")
+			SaveUserDataWithTTL(ctx, fakeDB, "session", "token", time.Minute)
+			SaveUserDataWithTTL(ctx, fakeDB, "short session", "token", time.Second)
+			SaveUserRecords(ctx, fakeDB, map[string]string{"user3": "data 3", "user4": "data 4"})
+			seq := fakeDB.seq.Load()
+			if err := fakeDB.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			clock.Advance(10 * time.Second)
+			fakeDB, err = OpenFakeDatabase(dir, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer fakeDB.Close()
+			users, _ := ListUsers(ctx, fakeDB)
+			if fmt.Sprint(users) != "[session user1 user3 user4]" {
+				t.Errorf("expected users [session user1 user3 user4], but got: %v", users)
+			}
+			if ttl, ok, _ := fakeDB.TTL(ctx, "session"); !ok || ttl != 50*time.Second {
+				t.Errorf("expected the session to have 50s left, but got: %s", ttl)
+			}
+			if fakeDB.seq.Load() != seq {
+				t.Errorf("expected seq %d after recovery, but got: %d", seq, fakeDB.seq.Load())
+			}
+		})
+	}
+
+	// "torn log":
+	// a crash can cut the log at any byte. Whatever the offset, recovery keeps exactly the writes whose records are complete,
+	// and the log takes new writes that survive the next restart.
+	t.Run("torn log", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDB, err := OpenFakeDatabase(dir, WithFsync(FsyncNever))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		const writes = 30
+		var ends []int // where the record of each write ends in the log
+		for i := range writes {
+			SaveUserData(ctx, fakeDB, fmt.Sprintf("user%02d", i), fmt.Sprintf("data %d", i))
+			ends = append(ends, int(fakeDB.wal.size))
+		}
+		fakeDB.Close()
+		log, err := os.ReadFile(filepath.Join(dir, walFile))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for offset := 0; offset <= len(log); offset++ {
+			complete := 0
+			for complete < writes && ends[complete] <= offset {
+				complete++
+			}
+			crashed := t.TempDir()
+			os.WriteFile(filepath.Join(crashed, walFile), log[:offset], 0o644)
+			fakeDB, err := OpenFakeDatabase(crashed, WithFsync(FsyncNever))
+			if err != nil {
+				t.Fatalf("offset %d: unexpected error: %v", offset, err)
+			}
+			if n, _ := fakeDB.Len(ctx); n != complete {
+				t.Errorf("offset %d: expected %d users, but got: %d", offset, complete, n)
+			}
+			if complete > 0 {
+				last := fmt.Sprintf("user%02d", complete-1)
+				if data, _, _ := GetUserData(ctx, fakeDB, last); data != fmt.Sprintf("data %d", complete-1) {
+					t.Errorf("offset %d: unexpected data for %s: %s", offset, last, data)
+				}
+			}
+			SaveUserData(ctx, fakeDB, "after crash", "data")
+			fakeDB.Close()
+
+			fakeDB, err = OpenFakeDatabase(crashed)
+			if err != nil {
+				t.Fatalf("offset %d: unexpected error: %v", offset, err)
+			}
+			if n, _ := fakeDB.Len(ctx); n != complete+1 {
+				t.Errorf("offset %d: expected %d users after the second restart, but got: %d", offset, complete+1, n)
+			}
+			fakeDB.Close()
+		}
+	})
+
+	// "corrupt record":
+	// a flipped bit fails the checksum, and recovery keeps the writes before the damaged record.
+	t.Run("corrupt record", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDB, _ := OpenFakeDatabase(dir)
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		size := fakeDB.wal.size
+		SaveUserData(ctx, fakeDB, "user2", "data 2")
+		SaveUserData(ctx, fakeDB, "user3", "data 3")
+		fakeDB.Close()
+
+		path := filepath.Join(dir, walFile)
+		log, _ := os.ReadFile(path)
+		log[size+recordHeaderSize+2] ^= 0x10
+		os.WriteFile(path, log, 0o644)
+
+		fakeDB, err := OpenFakeDatabase(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer fakeDB.Close()
+		if users, _ := ListUsers(ctx, fakeDB); fmt.Sprint(users) != "[user1]" {
+			t.Errorf("expected users [user1], but got: %v", users)
+		}
+	})
+
+	// "compaction":
+	// Compact moves the data into the snapshot and empties the log; writes after it go to the log again,
+	// and both are recovered together.
+	t.Run("compaction", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDB, _ := OpenFakeDatabase(dir)
+		for i := range 100 {
+			SaveUserData(ctx, fakeDB, fmt.Sprintf("user%d", i%10), fmt.Sprintf("data %d", i))
+		}
+		if err := fakeDB.Compact(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fakeDB.wal.size != 0 {
+			t.Errorf("expected an empty log after compaction, but it has %d bytes", fakeDB.wal.size)
+		}
+		DeleteUserData(ctx, fakeDB, "user0")
+		SaveUserData(ctx, fakeDB, "user1", "new data")
+		fakeDB.Close()
+
+		fakeDB, err := OpenFakeDatabase(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer fakeDB.Close()
+		if n, _ := fakeDB.Len(ctx); n != 9 {
+			t.Errorf("expected 9 users, but got: %d", n)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "new data" {
+			t.Errorf("expected user data: new data, but got: %s", data)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user9"); data != "data 99" {
+			t.Errorf("expected user data: data 99, but got: %s", data)
+		}
+	})
+
+	// "interrupted compaction":
+	// if the process dies after writing the snapshot but before trimming the log,
+	// the records the snapshot already has are skipped on replay instead of being applied twice.
+	t.Run("interrupted compaction", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDB, _ := OpenFakeDatabase(dir)
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		DeleteUserData(ctx, fakeDB, "user1")
+		SaveUserData(ctx, fakeDB, "user2", "data 2")
+		log, _ := os.ReadFile(filepath.Join(dir, walFile))
+		fakeDB.Compact()
+		SaveUserData(ctx, fakeDB, "user1", "data 1 again")
+		fakeDB.Close()
+
+		// put the untrimmed log back, followed by the write made after the compaction
+		trimmed, _ := os.ReadFile(filepath.Join(dir, walFile))
+		os.WriteFile(filepath.Join(dir, walFile), append(log, trimmed...), 0o644)
+
+		fakeDB, err := OpenFakeDatabase(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer fakeDB.Close()
+		if users, _ := ListUsers(ctx, fakeDB); fmt.Sprint(users) != "[user1 user2]" {
+			t.Errorf("expected users [user1 user2], but got: %v", users)
+		}
+		if data, _, _ := GetUserData(ctx, fakeDB, "user1"); data != "data 1 again" {
+			t.Errorf("expected user data: data 1 again, but got: %s", data)
+		}
+	})
+
+	// "snapshot interval":
+	// WithSnapshotInterval compacts in the background.
+	t.Run("snapshot interval", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDB, _ := OpenFakeDatabase(dir, WithSnapshotInterval(time.Millisecond))
+		defer fakeDB.Close()
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := os.Stat(filepath.Join(dir, snapshotFile)); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("expected a snapshot to be written")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	// "corrupt snapshot":
+	// a snapshot is never torn, so a damaged one is an error rather than silently lost data.
+	t.Run("corrupt snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, snapshotFile), []byte("not a snapshot"), 0o644)
+		if _, err := OpenFakeDatabase(dir); err == nil {
+			t.Errorf("expected an error for a corrupt snapshot")
+		}
+	})
+
+	// "failed sync":
+	// with FsyncAlways, a save whose sync fails is gone from the log, so it doesn't come back after a restart,
+	// and the saves after it are logged as usual.
+	t.Run("failed sync", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDB, err := OpenFakeDatabase(dir, WithFsync(FsyncAlways))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		fakeDB.wal.file = &failingFile{logFile: fakeDB.wal.file, syncErr: errors.New("disk gone")}
+		if err := SaveUserData(ctx, fakeDB, "user2", "data 2"); err == nil {
+			t.Errorf("expected the save to fail")
+		}
+		if err := SaveUserData(ctx, fakeDB, "user3", "data 3"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		fakeDB.Close()
+
+		fakeDB, err = OpenFakeDatabase(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer fakeDB.Close()
+		if users, _ := ListUsers(ctx, fakeDB); fmt.Sprint(users) != "[user1 user3]" {
+			t.Errorf("expected users [user1 user3], but got: %v", users)
+		}
+	})
+
+	// "failed undo":
+	// when the record of a failed sync can't be cut off either, the log refuses every later save
+	// rather than log writes after one its caller saw fail.
+	t.Run("failed undo", func(t *testing.T) {
+		fakeDB, err := OpenFakeDatabase(t.TempDir(), WithFsync(FsyncAlways))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer fakeDB.Close()
+		fakeDB.wal.file = &failingFile{logFile: fakeDB.wal.file, syncErr: errors.New("disk gone"), truncateErr: errors.New("disk gone")}
+		if err := SaveUserData(ctx, fakeDB, "user1", "data 1"); err == nil {
+			t.Errorf("expected the save to fail")
+		}
+		if err := SaveUserData(ctx, fakeDB, "user2", "data 2"); err == nil {
+			t.Errorf("expected the log to refuse saves")
+		}
+		if users, _ := ListUsers(ctx, fakeDB); len(users) != 0 {
+			t.Errorf("expected no users, but got: %v", users)
+		}
+	})
+}
+
+// failingFile is a log file whose next Sync fails with syncErr, and whose Truncate always fails with truncateErr if set.
+type failingFile struct {
+	logFile
+	syncErr     error
+	truncateErr error
+}
+
+func (f *failingFile) Sync() error {
+	if err := f.syncErr; err != nil {
+		f.syncErr = nil
+		return err
+	}
+	return f.logFile.Sync()
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+	return f.logFile.Truncate(size)
+}
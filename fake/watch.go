@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// A change feed: watching the writes to the fake.
+// ----------------------------------------------------------------------------
+
+// Caches and search indexes have to know when records change. With WithChangeFeed, the fake keeps the recent writes
+// in a history, and Watch streams them as events: a put or a delete of a key, stamped with the seq of its write.
+//
+//	fakeDB := NewFakeDatabase(WithChangeFeed(1024, 256))
+//	for event, err := range fakeDB.Watch(ctx, "user:", fakeDB.Seq()) {
+//		if err != nil {
+//			return err // the context is done, the watcher fell behind, or the fake was closed
+//		}
+//		cache.Invalidate(event.Key)
+//		lastSeen = event.Seq
+//	}
+//
+// Events come in the order of their seqs. The events of one commit share its seq and come together, in key order.
+// A watch resumes after a seq: passing the seq of the last event it handled continues where it left off,
+// as long as the history still has everything after it; otherwise the watch fails with ErrHistoryGone
+// and the watcher has to rebuild from a scan. Pass Seq() to see only new writes.
+//
+// The writers never wait for the watchers. Every watch has a queue of pending events:
+// a watcher that falls maxPending events behind is disconnected with ErrSlowWatcher.
+// A maxPending of 0 buffers without limit instead, which keeps every event at the cost of memory.
+//
+// Keys that expire are not events: like the write-ahead log, the feed only sees the writes.
+
+// ErrNoChangeFeed is returned by Watch when the fake was created without WithChangeFeed.
+var ErrNoChangeFeed = errors.New("change feed not enabled: create the fake with WithChangeFeed")
+
+// ErrHistoryGone is returned by Watch when some of the events after the requested seq are no longer in the history.
+var ErrHistoryGone = errors.New("events no longer in the history")
+
+// ErrSlowWatcher ends a watch that fell too far behind.
+var ErrSlowWatcher = errors.New("watcher too slow")
+
+// ErrClosed ends the watches of a fake that is closed.
+var ErrClosed = errors.New("database closed")
+
+type EventKind string
+
+const (
+	EventPut    EventKind = "put"
+	EventDelete EventKind = "delete"
+)
+
+type Event struct {
+	Seq       uint64
+	Kind      EventKind
+	Key       string
+	Value     string    // empty for a delete
+	ExpiresAt time.Time // zero if the key never expires
+}
+
+// WithChangeFeed turns on the change feed: the fake keeps the last history events for watches to resume from,
+// and disconnects a watcher that falls maxPending events behind (0 for never).
+func WithChangeFeed(history, maxPending int) FakeDatabaseOption {
+	return func(c *fakeConfig) {
+		c.feedHistory = history
+		c.feedMaxPending = maxPending
+	}
+}
+
+// Seq returns the seq of the last write; watching from it sees only the writes after this call.
+func (db *FakeDatabase) Seq() uint64 {
+	return db.seq.Load()
+}
+
+// changeFeed holds the history and the watches. A single mutex guards all of it, and stamp holds it while a write is published.
+type changeFeed struct {
+	mu sync.Mutex
+	// history is a ring buffer of the last events: next is where the next event goes, and full says whether it has wrapped
+	history []Event
+	next    int
+	full    bool
+	// dropped is the seq of the last event pushed out of the history; a watch can resume after it, but not before
+	dropped    uint64
+	maxPending int
+	watches    map[*watch]struct{}
+	closed     bool
+}
+
+// watch is the state of one Watch: the events waiting for the watcher, and why it ended, if it has.
+type watch struct {
+	prefix  string
+	pending []Event
+	// wake has room for one signal: there is something new in pending or err
+	wake chan struct{}
+	err  error
+}
+
+func newChangeFeed(history, maxPending int) *changeFeed {
+	return &changeFeed{history: make([]Event, history), maxPending: maxPending, watches: make(map[*watch]struct{})}
+}
+
+// publish records the events of a write and hands them to the watches. The caller holds f.mu.
+func (f *changeFeed) publish(r walRecord) {
+	for _, op := range r.ops {
+		event := Event{Seq: r.seq, Kind: EventPut, Key: op.key, Value: op.value, ExpiresAt: op.expiresAt}
+		if op.deleted {
+			event.Kind = EventDelete
+		}
+		if f.full {
+			f.dropped = f.history[f.next].Seq
+		}
+		f.history[f.next] = event
+		f.next = (f.next + 1) % len(f.history)
+		f.full = f.full || f.next == 0
+
+		for w := range f.watches {
+			if !strings.HasPrefix(event.Key, w.prefix) {
+				continue
+			}
+			if f.maxPending > 0 && len(w.pending) >= f.maxPending {
+				f.end(w, fmt.Errorf("%w: %d events behind", ErrSlowWatcher, len(w.pending)))
+				continue
+			}
+			w.pending = append(w.pending, event)
+			w.signal()
+		}
+	}
+}
+
+func (w *watch) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// end stops publishing to w; the watcher gets the events already pending, and then err. The caller holds f.mu.
+func (f *changeFeed) end(w *watch, err error) {
+	w.err = err
+	delete(f.watches, w)
+	w.signal()
+}
+
+// subscribe starts a watch of the keys with prefix, with the events after seq from the history already pending.
+func (f *changeFeed) subscribe(prefix string, after uint64) (*watch, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, ErrClosed
+	}
+	if after < f.dropped {
+		return nil, fmt.Errorf("%w: can't resume after seq %d, the history starts after seq %d", ErrHistoryGone, after, f.dropped)
+	}
+	w := &watch{prefix: prefix, wake: make(chan struct{}, 1)}
+	start := 0
+	if f.full {
+		start = f.next
+	}
+	for i := range f.size() {
+		event := f.history[(start+i)%len(f.history)]
+		if event.Seq > after && strings.HasPrefix(event.Key, prefix) {
+			w.pending = append(w.pending, event)
+		}
+	}
+	f.watches[w] = struct{}{}
+	return w, nil
+}
+
+func (f *changeFeed) size() int {
+	if f.full {
+		return len(f.history)
+	}
+	return f.next
+}
+
+func (f *changeFeed) unsubscribe(w *watch) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.watches, w)
+}
+
+// receive waits until w has pending events and takes them all, or returns why the watch ended.
+func (f *changeFeed) receive(ctx context.Context, w *watch) ([]Event, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		f.mu.Lock()
+		events, err := w.pending, w.err
+		w.pending = nil
+		f.mu.Unlock()
+		if len(events) > 0 {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// close ends every watch with ErrClosed.
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for w := range f.watches {
+		f.end(w, ErrClosed)
+	}
+}
+
+// Watch streams the events of the keys starting with prefix, from the first write after seq after.
+// The iterator yields an error instead of an event when the watch ends: the context's error when it is done,
+// ErrHistoryGone, ErrSlowWatcher, ErrClosed, or ErrNoChangeFeed. It stops after the error.
+func (db *FakeDatabase) Watch(ctx context.Context, prefix string, after uint64) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		if db.feed == nil {
+			yield(Event{}, ErrNoChangeFeed)
+			return
+		}
+		w, err := db.feed.subscribe(prefix, after)
+		if err != nil {
+			yield(Event{}, err)
+			return
+		}
+		defer db.feed.unsubscribe(w)
+		for {
+			events, err := db.feed.receive(ctx, w)
+			if err != nil {
+				yield(Event{}, err)
+				return
+			}
+			for _, event := range events {
+				if !yield(event, nil) {
+					return
+				}
+			}
+		}
+	}
+}
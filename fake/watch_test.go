@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Watching the writes to the fake.
+// ----------------------------------------------------------------------------
+
+// collect reads n events from a watch, failing the test on an error.
+func collect(t *testing.T, events iter.Seq2[Event, error], n int) []Event {
+	t.Helper()
+	var got []Event
+	if n == 0 {
+		return got
+	}
+	for event, err := range events {
+		if err != nil {
+			t.Fatalf("unexpected error after %d events: %v", len(got), err)
+		}
+		got = append(got, event)
+		if len(got) == n {
+			break
+		}
+	}
+	return got
+}
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+
+	// "events":
+	// saves, deletes and commits arrive in order, with their seqs; the events of a commit share one seq.
+	t.Run("events", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithChangeFeed(100, 0))
+		start := fakeDB.Seq()
+		SaveUserData(ctx, fakeDB, "user1", "data 1")
+		SaveUserDataWithTTL(ctx, fakeDB, "session", "token", time.Minute)
+		DeleteUserData(ctx, fakeDB, "user1")
+		DeleteUserData(ctx, fakeDB, "missing")
+		SaveUserRecords(ctx, fakeDB, map[string]string{"user3": "data 3", "user2": "data 2"})
+
+		got := collect(t, fakeDB.Watch(ctx, "", start), 5)
+		expected := []string{"put user1 data 1", "put session token", "delete user1 ", "put user2 data 2", "put user3 data 3"}
+		for i, event := range got {
+			if s := fmt.Sprintf("%s %s %s", event.Kind, event.Key, event.Value); s != expected[i] {
+				t.Errorf("event %d: expected %q, but got: %q", i, expected[i], s)
+			}
+		}
+		if got[1].ExpiresAt.IsZero() || !got[0].ExpiresAt.IsZero() {
+			t.Errorf("expected only the session to have an expiry time")
+		}
+		if got[0].Seq >= got[1].Seq || got[1].Seq >= got[2].Seq || got[2].Seq >= got[3].Seq || got[3].Seq != got[4].Seq {
+			t.Errorf("expected increasing seqs, shared by the commit, but got: %d %d %d %d %d",
+				got[0].Seq, got[1].Seq, got[2].Seq, got[3].Seq, got[4].Seq)
+		}
+		if got[4].Seq != fakeDB.Seq() {
+			t.Errorf("expected the last event to have seq %d, but got: %d", fakeDB.Seq(), got[4].Seq)
+		}
+	})
+
+	// "live, prefix and resume":
+	// a watch sees the writes made while it waits, only for its prefix,
+	// and a new watch resumes after the last event handled by an earlier one.
+	t.Run("live, prefix and resume", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithChangeFeed(100, 0))
+		start := fakeDB.Seq()
+		go func() {
+			for i := range 6 {
+				SaveUserData(ctx, fakeDB, fmt.Sprintf("admin%d", i), "data")
+				SaveUserData(ctx, fakeDB, fmt.Sprintf("user%d", i), "data")
+			}
+		}()
+		first := collect(t, fakeDB.Watch(ctx, "user", start), 3)
+		rest := collect(t, fakeDB.Watch(ctx, "user", first[2].Seq), 3)
+		for i, event := range append(first, rest...) {
+			if event.Key != fmt.Sprintf("user%d", i) {
+				t.Errorf("event %d: expected key user%d, but got: %s", i, i, event.Key)
+			}
+		}
+	})
+
+	// "history gone":
+	// resuming from a seq whose events were pushed out of the history fails; resuming later works.
+	t.Run("history gone", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithChangeFeed(4, 0))
+		for i := range 10 {
+			SaveUserData(ctx, fakeDB, fmt.Sprintf("user%d", i), "data")
+		}
+		for _, err := range fakeDB.Watch(ctx, "", 0) {
+			if !errors.Is(err, ErrHistoryGone) {
+				t.Errorf("expected ErrHistoryGone, but got: %v", err)
+			}
+			break
+		}
+		got := collect(t, fakeDB.Watch(ctx, "", fakeDB.Seq()-4), 4)
+		if got[0].Key != "user6" || got[3].Key != "user9" {
+			t.Errorf("expected the events of user6 to user9, but got: %v", got)
+		}
+	})
+
+	// "slow watcher":
+	// a watcher that doesn't read gets the events it has room for, and is then disconnected;
+	// with no limit, it gets every event however far behind it is.
+	for _, maxPending := range []int{5, 0} {
+		t.Run(fmt.Sprintf("slow watcher with max pending %d", maxPending), func(t *testing.T) {
+			fakeDB := NewFakeDatabase(WithChangeFeed(10, maxPending))
+			start := fakeDB.Seq()
+			SaveUserData(ctx, fakeDB, "user", "data")
+			next, stop := iter.Pull2(fakeDB.Watch(ctx, "", start))
+			defer stop()
+			// the first event proves the watch has started
+			if _, err, _ := next(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			const writes = 1000
+			for i := range writes {
+				SaveUserData(ctx, fakeDB, fmt.Sprintf("user%d", i), "data")
+			}
+			received := 0
+			for {
+				_, err, _ := next()
+				if err != nil {
+					if maxPending == 0 || !errors.Is(err, ErrSlowWatcher) {
+						t.Errorf("unexpected error: %v", err)
+					}
+					break
+				}
+				received++
+				if received == writes {
+					break
+				}
+			}
+			expected := writes
+			if maxPending > 0 {
+				expected = maxPending
+			}
+			if received != expected {
+				t.Errorf("expected %d events, but got: %d", expected, received)
+			}
+		})
+	}
+
+	// "cancel and close":
+	// a waiting watch ends with the context's error when it is cancelled, and with ErrClosed when the fake is closed.
+	t.Run("cancel and close", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithChangeFeed(10, 0))
+		watchCtx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i, watchCtx := range []context.Context{watchCtx, ctx} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, err := range fakeDB.Watch(watchCtx, "", fakeDB.Seq()) {
+					errs[i] = err
+				}
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		fakeDB.Close()
+		wg.Wait()
+		if !errors.Is(errs[0], context.Canceled) {
+			t.Errorf("expected context.Canceled, but got: %v", errs[0])
+		}
+		if !errors.Is(errs[1], ErrClosed) {
+			t.Errorf("expected ErrClosed, but got: %v", errs[1])
+		}
+	})
+
+	// "no change feed":
+	// a fake without WithChangeFeed can't be watched.
+	t.Run("no change feed", func(t *testing.T) {
+		for _, err := range NewFakeDatabase().Watch(ctx, "", 0) {
+			if !errors.Is(err, ErrNoChangeFeed) {
+				t.Errorf("expected ErrNoChangeFeed, but got: %v", err)
+			}
+		}
+	})
+
+	// "concurrent writers":
+	// writes on many shards at once still come out in seq order, and none is missing.
+	t.Run("concurrent writers", func(t *testing.T) {
+		fakeDB := NewFakeDatabase(WithChangeFeed(10000, 0))
+		start := fakeDB.Seq()
+		const goroutines, writes = 8, 200
+		var wg sync.WaitGroup
+		for g := range goroutines {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range writes {
+					SaveUserData(ctx, fakeDB, fmt.Sprintf("user%d-%d", g, i), "data")
+				}
+			}()
+		}
+		got := collect(t, fakeDB.Watch(ctx, "", start), goroutines*writes)
+		wg.Wait()
+		for i := 1; i < len(got); i++ {
+			if got[i].Seq != got[i-1].Seq+1 {
+				t.Fatalf("event %d: expected seq %d, but got: %d", i, got[i-1].Seq+1, got[i].Seq)
+			}
+		}
+	})
+}
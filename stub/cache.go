@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// CachedGeoService remembers the answers of another GeoService.
+// ----------------------------------------------------------------------------
+
+// The cache sits in front of any GeoService (usually the RealGeoService) and keeps every successful lookup in memory.
+// Failed lookups are not cached, so a transient network error does not stick.
+
+// The cache can be saved to and loaded from a JSON file in the same format as a stub fixture.
+// That means a cache file written by an online run can later be handed to the stub with -fixture and replayed fully offline.
+
+type CachedGeoService struct {
+	Next GeoService
+
+	mu      sync.Mutex
+	entries map[string]Coordinates
+}
+
+func NewCachedGeoService(next GeoService) *CachedGeoService {
+	return &CachedGeoService{
+		Next:    next,
+		entries: make(map[string]Coordinates),
+	}
+}
+
+func (c *CachedGeoService) GetCoordinates(ctx context.Context, address string) (float64, float64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, fmt.Errorf("cached geocoding %q: %w", address, err)
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[address]
+	c.mu.Unlock()
+	if ok {
+		return entry.Lat, entry.Lng, nil
+	}
+
+	lat, lng, err := c.Next.GetCoordinates(ctx, address)
+	if err != nil {
+		return 0, 0, err
+	}
+	c.mu.Lock()
+	c.entries[address] = Coordinates{Lat: lat, Lng: lng}
+	c.mu.Unlock()
+	return lat, lng, nil
+}
+
+// Load adds the entries of a cache (or fixture) file to the cache.
+// A missing file is not an error: it just means the cache starts empty.
+func (c *CachedGeoService) Load(path string) error {
+	entries, err := LoadFixture(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for address, coordinates := range entries {
+		c.entries[address] = coordinates
+	}
+	return nil
+}
+
+// Save writes the cache to path, replacing the file atomically.
+func (c *CachedGeoService) Save(path string) error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// ChaosGeoService adds latency and random failures to another GeoService.
+// ----------------------------------------------------------------------------
+
+// A stub answers instantly and never fails, which is great for checking answers but useless for checking timeouts.
+// The chaos wrapper sits in front of any GeoService and, before every call, waits for a delay drawn from a latency distribution
+// and then fails a configurable fraction of the calls with ErrInjectedFault.
+
+// The random numbers come from a seeded generator, so a run with the same seed and the same sequence of calls
+// sees the same delays and the same failures every time.
+
+// While it waits, the wrapper watches the context: if the caller's deadline passes first, the call fails with the context error,
+// exactly as a slow real service would.
+
+// ErrInjectedFault is returned by ChaosGeoService for the calls it decides to fail.
+var ErrInjectedFault = errors.New("injected fault")
+
+// ErrInvalidLatency is returned for a latency distribution that makes no sense, like latencies that drop as the percentiles rise.
+var ErrInvalidLatency = errors.New("invalid latency")
+
+// A LatencyDistribution draws the delay to add to a single call.
+type LatencyDistribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// FixedLatency delays every call by the same amount.
+type FixedLatency time.Duration
+
+func (l FixedLatency) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(l)
+}
+
+// UniformLatency delays calls by a duration picked uniformly between Min and Max.
+type UniformLatency struct {
+	Min, Max time.Duration
+}
+
+func (l UniformLatency) Sample(r *rand.Rand) time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + time.Duration(r.Int64N(int64(l.Max-l.Min)+1))
+}
+
+// NormalLatency delays calls by a normally distributed duration, never less than zero.
+type NormalLatency struct {
+	Mean, StdDev time.Duration
+}
+
+func (l NormalLatency) Sample(r *rand.Rand) time.Duration {
+	return max(0, l.Mean+time.Duration(r.NormFloat64()*float64(l.StdDev)))
+}
+
+// LatencyPercentile says that Percent percent of the calls take at most Latency.
+type LatencyPercentile struct {
+	Percent float64
+	Latency time.Duration
+}
+
+// PercentileLatency describes a long-tail distribution by a few of its percentiles, e.g. p50=20ms, p99=400ms, p99.9=2s,
+// in increasing order. Delays between two given percentiles are interpolated linearly; the fastest calls take no time at all
+// and the slowest take the latency of the highest percentile.
+type PercentileLatency []LatencyPercentile
+
+func (l PercentileLatency) Sample(r *rand.Rand) time.Duration {
+	percent := r.Float64() * 100
+	lowPercent, lowLatency := 0.0, time.Duration(0)
+	for _, p := range l {
+		if percent <= p.Percent {
+			fraction := (percent - lowPercent) / (p.Percent - lowPercent)
+			return lowLatency + time.Duration(fraction*float64(p.Latency-lowLatency))
+		}
+		lowPercent, lowLatency = p.Percent, p.Latency
+	}
+	return lowLatency
+}
+
+// validate checks that there are percentiles, between 0 and 100, and that both they and their latencies increase.
+func (l PercentileLatency) validate() error {
+	if len(l) == 0 {
+		return fmt.Errorf("%w: no percentiles", ErrInvalidLatency)
+	}
+	lowPercent, lowLatency := 0.0, time.Duration(0)
+	for _, p := range l {
+		if p.Percent <= lowPercent || p.Percent > 100 {
+			return fmt.Errorf("%w: percentile %v after %v", ErrInvalidLatency, p.Percent, lowPercent)
+		}
+		if p.Latency < lowLatency {
+			return fmt.Errorf("%w: p%v is %v, less than the %v before it", ErrInvalidLatency, p.Percent, p.Latency, lowLatency)
+		}
+		lowPercent, lowLatency = p.Percent, p.Latency
+	}
+	return nil
+}
+
+type ChaosConfig struct {
+	Latency   LatencyDistribution // nil means no added latency
+	ErrorRate float64             // fraction of calls, between 0 and 1, that fail with ErrInjectedFault
+	Seed      uint64
+}
+
+type ChaosGeoService struct {
+	Next   GeoService
+	config ChaosConfig
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewChaosGeoService wraps next, or fails with ErrInvalidLatency for a latency distribution that makes no sense.
+func NewChaosGeoService(next GeoService, config ChaosConfig) (*ChaosGeoService, error) {
+	if latency, ok := config.Latency.(interface{ validate() error }); ok {
+		if err := latency.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &ChaosGeoService{
+		Next:   next,
+		config: config,
+		rng:    rand.New(rand.NewPCG(config.Seed, config.Seed)),
+	}, nil
+}
+
+// roll draws the delay and the fate of the next call.
+// Both come from the same generator under one lock, so the sequence only depends on the seed and the number of calls.
+func (c *ChaosGeoService) roll() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var delay time.Duration
+	if c.config.Latency != nil {
+		delay = c.config.Latency.Sample(c.rng)
+	}
+	fail := c.rng.Float64() < c.config.ErrorRate
+	return delay, fail
+}
+
+func (c *ChaosGeoService) GetCoordinates(ctx context.Context, address string) (float64, float64, error) {
+	delay, fail := c.roll()
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, 0, fmt.Errorf("chaos geocoding %q: %w", address, ctx.Err())
+		}
+	}
+	if fail {
+		return 0, 0, fmt.Errorf("chaos geocoding %q: %w", address, ErrInjectedFault)
+	}
+	return c.Next.GetCoordinates(ctx, address)
+}
+
+// ParseLatency parses the latency distributions accepted by the -chaos-latency flag:
+//
+//	fixed:100ms
+//	uniform:50ms,200ms
+//	normal:100ms,20ms
+//	percentiles:50=20ms,90=80ms,99=400ms,99.9=2s
+//
+// The percentiles may come in any order, but their latencies must not drop as they rise.
+func ParseLatency(spec string) (LatencyDistribution, error) {
+	kind, args, _ := strings.Cut(spec, ":")
+	var values []string
+	if args != "" {
+		values = strings.Split(args, ",")
+	}
+	durations := func(n int) ([]time.Duration, error) {
+		if len(values) != n {
+			return nil, fmt.Errorf("latency %q: %s takes %d durations", spec, kind, n)
+		}
+		result := make([]time.Duration, n)
+		for i, value := range values {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("latency %q: %w", spec, err)
+			}
+			result[i] = d
+		}
+		return result, nil
+	}
+
+	switch kind {
+	case "fixed":
+		d, err := durations(1)
+		if err != nil {
+			return nil, err
+		}
+		return FixedLatency(d[0]), nil
+	case "uniform":
+		d, err := durations(2)
+		if err != nil {
+			return nil, err
+		}
+		return UniformLatency{Min: d[0], Max: d[1]}, nil
+	case "normal":
+		d, err := durations(2)
+		if err != nil {
+			return nil, err
+		}
+		return NormalLatency{Mean: d[0], StdDev: d[1]}, nil
+	case "percentiles":
+		var latency PercentileLatency
+		for _, value := range values {
+			percent, duration, ok := strings.Cut(value, "=")
+			if !ok {
+				return nil, fmt.Errorf("latency %q: expected PERCENT=DURATION, got %q", spec, value)
+			}
+			p, err := strconv.ParseFloat(percent, 64)
+			if err != nil || p <= 0 || p > 100 {
+				return nil, fmt.Errorf("latency %q: bad percentile %q", spec, percent)
+			}
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				return nil, fmt.Errorf("latency %q: %w", spec, err)
+			}
+			latency = append(latency, LatencyPercentile{Percent: p, Latency: d})
+		}
+		slices.SortFunc(latency, func(a, b LatencyPercentile) int {
+			return cmp.Compare(a.Percent, b.Percent)
+		})
+		if err := latency.validate(); err != nil {
+			return nil, fmt.Errorf("latency %q: %w", spec, err)
+		}
+		return latency, nil
+	}
+	return nil, fmt.Errorf("latency %q: unknown distribution %q", spec, kind)
+}
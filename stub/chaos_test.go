@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// The chaos wrapper: latency distributions, injected faults and timeouts.
+// ----------------------------------------------------------------------------
+
+func TestLatencyDistributions(t *testing.T) {
+	// sampleQuantile draws n delays and returns the one at quantile q.
+	sampleQuantile := func(l LatencyDistribution, n int, q float64) time.Duration {
+		r := rand.New(rand.NewPCG(1, 1))
+		samples := make([]time.Duration, n)
+		for i := range samples {
+			samples[i] = l.Sample(r)
+		}
+		slices.Sort(samples)
+		return samples[int(q*float64(n-1))]
+	}
+	within := func(got, want, tolerance time.Duration) bool {
+		return got >= want-tolerance && got <= want+tolerance
+	}
+
+	t.Run("fixed", func(t *testing.T) {
+		if got := sampleQuantile(FixedLatency(30*time.Millisecond), 100, 0.99); got != 30*time.Millisecond {
+			t.Errorf("expected every sample to be 30ms, but got: %v", got)
+		}
+	})
+
+	t.Run("uniform", func(t *testing.T) {
+		l := UniformLatency{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond}
+		if got := sampleQuantile(l, 10000, 0); got < l.Min {
+			t.Errorf("expected no sample below %v, but got: %v", l.Min, got)
+		}
+		if got := sampleQuantile(l, 10000, 1); got > l.Max {
+			t.Errorf("expected no sample above %v, but got: %v", l.Max, got)
+		}
+		if got := sampleQuantile(l, 10000, 0.5); !within(got, 15*time.Millisecond, time.Millisecond) {
+			t.Errorf("expected a median of about 15ms, but got: %v", got)
+		}
+	})
+
+	t.Run("normal", func(t *testing.T) {
+		l := NormalLatency{Mean: 100 * time.Millisecond, StdDev: 10 * time.Millisecond}
+		if got := sampleQuantile(l, 10000, 0.5); !within(got, 100*time.Millisecond, 2*time.Millisecond) {
+			t.Errorf("expected a median of about 100ms, but got: %v", got)
+		}
+		// mean + 1 standard deviation is roughly the 84th percentile
+		if got := sampleQuantile(l, 10000, 0.84); !within(got, 110*time.Millisecond, 2*time.Millisecond) {
+			t.Errorf("expected a p84 of about 110ms, but got: %v", got)
+		}
+	})
+
+	t.Run("percentiles", func(t *testing.T) {
+		l, err := ParseLatency("percentiles:99=400ms,50=20ms,99.9=2s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			q         float64
+			want      time.Duration
+			tolerance time.Duration
+		}{
+			{0.50, 20 * time.Millisecond, 2 * time.Millisecond},
+			{0.90, 330 * time.Millisecond, 10 * time.Millisecond}, // interpolated between p50 and p99
+			{0.99, 400 * time.Millisecond, 100 * time.Millisecond},
+			{0.999, 2 * time.Second, 200 * time.Millisecond},
+		} {
+			if got := sampleQuantile(l, 100000, c.q); !within(got, c.want, c.tolerance) {
+				t.Errorf("expected p%v of about %v, but got: %v", c.q*100, c.want, got)
+			}
+		}
+	})
+
+	t.Run("bad specs", func(t *testing.T) {
+		for _, spec := range []string{"", "fixed", "fixed:10ms,20ms", "uniform:10ms", "normal:soon,5ms", "percentiles:", "percentiles:150=1s",
+			"percentiles:50=500ms,99=10ms", "percentiles:50=1ms,50=2ms", "gamma:1s"} {
+			if _, err := ParseLatency(spec); err == nil {
+				t.Errorf("%q: expected an error", spec)
+			}
+		}
+	})
+}
+
+func newChaos(t *testing.T, config ChaosConfig) *ChaosGeoService {
+	t.Helper()
+	chaos, err := NewChaosGeoService(&StubGeoService{}, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return chaos
+}
+
+func TestChaosGeoService(t *testing.T) {
+	ctx := context.Background()
+
+	// failures records which of n calls fail.
+	failures := func(chaos *ChaosGeoService, n int) []bool {
+		result := make([]bool, n)
+		for i := range result {
+			_, _, err := GetCityCoordinates(ctx, chaos, "London")
+			result[i] = errors.Is(err, ErrInjectedFault)
+		}
+		return result
+	}
+
+	// "error rate":
+	// roughly the configured fraction of calls fails, and the others get the stub's answer.
+	t.Run("error rate", func(t *testing.T) {
+		chaos := newChaos(t, ChaosConfig{ErrorRate: 0.3, Seed: 42})
+		failed := 0
+		for _, f := range failures(chaos, 1000) {
+			if f {
+				failed++
+			}
+		}
+		if failed < 250 || failed > 350 {
+			t.Errorf("expected about 300 failures out of 1000, but got: %d", failed)
+		}
+	})
+
+	// "same seed, same run":
+	// two wrappers with the same seed fail exactly the same calls, a different seed fails different ones.
+	t.Run("same seed, same run", func(t *testing.T) {
+		config := ChaosConfig{ErrorRate: 0.5, Seed: 7}
+		first := failures(newChaos(t, config), 100)
+		second := failures(newChaos(t, config), 100)
+		if !slices.Equal(first, second) {
+			t.Errorf("expected the same failures for the same seed")
+		}
+		config.Seed = 8
+		if other := failures(newChaos(t, config), 100); slices.Equal(first, other) {
+			t.Errorf("expected different failures for a different seed")
+		}
+	})
+
+	// "invalid latency":
+	// percentiles built by hand that are out of order, or whose latencies drop as they rise, are rejected.
+	t.Run("invalid latency", func(t *testing.T) {
+		for _, latency := range []PercentileLatency{
+			{},
+			{{99, 400 * time.Millisecond}, {50, 20 * time.Millisecond}},
+			{{50, 500 * time.Millisecond}, {99, 10 * time.Millisecond}},
+		} {
+			if _, err := NewChaosGeoService(&StubGeoService{}, ChaosConfig{Latency: latency}); !errors.Is(err, ErrInvalidLatency) {
+				t.Errorf("%v: expected ErrInvalidLatency, but got: %v", latency, err)
+			}
+		}
+	})
+
+	// "timeouts":
+	// a lookup slower than the caller's deadline fails with context.DeadlineExceeded as soon as the deadline passes,
+	// which is what the -timeout flag of the geocode tool relies on.
+	t.Run("timeouts", func(t *testing.T) {
+		chaos := newChaos(t, ChaosConfig{Latency: FixedLatency(10 * time.Second)})
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, _, err := GetCityCoordinates(ctx, chaos, "London")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, but got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expected the call to give up at the deadline, but it took: %v", elapsed)
+		}
+	})
+
+	// "demo mode":
+	// the geocode tool wraps its backend in the chaos service when a chaos flag is given.
+	t.Run("demo mode", func(t *testing.T) {
+		code, _, _ := runGeocode(t, "", "-backend", "stub", "-timeout", "10ms", "-chaos-latency", "fixed:1s", "London", "Paris")
+		if code != 2 {
+			t.Errorf("expected both lookups to time out, but got exit status: %d", code)
+		}
+		code, _, _ = runGeocode(t, "", "-backend", "stub", "-chaos-error-rate", "1", "London")
+		if code != 1 {
+			t.Errorf("expected the lookup to fail, but got exit status: %d", code)
+		}
+		code, _, _ = runGeocode(t, "", "-backend", "stub", "-chaos-latency", "weird", "London")
+		if code != exitUsage {
+			t.Errorf("expected a usage error, but got exit status: %d", code)
+		}
+	})
+}
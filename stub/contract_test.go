@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------
+// A contract suite that every GeoService implementation has to pass.
+// ----------------------------------------------------------------------------
+
+// A stub is only useful if it behaves like the thing it stands in for.
+// GeoServiceContract writes down the behaviour documented on the GeoService interface as a test suite,
+// and we run that same suite against the stub and against the real service.
+// If the real service ever changes its answers (or its errors), the suite fails for the real service,
+// which tells us that the stub and its fixture have drifted away from reality.
+//
+// The stub, the cached stub and the real service are checked in TestGeoServiceContract, next to each other.
+// Run takes any GeoService, but only this module's tests can call it; a geocoder built elsewhere has no way in.
+
+// By default the real service is pointed at a local server replaying recorded geocoding API responses (testdata/nominatim.json),
+// so the tests stay fast and offline. Pass -geo.live to run the contract against the live API instead:
+//
+//	go test -run TestGeoServiceContract -geo.live
+
+var liveGeocoder = flag.Bool("geo.live", false, "run the GeoService contract against the live geocoding API")
+
+type GeoServiceContract struct {
+	// Known maps addresses the service must resolve to the coordinates it must return.
+	Known map[string]Coordinates
+	// Unknown lists addresses the service must fail to resolve with ErrAddressNotFound.
+	Unknown []string
+	// Tolerance is how far (in degrees) an answer may be from the expected coordinates.
+	Tolerance float64
+	// Concurrency is the number of goroutines used to check that the service is safe for concurrent use.
+	Concurrency int
+}
+
+// Run checks svc against the contract, one subtest per rule.
+func (c GeoServiceContract) Run(t *testing.T, svc GeoService) {
+	t.Helper()
+	ctx := context.Background()
+
+	t.Run("known addresses resolve within tolerance", func(t *testing.T) {
+		for address, expected := range c.Known {
+			lat, lng, err := svc.GetCoordinates(ctx, address)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", address, err)
+				continue
+			}
+			if math.Abs(lat-expected.Lat) > c.Tolerance || math.Abs(lng-expected.Lng) > c.Tolerance {
+				t.Errorf("%s: expected coordinates within %v of (%.4f, %.4f), but got: (%.4f, %.4f)",
+					address, c.Tolerance, expected.Lat, expected.Lng, lat, lng)
+			}
+		}
+	})
+
+	t.Run("unknown addresses return ErrAddressNotFound", func(t *testing.T) {
+		for _, address := range c.Unknown {
+			_, _, err := svc.GetCoordinates(ctx, address)
+			if !errors.Is(err, ErrAddressNotFound) {
+				t.Errorf("%s: expected ErrAddressNotFound, but got: %v", address, err)
+			}
+		}
+	})
+
+	t.Run("results are deterministic", func(t *testing.T) {
+		for address := range c.Known {
+			lat1, lng1, err1 := svc.GetCoordinates(ctx, address)
+			lat2, lng2, err2 := svc.GetCoordinates(ctx, address)
+			if lat1 != lat2 || lng1 != lng2 || (err1 == nil) != (err2 == nil) {
+				t.Errorf("%s: got (%v, %v, %v) and then (%v, %v, %v)", address, lat1, lng1, err1, lat2, lng2, err2)
+			}
+		}
+	})
+
+	t.Run("concurrent calls are safe", func(t *testing.T) {
+		// run with -race to get the most out of this one
+		var wg sync.WaitGroup
+		errs := make(chan error, c.Concurrency*(len(c.Known)+len(c.Unknown)))
+		for range c.Concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for address := range c.Known {
+					if _, _, err := svc.GetCoordinates(ctx, address); err != nil {
+						errs <- err
+					}
+				}
+				for _, address := range c.Unknown {
+					if _, _, err := svc.GetCoordinates(ctx, address); !errors.Is(err, ErrAddressNotFound) {
+						errs <- err
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("unexpected result from a concurrent call: %v", err)
+		}
+	})
+
+	t.Run("context cancellation is honoured", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		for address := range c.Known {
+			_, _, err := svc.GetCoordinates(cancelled, address)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s: expected context.Canceled, but got: %v", address, err)
+			}
+		}
+	})
+}
+
+// newReplayServer serves the recorded geocoding API responses in path, and an empty result for anything else.
+func newReplayServer(t *testing.T, path string) *httptest.Server {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded map[string]json.RawMessage
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		response, ok := recorded[r.URL.Query().Get("q")]
+		if !ok {
+			response = json.RawMessage(`[]`)
+		}
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGeoServiceContract(t *testing.T) {
+	// the fixture is the single source of truth: the stub answers from it,
+	// and the real service has to agree with it
+	fixture, err := LoadFixture("testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := GeoServiceContract{
+		Known:       fixture,
+		Unknown:     []string{"Qqqxz Nowhere 00000", "Zzyzzx Imaginary Street 99999"},
+		Tolerance:   0.01, // roughly a kilometre
+		Concurrency: 8,
+	}
+
+	t.Run("stub geo service", func(t *testing.T) {
+		contract.Run(t, &StubGeoService{Fixture: fixture})
+	})
+
+	t.Run("cached stub geo service", func(t *testing.T) {
+		contract.Run(t, NewCachedGeoService(&StubGeoService{Fixture: fixture}))
+	})
+
+	t.Run("real geo service", func(t *testing.T) {
+		realGeoService := &RealGeoService{BaseURL: newReplayServer(t, "testdata/nominatim.json").URL}
+		if *liveGeocoder {
+			// be gentle with the public API: it allows about one request per second
+			realGeoService = &RealGeoService{}
+			contract.Concurrency = 1
+		}
+		contract.Run(t, realGeoService)
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// geocode: a command-line tool built on top of GetCityCoordinates.
+// ----------------------------------------------------------------------------
+
+// usage:
+//
+//	stub [flags] [address ...]
+//
+// The addresses are taken from the arguments, or read one per line from stdin when there are none.
+// Every address is looked up with GetCityCoordinates using the selected backend:
+//
+//	-backend real    the RealGeoService (HTTP, needs network access)
+//	-backend stub    the StubGeoService with its built-in answers
+//	-backend cache   the RealGeoService behind a CachedGeoService (see -cache-file)
+//	-fixture FILE    the StubGeoService answering from FILE; never touches the network
+//
+// The results are written to stdout as CSV, JSON lines or a GeoJSON FeatureCollection (-format).
+//
+// The chaos flags put a ChaosGeoService (see chaos.go) in front of the selected backend, which is a handy demo of
+// how the tool copes with a slow or flaky geocoder, e.g. a stub that is slow in the tail and times out now and then:
+//
+//	stub -backend stub -timeout 300ms -chaos-latency percentiles:50=20ms,99=500ms -chaos-error-rate 0.1 London Paris
+
+// The exit status is the number of lookups that failed, capped at exitMaxFailures.
+// exitUsage is reserved for runs that could not start at all (bad flags, unreadable fixture, ...).
+const (
+	exitMaxFailures = 124
+	exitUsage       = 125
+)
+
+// lookupResult is one line of output.
+type lookupResult struct {
+	Address string
+	Lat     float64
+	Lng     float64
+	Err     error
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("geocode", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	backend := flags.String("backend", "real", "geocoding backend: real, stub or cache")
+	fixture := flags.String("fixture", "", "answer from this JSON fixture with the stub backend (fully offline)")
+	cacheFile := flags.String("cache-file", "", "JSON file the cache backend loads at start and saves at exit")
+	format := flags.String("format", "csv", "output format: csv, jsonl or geojson")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout for each lookup")
+	geocoderURL := flags.String("geocoder-url", DefaultGeocoderURL, "base URL of the Nominatim-compatible geocoding API")
+	chaosLatency := flags.String("chaos-latency", "", "add latency to every lookup: fixed:D, uniform:MIN,MAX, normal:MEAN,STDDEV or percentiles:P=D,...")
+	chaosErrorRate := flags.Float64("chaos-error-rate", 0, "fraction of lookups, between 0 and 1, that fail with an injected fault")
+	chaosSeed := flags.Uint64("chaos-seed", 1, "seed for the chaos latency and faults, for reproducible runs")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	backendSet := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "backend" {
+			backendSet = true
+		}
+	})
+	if *fixture != "" && backendSet && *backend != "stub" {
+		fmt.Fprintf(stderr, "geocode: -fixture cannot be combined with -backend=%s\n", *backend)
+		return exitUsage
+	}
+
+	var geoService GeoService
+	var cache *CachedGeoService
+	switch {
+	case *fixture != "":
+		entries, err := LoadFixture(*fixture)
+		if err != nil {
+			fmt.Fprintf(stderr, "geocode: %v\n", err)
+			return exitUsage
+		}
+		geoService = &StubGeoService{Fixture: entries}
+	case *backend == "real":
+		geoService = &RealGeoService{BaseURL: *geocoderURL}
+	case *backend == "stub":
+		geoService = &StubGeoService{}
+	case *backend == "cache":
+		cache = NewCachedGeoService(&RealGeoService{BaseURL: *geocoderURL})
+		if *cacheFile != "" {
+			if err := cache.Load(*cacheFile); err != nil {
+				fmt.Fprintf(stderr, "geocode: %v\n", err)
+				return exitUsage
+			}
+		}
+		geoService = cache
+	default:
+		fmt.Fprintf(stderr, "geocode: unknown backend %q\n", *backend)
+		return exitUsage
+	}
+
+	if *chaosLatency != "" || *chaosErrorRate != 0 {
+		config := ChaosConfig{ErrorRate: *chaosErrorRate, Seed: *chaosSeed}
+		if *chaosLatency != "" {
+			latency, err := ParseLatency(*chaosLatency)
+			if err != nil {
+				fmt.Fprintf(stderr, "geocode: %v\n", err)
+				return exitUsage
+			}
+			config.Latency = latency
+		}
+		if config.ErrorRate < 0 || config.ErrorRate > 1 {
+			fmt.Fprintf(stderr, "geocode: -chaos-error-rate must be between 0 and 1\n")
+			return exitUsage
+		}
+		chaos, err := NewChaosGeoService(geoService, config)
+		if err != nil {
+			fmt.Fprintf(stderr, "geocode: %v\n", err)
+			return exitUsage
+		}
+		geoService = chaos
+	}
+
+	out, err := newResultWriter(*format, stdout)
+	if err != nil {
+		fmt.Fprintf(stderr, "geocode: %v\n", err)
+		return exitUsage
+	}
+
+	failed := 0
+	err = forEachAddress(flags.Args(), stdin, func(address string) error {
+		result := lookup(ctx, geoService, address, *timeout)
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(stderr, "geocode: %v\n", result.Err)
+		}
+		return out.Write(result)
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "geocode: %v\n", err)
+		return exitUsage
+	}
+	if err := out.Close(); err != nil {
+		fmt.Fprintf(stderr, "geocode: writing output: %v\n", err)
+		return exitUsage
+	}
+
+	if cache != nil && *cacheFile != "" {
+		if err := cache.Save(*cacheFile); err != nil {
+			fmt.Fprintf(stderr, "geocode: saving cache: %v\n", err)
+		}
+	}
+
+	return min(failed, exitMaxFailures)
+}
+
+func lookup(ctx context.Context, geoService GeoService, address string, timeout time.Duration) lookupResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	lat, lng, err := GetCityCoordinates(ctx, geoService, address)
+	return lookupResult{Address: address, Lat: lat, Lng: lng, Err: err}
+}
+
+// forEachAddress calls fn with each address given as an argument, or with each non-blank line of stdin when there are none.
+func forEachAddress(args []string, stdin io.Reader, fn func(address string) error) error {
+	if len(args) > 0 {
+		for _, address := range args {
+			if err := fn(address); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		address := strings.TrimSpace(scanner.Text())
+		if address == "" {
+			continue
+		}
+		if err := fn(address); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading addresses: %w", err)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// output formats
+// ----------------------------------------------------------------------------
+
+type resultWriter interface {
+	Write(result lookupResult) error
+	Close() error
+}
+
+func newResultWriter(format string, w io.Writer) (resultWriter, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"address", "lat", "lng", "error"}); err != nil {
+			return nil, err
+		}
+		return &csvWriter{w: cw}, nil
+	case "jsonl":
+		return &jsonLinesWriter{enc: json.NewEncoder(w)}, nil
+	case "geojson":
+		return &geoJSONWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func formatCoordinate(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// csvWriter writes "address,lat,lng,error" rows; failed lookups leave lat and lng empty.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvWriter) Write(result lookupResult) error {
+	if result.Err != nil {
+		return cw.w.Write([]string{result.Address, "", "", result.Err.Error()})
+	}
+	return cw.w.Write([]string{result.Address, formatCoordinate(result.Lat), formatCoordinate(result.Lng), ""})
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// jsonLine is one line of jsonl output; failed lookups carry an error instead of coordinates.
+type jsonLine struct {
+	Address string   `json:"address"`
+	Lat     *float64 `json:"lat,omitempty"`
+	Lng     *float64 `json:"lng,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type jsonLinesWriter struct {
+	enc *json.Encoder
+}
+
+func (jw *jsonLinesWriter) Write(result lookupResult) error {
+	line := jsonLine{Address: result.Address}
+	if result.Err != nil {
+		line.Error = result.Err.Error()
+	} else {
+		line.Lat, line.Lng = &result.Lat, &result.Lng
+	}
+	return jw.enc.Encode(line)
+}
+
+func (jw *jsonLinesWriter) Close() error {
+	return nil
+}
+
+// geoJSONWriter streams a FeatureCollection, one Point feature per lookup.
+// Failed lookups become features with a null geometry and the error in their properties, which GeoJSON allows.
+type geoJSONWriter struct {
+	w        io.Writer
+	features int
+	err      error
+}
+
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   *geoJSONPoint     `json:"geometry"`
+	Properties map[string]string `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"` // GeoJSON order: longitude, latitude
+}
+
+func (gw *geoJSONWriter) Write(result lookupResult) error {
+	feature := geoJSONFeature{
+		Type:       "Feature",
+		Properties: map[string]string{"address": result.Address},
+	}
+	if result.Err != nil {
+		feature.Properties["error"] = result.Err.Error()
+	} else {
+		feature.Geometry = &geoJSONPoint{Type: "Point", Coordinates: [2]float64{result.Lng, result.Lat}}
+	}
+	data, err := json.Marshal(feature)
+	if err != nil {
+		return err
+	}
+	separator := ",\n"
+	if gw.features == 0 {
+		separator = `{"type":"FeatureCollection","features":[` + "\n"
+	}
+	gw.features++
+	return gw.write(separator, string(data))
+}
+
+func (gw *geoJSONWriter) Close() error {
+	if gw.features == 0 {
+		return gw.write(`{"type":"FeatureCollection","features":[]}` + "\n")
+	}
+	return gw.write("\n]}\n")
+}
+
+func (gw *geoJSONWriter) write(parts ...string) error {
+	for _, part := range parts {
+		if gw.err != nil {
+			break
+		}
+		_, gw.err = io.WriteString(gw.w, part)
+	}
+	return gw.err
+}
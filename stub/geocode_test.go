@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------
+// The geocode command-line tool, run fully offline with -fixture.
+// ----------------------------------------------------------------------------
+
+// runGeocode runs the command with args and stdin and returns its exit status and output.
+func runGeocode(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestGeocode(t *testing.T) {
+	// "csv from arguments":
+	// known cities are written with their coordinates, unknown ones with an error,
+	// and the exit status is the number of failed lookups.
+	t.Run("csv from arguments", func(t *testing.T) {
+		code, stdout, _ := runGeocode(t, "", "-fixture", "testdata/fixture.json", "Paris", "Atlantis", "Tokyo", "El Dorado")
+		if code != 2 {
+			t.Errorf("expected exit status 2, but got: %d", code)
+		}
+		lines := strings.Split(strings.TrimSpace(stdout), "\n")
+		expected := []string{
+			"address,lat,lng,error",
+			"Paris,48.8566,2.3522,",
+			`Atlantis,,,"stub geocoding ""Atlantis"": address not found"`,
+			"Tokyo,35.6769,139.7639,",
+			`El Dorado,,,"stub geocoding ""El Dorado"": address not found"`,
+		}
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("unexpected output:\n%s", stdout)
+		}
+	})
+
+	// "jsonl from stdin":
+	// without arguments the addresses are read from stdin, one per line, skipping blank lines.
+	t.Run("jsonl from stdin", func(t *testing.T) {
+		code, stdout, _ := runGeocode(t, "London\n\n  New York  \n", "-fixture", "testdata/fixture.json", "-format", "jsonl")
+		if code != 0 {
+			t.Errorf("expected exit status 0, but got: %d", code)
+		}
+		expected := `{"address":"London","lat":51.5074,"lng":-0.1278}` + "\n" +
+			`{"address":"New York","lat":40.7128,"lng":-74.006}` + "\n"
+		if stdout != expected {
+			t.Errorf("unexpected output:\n%s", stdout)
+		}
+	})
+
+	// "geojson feature collection":
+	// the output must be a valid FeatureCollection with [lng, lat] points and a null geometry for failures.
+	t.Run("geojson feature collection", func(t *testing.T) {
+		code, stdout, _ := runGeocode(t, "", "-backend", "stub", "-format", "geojson", "London", "Atlantis")
+		if code != 1 {
+			t.Errorf("expected exit status 1, but got: %d", code)
+		}
+		var collection struct {
+			Type     string
+			Features []struct {
+				Geometry *struct {
+					Type        string
+					Coordinates []float64
+				}
+				Properties map[string]string
+			}
+		}
+		if err := json.Unmarshal([]byte(stdout), &collection); err != nil {
+			t.Fatalf("invalid geojson: %v\n%s", err, stdout)
+		}
+		if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+			t.Fatalf("unexpected feature collection:\n%s", stdout)
+		}
+		london := collection.Features[0]
+		if london.Geometry == nil || london.Geometry.Coordinates[0] != -0.1278 || london.Geometry.Coordinates[1] != 51.5074 {
+			t.Errorf("unexpected geometry for London:\n%s", stdout)
+		}
+		if collection.Features[1].Geometry != nil || collection.Features[1].Properties["error"] == "" {
+			t.Errorf("expected a null geometry and an error for Atlantis:\n%s", stdout)
+		}
+	})
+
+	// "usage errors":
+	// runs that cannot start exit with exitUsage, which can't be confused with a failure count.
+	t.Run("usage errors", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"-format", "xml", "London"},
+			{"-backend", "carrier-pigeon", "London"},
+			{"-fixture", "testdata/missing.json", "London"},
+			{"-fixture", "testdata/fixture.json", "-backend", "real", "London"},
+		} {
+			if code, _, _ := runGeocode(t, "", args...); code != exitUsage {
+				t.Errorf("%v: expected exit status %d, but got: %d", args, exitUsage, code)
+			}
+		}
+	})
+}
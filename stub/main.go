@@ -1,6 +1,16 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+)
 
 // ----------------------------------------------------------------------------
 // A "stub" is an object that provides predefined answers to method calls.
@@ -8,17 +18,17 @@ import "fmt"
 
 // We define the GeoService interface and two structs: RealGeoService and StubGeoService.
 
-// The RealGeoService simulates a real geocoding service that would typically make an API call to retrieve the actual coordinates for a given address.
-// For simplicity, it returns dummy coordinates in this example.
+// The RealGeoService is a real geocoding service that makes an HTTP call to a Nominatim-compatible API to retrieve the actual coordinates for a given address.
 
 // The StubGeoService provides predefined coordinates for specific city names.
+// The predefined answers can also be loaded from a JSON fixture file, so the same stub can answer for any set of addresses.
 
 // The GetCityCoordinates function takes a GeoService interface and a city string.
 // It calls the GetCoordinates method of the provided geo service to retrieve the coordinates for the given city.
 
-// We demonstrate the usage of both the real geo service and the stub geo service.
-// When using the RealGeoService, it returns the dummy coordinates.
-// When using the StubGeoService, it returns the predefined coordinates for the specified city.
+// The geocode command-line tool (see geocode.go) lets you pick either service at runtime.
+// When using the RealGeoService, it asks the geocoding API for the coordinates.
+// When using the StubGeoService, it returns the predefined coordinates for the specified city, without touching the network.
 
 // The purpose of the stub geo service in this example is to provide predefined answers for specific inputs.
 // Instead of relying on a real geocoding service, which might be slow or have external dependencies, we use a stub that returns hardcoded coordinates for known cities.
@@ -28,46 +38,147 @@ import "fmt"
 // The stub geo service is primarily used in testing or in situations where you want to control the behaviour of the geocoding service for specific inputs.
 
 type GeoService interface {
-	GetCoordinates(address string) (float64, float64)
+	// GetCoordinates returns the latitude and longitude of address.
+	// If the service has no answer for the address it returns an error wrapping ErrAddressNotFound.
+	// If ctx is done before the answer is known it returns an error wrapping ctx.Err().
+	// Implementations must be safe for concurrent use; contract_test.go checks all of this.
+	GetCoordinates(ctx context.Context, address string) (float64, float64, error)
 }
 
-type RealGeoService struct{}
+// ErrAddressNotFound is the error every GeoService wraps when it cannot resolve an address.
+var ErrAddressNotFound = errors.New("address not found")
 
-func (gs *RealGeoService) GetCoordinates(address string) (float64, float64) {
-	// simulating a real geocoding service
-	// this would typically make an API call to a geocoding service
-	// and return the actual coordinates for the given address.
-	// for simplicity, we'll return dummy coordinates here.
-	return 37.7749, -122.4194
+// Coordinates is a latitude/longitude pair, as stored in fixture and cache files.
+type Coordinates struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// DefaultGeocoderURL is the Nominatim instance used when RealGeoService.BaseURL is empty.
+const DefaultGeocoderURL = "https://nominatim.openstreetmap.org"
+
+// defaultUserAgent identifies us to the geocoding API (Nominatim rejects requests without one).
+const defaultUserAgent = "go-test-doubles-geocode/1.0"
+
+type RealGeoService struct {
+	BaseURL   string       // defaults to DefaultGeocoderURL
+	Client    *http.Client // defaults to http.DefaultClient
+	UserAgent string       // defaults to defaultUserAgent
+}
+
+// nominatimPlace is the part of a Nominatim search result that we care about.
+// Nominatim encodes the coordinates as strings.
+type nominatimPlace struct {
+	Lat string `json:"lat"`
+	Lon string `json:"lon"`
+}
+
+func (gs *RealGeoService) GetCoordinates(ctx context.Context, address string) (float64, float64, error) {
+	baseURL := gs.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultGeocoderURL
+	}
+	client := gs.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	userAgent := gs.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	query := url.Values{}
+	query.Set("q", address)
+	query.Set("format", "jsonv2")
+	query.Set("limit", "1")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/search?"+query.Encode(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, fmt.Errorf("geocoding %q: %w", address, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("geocoding %q: unexpected status %s", address, resp.Status)
+	}
+
+	var places []nominatimPlace
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		return 0, 0, fmt.Errorf("geocoding %q: decoding response: %w", address, err)
+	}
+	if len(places) == 0 {
+		return 0, 0, fmt.Errorf("geocoding %q: %w", address, ErrAddressNotFound)
+	}
+	lat, err := strconv.ParseFloat(places[0].Lat, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("geocoding %q: bad latitude: %w", address, err)
+	}
+	lng, err := strconv.ParseFloat(places[0].Lon, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("geocoding %q: bad longitude: %w", address, err)
+	}
+	return lat, lng, nil
+}
+
+// defaultFixture holds the answers the stub gives when it has no fixture of its own.
+var defaultFixture = map[string]Coordinates{
+	"New York": {Lat: 40.7128, Lng: -74.0060},
+	"London":   {Lat: 51.5074, Lng: -0.1278},
 }
 
 // this is the "stub" an object that provides predefined answers to method calls
-type StubGeoService struct{}
+type StubGeoService struct {
+	// Fixture maps addresses to their predefined coordinates.
+	// When it is nil the stub answers for New York and London only.
+	Fixture map[string]Coordinates
+}
 
-func (gs *StubGeoService) GetCoordinates(address string) (float64, float64) {
+func (gs *StubGeoService) GetCoordinates(ctx context.Context, address string) (float64, float64, error) {
+	// a stub answers instantly, but it still behaves like the real service when the caller has given up
+	if err := ctx.Err(); err != nil {
+		return 0, 0, fmt.Errorf("stub geocoding %q: %w", address, err)
+	}
+	fixture := gs.Fixture
+	if fixture == nil {
+		fixture = defaultFixture
+	}
 	// return predefined coordinates for specific addresses
-	if address == "New York" {
-		return 40.7128, -74.0060
-	} else if address == "London" {
-		return 51.5074, -0.1278
+	if c, ok := fixture[address]; ok {
+		return c.Lat, c.Lng, nil
+	}
+	return 0, 0, fmt.Errorf("stub geocoding %q: %w", address, ErrAddressNotFound)
+}
+
+// LoadFixture reads a JSON object mapping addresses to coordinates, e.g.
+//
+//	{"New York": {"lat": 40.7128, "lng": -74.0060}}
+//
+// The same format is written by CachedGeoService.Save, so a cache file from an online run can be replayed offline.
+func LoadFixture(path string) (map[string]Coordinates, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fixture := make(map[string]Coordinates)
+	if err := json.NewDecoder(f).Decode(&fixture); err != nil {
+		return nil, fmt.Errorf("reading fixture %s: %w", path, err)
 	}
-	return 0, 0
+	return fixture, nil
 }
 
-func GetCityCoordinates(geoService GeoService, city string) (float64, float64) {
-	return geoService.GetCoordinates(city)
+func GetCityCoordinates(ctx context.Context, geoService GeoService, city string) (float64, float64, error) {
+	return geoService.GetCoordinates(ctx, city)
 }
 
 func main() {
-	city := "New York"
-
-	// using a real geo service
-	realGeoService := &RealGeoService{}
-	lat, lng := GetCityCoordinates(realGeoService, city)
-	fmt.Printf("Real GeoService - Coordinates for %s: (%.4f, %.4f)\n", city, lat, lng)
-
-	// using a stub geo service (! typically only used in the tests)
-	stubGeoService := &StubGeoService{}
-	lat, lng = GetCityCoordinates(stubGeoService, city)
-	fmt.Printf("Stub GeoService - Coordinates for %s: (%.4f, %.4f)\n", city, lat, lng)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
 }
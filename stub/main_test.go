@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -11,16 +16,37 @@ import (
 // TestGetCityCoordinates tests the GetCityCoordinates function with both the real geo service and the stub geo service.
 
 func TestGetCityCoordinates(t *testing.T) {
+	ctx := context.Background()
+
 	// with real geo service:
 	// It creates an instance of RealGeoService and passes it to GetCityCoordinates.
-	// Since the real geo service returns dummy coordinates, we can only assert that the returned coordinates are within an acceptable range.
+	// So that the test does not depend on the network, the service talks to a local httptest server that answers like the geocoding API would.
+	// We assert that the coordinates in the response are parsed correctly.
 	t.Run("with real geo service", func(t *testing.T) {
-		realGeoService := &RealGeoService{}
-		lat, lng := GetCityCoordinates(realGeoService, "New York")
-		// assert that the returned coordinates are within an acceptable range
-		if lat < 37 || lat > 38 || lng < -123 || lng > -122 {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/search" || r.URL.Query().Get("q") != "New York" {
+				fmt.Fprint(w, `[]`)
+				return
+			}
+			fmt.Fprint(w, `[{"lat":"40.7127281","lon":"-74.0060152","display_name":"City of New York"}]`)
+		}))
+		defer server.Close()
+
+		realGeoService := &RealGeoService{BaseURL: server.URL}
+		lat, lng, err := GetCityCoordinates(ctx, realGeoService, "New York")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// assert that the returned coordinates are the ones from the response
+		if lat != 40.7127281 || lng != -74.0060152 {
 			t.Errorf("unexpected coordinates for New York: (%.4f, %.4f)", lat, lng)
 		}
+
+		// an empty result list means the address is unknown
+		_, _, err = GetCityCoordinates(ctx, realGeoService, "Atlantis")
+		if !errors.Is(err, ErrAddressNotFound) {
+			t.Errorf("expected ErrAddressNotFound for Atlantis, but got: %v", err)
+		}
 	})
 
 	// with stub geo service:
@@ -28,7 +54,10 @@ func TestGetCityCoordinates(t *testing.T) {
 	// We assert that the returned coordinates match the predefined values for the specified city (New York in this case).
 	t.Run("with stub geo service", func(t *testing.T) {
 		stubGeoService := &StubGeoService{}
-		lat, lng := GetCityCoordinates(stubGeoService, "New York")
+		lat, lng, err := GetCityCoordinates(ctx, stubGeoService, "New York")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
 		// assert that the returned coordinates match the predefined values
 		expectedLat, expectedLng := 40.7128, -74.0060
 		if lat != expectedLat || lng != expectedLng {
@@ -36,4 +65,46 @@ func TestGetCityCoordinates(t *testing.T) {
 				expectedLat, expectedLng, lat, lng)
 		}
 	})
+
+	// with stub geo service and a fixture:
+	// The fixture replaces the built-in answers, so cities outside of it are unknown.
+	t.Run("with stub geo service and a fixture", func(t *testing.T) {
+		fixture, err := LoadFixture("testdata/fixture.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stubGeoService := &StubGeoService{Fixture: fixture}
+		lat, lng, err := GetCityCoordinates(ctx, stubGeoService, "Paris")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if lat != 48.8566 || lng != 2.3522 {
+			t.Errorf("unexpected coordinates for Paris: (%.4f, %.4f)", lat, lng)
+		}
+		_, _, err = GetCityCoordinates(ctx, stubGeoService, "Atlantis")
+		if !errors.Is(err, ErrAddressNotFound) {
+			t.Errorf("expected ErrAddressNotFound for Atlantis, but got: %v", err)
+		}
+	})
+
+	// with cached geo service:
+	// The cache sits in front of a real geo service and should only ask it once per address.
+	t.Run("with cached geo service", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			fmt.Fprint(w, `[{"lat":"51.5074","lon":"-0.1278"}]`)
+		}))
+		defer server.Close()
+
+		cachedGeoService := NewCachedGeoService(&RealGeoService{BaseURL: server.URL})
+		for range 3 {
+			if _, _, err := GetCityCoordinates(ctx, cachedGeoService, "London"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if requests != 1 {
+			t.Errorf("expected 1 request to the geocoding API, but got: %d", requests)
+		}
+	})
 }